@@ -1,24 +1,32 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/hound-search/hound/auth"
 	"github.com/hound-search/hound/config"
 	"github.com/hound-search/hound/index"
+	"github.com/hound-search/hound/metrics"
 	"github.com/hound-search/hound/searcher"
+	"github.com/hound-search/hound/vcs"
 )
 
 // SearcherProvider provides access to searchers
 type SearcherProvider interface {
 	GetSearchers() map[string]*searcher.Searcher
 	AddSearcher(name string, s *searcher.Searcher)
+	RemoveSearcher(name string)
+	ReplaceSearcher(name string, s *searcher.Searcher) *searcher.Searcher
 	GetConfig() *config.Config
 	GetConfigFile() string
 }
@@ -27,6 +35,7 @@ const (
 	defaultLinesOfContext uint = 2
 	maxLinesOfContext     uint = 20
 	maxLimit              int  = 100000
+	defaultCommitLimit    int  = 100
 )
 
 type Stats struct {
@@ -36,7 +45,6 @@ type Stats struct {
 
 func writeJson(w http.ResponseWriter, data interface{}, status int) {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(data); err != nil {
 		log.Panicf("Failed to encode JSON: %v\n", err)
@@ -53,44 +61,101 @@ func writeError(w http.ResponseWriter, err error, status int) {
 	}, status)
 }
 
+var (
+	searchSeconds = metrics.NewHistogramVec(
+		"hound_search_duration_seconds",
+		"Time taken to search a repo.",
+		metrics.DurationBuckets,
+		"repo")
+	searchFilesOpened = metrics.NewHistogramVec(
+		"hound_search_files_opened",
+		"Number of files opened to search a repo.",
+		metrics.CountBuckets,
+		"repo")
+)
+
 type searchResponse struct {
 	repo string
 	res  *index.SearchResponse
 	err  error
 }
 
+// A single line of the streaming search response. Each record holds either the
+// results for one repo, the error from searching one repo or the final stats
+// for the search along with the repos whose results were truncated.
+type streamRecord struct {
+	Repo      string                `json:",omitempty"`
+	Result    *index.SearchResponse `json:",omitempty"`
+	Error     string                `json:",omitempty"`
+	Stats     *Stats                `json:",omitempty"`
+	Truncated []string              `json:",omitempty"`
+}
+
 /**
- * Searches all repos in parallel.
+ * Starts a search of all repos in parallel. Exactly one response per repo
+ * will be delivered on the returned channel, in the order they complete.
+ * A repo can be given as repo@ref to search the index of one of its refs.
  */
-func searchAll(
+func searchEach(
+	ctx context.Context,
 	query string,
 	opts *index.SearchOptions,
 	repos []string,
-	idx map[string]*searcher.Searcher,
-	filesOpened *int,
-	duration *int) (map[string]*index.SearchResponse, error) {
-
-	startedAt := time.Now()
-
-	n := len(repos)
+	idx map[string]*searcher.Searcher) <-chan *searchResponse {
 
 	// use a buffered channel to avoid routine leaks on errs.
-	ch := make(chan *searchResponse, n)
+	ch := make(chan *searchResponse, len(repos))
 	for _, repo := range repos {
 		go func(repo string) {
-			fms, err := idx[repo].Search(query, opts)
+			name, ref := splitRepoRef(repo, idx)
+			startedAt := time.Now()
+			fms, err := idx[name].SearchRef(ctx, ref, query, opts)
+			searchSeconds.Observe(time.Since(startedAt).Seconds(), name)
+			if err == nil {
+				searchFilesOpened.Observe(float64(fms.FilesOpened), name)
+			}
 			ch <- &searchResponse{repo, fms, err}
 		}(repo)
 	}
 
+	return ch
+}
+
+/**
+ * Searches all repos in parallel. An error in one repo does not fail the
+ * whole search; instead it is reported in the returned map of errors by
+ * repo. Only if every repo fails (as with a bad pattern) is an error returned.
+ */
+func searchAll(
+	ctx context.Context,
+	query string,
+	opts *index.SearchOptions,
+	repos []string,
+	idx map[string]*searcher.Searcher,
+	filesOpened *int,
+	duration *int) (map[string]*index.SearchResponse, map[string]string, error) {
+
+	startedAt := time.Now()
+
+	n := len(repos)
+	ch := searchEach(ctx, query, opts, repos, idx)
+
 	res := map[string]*index.SearchResponse{}
+	errs := map[string]string{}
+	var firstErr error
 	for i := 0; i < n; i++ {
 		r := <-ch
 		if r.err != nil {
-			return nil, r.err
+			log.Printf("search failed (%s): %s", r.repo, r.err)
+			errs[r.repo] = r.err.Error()
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
 		}
 
-		if r.res.Matches == nil {
+		// A repo that ran out of time is reported even without matches.
+		if r.res.Matches == nil && !r.res.Truncated {
 			continue
 		}
 
@@ -98,9 +163,26 @@ func searchAll(
 		*filesOpened += r.res.FilesOpened
 	}
 
+	if n > 0 && len(errs) == n {
+		return nil, nil, firstErr
+	}
+
 	*duration = int(time.Now().Sub(startedAt).Seconds() * 1000) //nolint
 
-	return res, nil
+	return res, errs, nil
+}
+
+// The sorted names of the repos whose search was cut short, so that their
+// results are incomplete.
+func truncatedRepos(res map[string]*index.SearchResponse) []string {
+	var repos []string
+	for repo, r := range res {
+		if r.Truncated {
+			repos = append(repos, repo)
+		}
+	}
+	sort.Strings(repos)
+	return repos
 }
 
 // Used for parsing flags from form values.
@@ -109,6 +191,18 @@ func parseAsBool(v string) bool {
 	return v == "true" || v == "1" || v == "fosho"
 }
 
+// The searchers for the repos that the client of the request may see.
+func visibleSearchers(r *http.Request, idx map[string]*searcher.Searcher) map[string]*searcher.Searcher {
+	id := auth.FromContext(r.Context())
+	res := make(map[string]*searcher.Searcher, len(idx))
+	for name, s := range idx {
+		if id.CanSee(s.Repo) {
+			res[name] = s
+		}
+	}
+	return res
+}
+
 func parseAsRepoList(v string, idx map[string]*searcher.Searcher) []string {
 	v = strings.TrimSpace(v)
 	var repos []string
@@ -120,7 +214,7 @@ func parseAsRepoList(v string, idx map[string]*searcher.Searcher) []string {
 	}
 
 	for _, repo := range strings.Split(v, ",") {
-		if idx[repo] == nil {
+		if name, _ := splitRepoRef(repo, idx); idx[name] == nil {
 			continue
 		}
 		repos = append(repos, repo)
@@ -128,6 +222,63 @@ func parseAsRepoList(v string, idx map[string]*searcher.Searcher) []string {
 	return repos
 }
 
+// Split a repo of the form repo@ref into its name and ref. The ref is empty
+// for the repo's default ref. Repo names may contain @ themselves, so v is only
+// split at its last @, and only when that leaves the name of a known repo.
+func splitRepoRef(v string, idx map[string]*searcher.Searcher) (string, string) {
+	if idx[v] != nil {
+		return v, ""
+	}
+
+	if i := strings.LastIndex(v, "@"); i >= 0 && idx[v[:i]] != nil {
+		return v[:i], v[i+1:]
+	}
+	return v, ""
+}
+
+// The refs to search, from the comma separated lists in the ref and branches
+// form values.
+func parseAsRefList(r *http.Request) []string {
+	var refs []string
+	for _, v := range []string{r.FormValue("ref"), r.FormValue("branches")} {
+		for _, ref := range strings.Split(v, ",") {
+			if ref = strings.TrimSpace(ref); ref != "" {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs
+}
+
+// Expand each repo into a repo@ref for every one of the refs that the repo
+// indexes, with * selecting all of them. Repos that do not index any of the
+// refs, including those that only index a single ref, are left out, while
+// repos that already name a ref are kept. Without refs the repos are returned
+// as they are.
+func withRefs(repos, refs []string, idx map[string]*searcher.Searcher) []string {
+	if len(refs) == 0 {
+		return repos
+	}
+
+	var res []string
+	for _, repo := range repos {
+		if _, ref := splitRepoRef(repo, idx); ref != "" {
+			res = append(res, repo)
+			continue
+		}
+
+		for _, ref := range idx[repo].Refs() {
+			for _, want := range refs {
+				if want == "*" || want == ref {
+					res = append(res, repo+"@"+ref)
+					break
+				}
+			}
+		}
+	}
+	return res
+}
+
 func parseAsUintValue(sv string, min, max, def uint) uint {
 	iv, err := strconv.ParseUint(sv, 10, 54)
 	if err != nil {
@@ -182,13 +333,362 @@ func parseRangeValue(rv string) (int, int) {
 	return b, e
 }
 
+// Serializes changes to the set of repos and to the config file.
+var reposLck sync.Mutex
+
+// Persist the config to the provider's config file.
+func saveConfig(provider SearcherProvider, cfg *config.Config) error {
+	configFile := provider.GetConfigFile()
+	if configFile == "" {
+		configFile = "config.json"
+	}
+	return cfg.SaveToFile(configFile)
+}
+
+// The fields of a repo that can be changed through the API. Fields that are
+// absent from the request are left unchanged.
+type repoPatch struct {
+	Ref                *string            `json:"ref"`
+	DisplayName        *string            `json:"display-name"`
+	MsBetweenPolls     *int               `json:"ms-between-poll"`
+	MsCommandTimeout   *int               `json:"ms-command-timeout"`
+	UrlPattern         *config.UrlPattern `json:"url-pattern"`
+	ExcludeDotFiles    *bool              `json:"exclude-dot-files"`
+	EnablePollUpdates  *bool              `json:"enable-poll-updates"`
+	EnablePushUpdates  *bool              `json:"enable-push-updates"`
+	Groups             *[]string          `json:"groups"`
+	IncludePaths       *[]string          `json:"include-paths"`
+	ExcludePaths       *[]string          `json:"exclude-paths"`
+	UseGitignore       *bool              `json:"use-gitignore"`
+	ContentStore       *string            `json:"content-store"`
+	ContentCompression *string            `json:"content-compression"`
+}
+
+// Apply the patch to a copy of the given repo.
+func (p *repoPatch) apply(repo *config.Repo) (*config.Repo, error) {
+	r := *repo
+
+	if p.DisplayName != nil {
+		r.DisplayName = *p.DisplayName
+	}
+
+	if p.MsBetweenPolls != nil {
+		r.MsBetweenPolls = *p.MsBetweenPolls
+	}
+
+	if p.MsCommandTimeout != nil {
+		r.MsCommandTimeout = *p.MsCommandTimeout
+	}
+
+	if p.UrlPattern != nil {
+		r.UrlPattern = p.UrlPattern
+	}
+
+	if p.ExcludeDotFiles != nil {
+		r.ExcludeDotFiles = *p.ExcludeDotFiles
+	}
+
+	if p.EnablePollUpdates != nil {
+		r.EnablePollUpdates = p.EnablePollUpdates
+	}
+
+	if p.EnablePushUpdates != nil {
+		r.EnablePushUpdates = p.EnablePushUpdates
+	}
+
+	if p.Groups != nil {
+		r.Groups = *p.Groups
+	}
+
+	if p.IncludePaths != nil {
+		r.IncludePaths = *p.IncludePaths
+	}
+
+	if p.ExcludePaths != nil {
+		r.ExcludePaths = *p.ExcludePaths
+	}
+
+	if p.UseGitignore != nil {
+		r.UseGitignore = *p.UseGitignore
+	}
+
+	if p.ContentStore != nil {
+		r.ContentStore = *p.ContentStore
+	}
+
+	if p.ContentCompression != nil {
+		r.ContentCompression = *p.ContentCompression
+	}
+
+	if p.Ref != nil {
+		msg, err := vcsConfigWithRef(repo.VcsConfig(), *p.Ref)
+		if err != nil {
+			return nil, err
+		}
+		r.VcsConfigMessage = msg
+	}
+
+	config.InitRepo(&r)
+
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// Return a copy of the given vcs-config with its ref set to the given value.
+// An empty ref removes the ref from the vcs-config.
+func vcsConfigWithRef(vcsConfig []byte, ref string) (*config.SecretMessage, error) {
+	vals := map[string]interface{}{}
+	if len(vcsConfig) > 0 {
+		if err := json.Unmarshal(vcsConfig, &vals); err != nil {
+			return nil, err
+		}
+	}
+
+	if ref == "" {
+		delete(vals, "ref")
+	} else {
+		vals["ref"] = ref
+	}
+
+	b, err := json.Marshal(vals)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := config.SecretMessage(b)
+	return &msg, nil
+}
+
+// Remove a repo from the config file and stop serving it. Its searcher is
+// stopped and its index and working directory are deleted in the background.
+func deleteRepo(w http.ResponseWriter, provider SearcherProvider, name string) {
+	reposLck.Lock()
+	defer reposLck.Unlock()
+
+	if job := jobFor(name); job != nil && job.inProgress() {
+		writeError(w, fmt.Errorf("Repository %s is still being built", name), http.StatusConflict)
+		return
+	}
+
+	idx := provider.GetSearchers()
+	s := idx[name]
+	if s == nil {
+		writeError(w, fmt.Errorf("No such repository: %s", name), http.StatusNotFound)
+		return
+	}
+
+	cfg := provider.GetConfig()
+	if cfg == nil {
+		writeError(w, errors.New("Config not available"), http.StatusInternalServerError)
+		return
+	}
+
+	repo := cfg.Repos[name]
+	delete(cfg.Repos, name)
+	if err := saveConfig(provider, cfg); err != nil {
+		cfg.Repos[name] = repo
+		writeError(w, fmt.Errorf("Failed to save config: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	provider.RemoveSearcher(name)
+	removeJob(name)
+	go destroySearcher(provider, name, s)
+
+	writeResp(w, map[string]string{
+		"status":  "ok",
+		"message": fmt.Sprintf("Repository %s removed successfully", name),
+	})
+}
+
+// Report the phase of a repo. Repos that were added through the API report the
+// progress of their job, any other repo with a searcher is ready.
+func repoStatus(w http.ResponseWriter, r *http.Request, provider SearcherProvider, name string) {
+	s := visibleSearchers(r, provider.GetSearchers())[name]
+
+	job := jobFor(name)
+	if job != nil && !auth.FromContext(r.Context()).CanSee(job.repo) {
+		job = nil
+	}
+
+	if job == nil {
+		if s == nil {
+			writeError(w, fmt.Errorf("No such repository: %s", name), http.StatusNotFound)
+			return
+		}
+
+		job = &repoJob{
+			Repo:  name,
+			Phase: searcher.PhaseReady,
+		}
+	}
+
+	if s != nil {
+		status := s.Status()
+		job.Index = &status
+	}
+
+	writeResp(w, job)
+}
+
+// List the revisions of a repo that were indexed on demand, or request an index
+// of a revision such as a tag. Once indexed, a revision is searched by passing
+// repo@rev in the repos of a search.
+func repoRevs(w http.ResponseWriter, r *http.Request, provider SearcherProvider, name string) {
+	s := visibleSearchers(r, provider.GetSearchers())[name]
+	if s == nil {
+		writeError(w, fmt.Errorf("No such repository: %s", name), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeResp(w, s.Revs())
+	case "POST":
+		var req struct {
+			Rev string `json:"rev"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, fmt.Errorf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		status, err := s.IndexRev(req.Rev)
+		if err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		writeJson(w, status, http.StatusAccepted)
+	default:
+		writeError(w,
+			errors.New(http.StatusText(http.StatusMethodNotAllowed)),
+			http.StatusMethodNotAllowed)
+	}
+}
+
+// Change the config of a repo and rebuild its searcher in the background, like
+// a repo that is added. The current searcher keeps serving the repo until the
+// new one is ready, and if the build fails the old config is restored.
+func patchRepo(w http.ResponseWriter, r *http.Request, provider SearcherProvider, name string) {
+	var req repoPatch
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, fmt.Errorf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	reposLck.Lock()
+	defer reposLck.Unlock()
+
+	old := provider.GetSearchers()[name]
+	if old == nil {
+		writeError(w, fmt.Errorf("No such repository: %s", name), http.StatusNotFound)
+		return
+	}
+
+	if job := jobFor(name); job != nil && job.inProgress() {
+		writeError(w, fmt.Errorf("Repository %s is still being built", name), http.StatusConflict)
+		return
+	}
+
+	cfg := provider.GetConfig()
+	if cfg == nil {
+		writeError(w, errors.New("Config not available"), http.StatusInternalServerError)
+		return
+	}
+
+	repo, err := req.apply(old.Repo)
+	if err != nil {
+		writeError(w, fmt.Errorf("Invalid repo config: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := vcs.New(repo.Vcs, repo.VcsConfig()); err != nil {
+		writeError(w, fmt.Errorf("Invalid vcs config: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	cfg.Repos[name] = repo
+	if err := saveConfig(provider, cfg); err != nil {
+		cfg.Repos[name] = old.Repo
+		writeError(w, fmt.Errorf("Failed to save config: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	job := buildSearcher(cfg, name, repo, old, func(s *searcher.Searcher, err error) {
+		if err != nil {
+			log.Printf("failed to rebuild repository %s, its previous config is restored: %s", name, err)
+
+			// Restore the old config on error
+			reposLck.Lock()
+			if cfg.Repos[name] == repo {
+				cfg.Repos[name] = old.Repo
+				if err := saveConfig(provider, cfg); err != nil {
+					log.Printf("failed to save config: %s", err)
+				}
+			}
+			reposLck.Unlock()
+			return
+		}
+
+		replaceSearcher(provider, name, s)
+	})
+
+	writeJson(w, map[string]string{
+		"status":  "accepted",
+		"id":      job.Id,
+		"message": fmt.Sprintf("Repository %s is being updated", name),
+	}, http.StatusAccepted)
+}
+
+// Create the context for a search request. The search is cancelled when the
+// client goes away or when the configured time budget is exhausted.
+func searchContext(r *http.Request, cfg *config.Config) (context.Context, context.CancelFunc) {
+	if cfg != nil && cfg.SearchTimeout() > 0 {
+		return context.WithTimeout(r.Context(), cfg.SearchTimeout())
+	}
+	return context.WithCancel(r.Context())
+}
+
+// Parse the query, the repos to search and the search options from the form
+// values of a search request.
+func parseSearchRequest(
+	r *http.Request,
+	idx map[string]*searcher.Searcher,
+	defaultMaxResults int) (string, []string, *index.SearchOptions) {
+	var opt index.SearchOptions
+
+	repos := withRefs(parseAsRepoList(r.FormValue("repos"), idx), parseAsRefList(r), idx)
+	query := r.FormValue("q")
+	opt.Offset, opt.Limit = parseRangeValue(r.FormValue("rng"))
+	opt.FileRegexp = r.FormValue("files")
+	opt.ExcludeFileRegexp = r.FormValue("excludeFiles")
+	opt.IgnoreCase = parseAsBool(r.FormValue("i"))
+	opt.LiteralSearch = parseAsBool(r.FormValue("literal"))
+	opt.MaxResults = parseAsIntValue(
+		r.FormValue("limit"),
+		-1,
+		maxLimit,
+		defaultMaxResults)
+	opt.LinesOfContext = parseAsUintValue(
+		r.FormValue("ctx"),
+		0,
+		maxLinesOfContext,
+		defaultLinesOfContext)
+
+	return query, repos, &opt
+}
+
 func Setup(m *http.ServeMux, provider SearcherProvider, defaultMaxResults int) {
 	getIdx := func() map[string]*searcher.Searcher {
 		return provider.GetSearchers()
 	}
 
 	m.HandleFunc("/api/v1/repos", func(w http.ResponseWriter, r *http.Request) {
-		idx := getIdx()
+		idx := visibleSearchers(r, getIdx())
 		res := map[string]*config.Repo{}
 		for name, srch := range idx {
 			res[name] = srch.Repo
@@ -198,32 +698,17 @@ func Setup(m *http.ServeMux, provider SearcherProvider, defaultMaxResults int) {
 	})
 
 	m.HandleFunc("/api/v1/search", func(w http.ResponseWriter, r *http.Request) {
-		idx := getIdx()
-		var opt index.SearchOptions
-
+		idx := visibleSearchers(r, getIdx())
 		stats := parseAsBool(r.FormValue("stats"))
-		repos := parseAsRepoList(r.FormValue("repos"), idx)
-		query := r.FormValue("q")
-		opt.Offset, opt.Limit = parseRangeValue(r.FormValue("rng"))
-		opt.FileRegexp = r.FormValue("files")
-		opt.ExcludeFileRegexp = r.FormValue("excludeFiles")
-		opt.IgnoreCase = parseAsBool(r.FormValue("i"))
-		opt.LiteralSearch = parseAsBool(r.FormValue("literal"))
-		opt.MaxResults = parseAsIntValue(
-			r.FormValue("limit"),
-			-1,
-			maxLimit,
-			defaultMaxResults)
-		opt.LinesOfContext = parseAsUintValue(
-			r.FormValue("ctx"),
-			0,
-			maxLinesOfContext,
-			defaultLinesOfContext)
+		query, repos, opt := parseSearchRequest(r, idx, defaultMaxResults)
 
 		var filesOpened int
 		var durationMs int
 
-		results, err := searchAll(query, &opt, repos, idx, &filesOpened, &durationMs)
+		ctx, cancel := searchContext(r, provider.GetConfig())
+		defer cancel()
+
+		results, errs, err := searchAll(ctx, query, opt, repos, idx, &filesOpened, &durationMs)
 		if err != nil {
 			// TODO(knorton): Return ok status because the UI expects it for now.
 			writeError(w, err, http.StatusOK)
@@ -231,11 +716,15 @@ func Setup(m *http.ServeMux, provider SearcherProvider, defaultMaxResults int) {
 		}
 
 		var res struct {
-			Results map[string]*index.SearchResponse
-			Stats   *Stats `json:",omitempty"`
+			Results   map[string]*index.SearchResponse
+			Errors    map[string]string `json:",omitempty"`
+			Truncated []string          `json:",omitempty"`
+			Stats     *Stats            `json:",omitempty"`
 		}
 
 		res.Results = results
+		res.Errors = errs
+		res.Truncated = truncatedRepos(results)
 		if stats {
 			res.Stats = &Stats{
 				FilesOpened: filesOpened,
@@ -246,8 +735,113 @@ func Setup(m *http.ServeMux, provider SearcherProvider, defaultMaxResults int) {
 		writeResp(w, &res)
 	})
 
+	m.HandleFunc("/api/v1/search/stream", func(w http.ResponseWriter, r *http.Request) {
+		idx := visibleSearchers(r, getIdx())
+		query, repos, opt := parseSearchRequest(r, idx, defaultMaxResults)
+
+		ctx, cancel := searchContext(r, provider.GetConfig())
+		defer cancel()
+
+		startedAt := time.Now()
+		ch := searchEach(ctx, query, opt, repos, idx)
+
+		w.Header().Set("Content-Type", "application/x-ndjson;charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+
+		enc := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+		write := func(rec *streamRecord) error {
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}
+
+		var filesOpened int
+		var truncated []string
+		for i, n := 0, len(repos); i < n; i++ {
+			res := <-ch
+			if res.err != nil {
+				if err := write(&streamRecord{Repo: res.repo, Error: res.err.Error()}); err != nil {
+					log.Printf("Failed to write search stream: %v\n", err)
+					return
+				}
+				continue
+			}
+
+			if res.res.Matches == nil && !res.res.Truncated {
+				continue
+			}
+			filesOpened += res.res.FilesOpened
+			if res.res.Truncated {
+				truncated = append(truncated, res.repo)
+			}
+
+			if err := write(&streamRecord{Repo: res.repo, Result: res.res}); err != nil {
+				log.Printf("Failed to write search stream: %v\n", err)
+				return
+			}
+		}
+
+		sort.Strings(truncated)
+		write(&streamRecord{ //nolint
+			Stats: &Stats{
+				FilesOpened: filesOpened,
+				Duration:    int(time.Now().Sub(startedAt).Seconds() * 1000), //nolint
+			},
+			Truncated: truncated,
+		})
+	})
+
+	m.HandleFunc("/api/v1/commits", func(w http.ResponseWriter, r *http.Request) {
+		idx := visibleSearchers(r, getIdx())
+		repos := withRefs(parseAsRepoList(r.FormValue("repos"), idx), parseAsRefList(r), idx)
+
+		opt := searcher.CommitSearchOptions{
+			MessageRegexp:     r.FormValue("q"),
+			AuthorRegexp:      r.FormValue("author"),
+			FileRegexp:        r.FormValue("files"),
+			ExcludeFileRegexp: r.FormValue("excludeFiles"),
+			IgnoreCase:        parseAsBool(r.FormValue("i")),
+		}
+		opt.Offset, opt.Limit = parseRangeValue(r.FormValue("rng"))
+		if opt.Limit == 0 {
+			opt.Limit = defaultCommitLimit
+		}
+
+		var res struct {
+			Results map[string]*searcher.CommitSearchResponse
+			Errors  map[string]string `json:",omitempty"`
+		}
+		res.Results = map[string]*searcher.CommitSearchResponse{}
+		res.Errors = map[string]string{}
+
+		// Repos whose history is not kept are left out.
+		for _, repo := range repos {
+			name, ref := splitRepoRef(repo, idx)
+			if !idx[name].HasHistory() {
+				continue
+			}
+
+			cr, err := idx[name].SearchCommits(ref, &opt)
+			if err != nil {
+				res.Errors[repo] = err.Error()
+				continue
+			}
+
+			if cr.Total > 0 {
+				res.Results[repo] = cr
+			}
+		}
+
+		writeResp(w, &res)
+	})
+
 	m.HandleFunc("/api/v1/excludes", func(w http.ResponseWriter, r *http.Request) {
-		idx := getIdx()
+		idx := visibleSearchers(r, getIdx())
 		repo := r.FormValue("repo")
 		searcher := idx[repo]
 		if searcher == nil {
@@ -256,7 +850,6 @@ func Setup(m *http.ServeMux, provider SearcherProvider, defaultMaxResults int) {
 		}
 		res := searcher.GetExcludedFiles()
 		w.Header().Set("Content-Type", "application/json;charset=utf-8")
-		w.Header().Set("Access-Control-Allow", "*")
 		fmt.Fprint(w, res)
 	})
 
@@ -268,7 +861,7 @@ func Setup(m *http.ServeMux, provider SearcherProvider, defaultMaxResults int) {
 			return
 		}
 
-		idx := getIdx()
+		idx := visibleSearchers(r, getIdx())
 		repos := parseAsRepoList(r.FormValue("repos"), idx)
 
 		for _, repo := range repos {
@@ -292,6 +885,32 @@ func Setup(m *http.ServeMux, provider SearcherProvider, defaultMaxResults int) {
 		writeResp(w, "ok")
 	})
 
+	m.HandleFunc("/api/v1/config/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w,
+				errors.New(http.StatusText(http.StatusMethodNotAllowed)),
+				http.StatusMethodNotAllowed)
+			return
+		}
+
+		res, err := ReloadConfig(provider)
+		if err != nil {
+			writeError(w, fmt.Errorf("Failed to reload config: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		writeResp(w, res)
+	})
+
+	m.HandleFunc("/api/v1/repos/status", func(w http.ResponseWriter, r *http.Request) {
+		res := map[string]searcher.Status{}
+		for name, s := range visibleSearchers(r, getIdx()) {
+			res[name] = s.Status()
+		}
+
+		writeResp(w, res)
+	})
+
 	m.HandleFunc("/api/v1/repos/add", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			writeError(w,
@@ -300,9 +919,11 @@ func Setup(m *http.ServeMux, provider SearcherProvider, defaultMaxResults int) {
 			return
 		}
 
+		// The request is the repo as it would appear in the config file along
+		// with its name. branch is a shorthand for the ref in vcs-config.
 		var req struct {
+			config.Repo
 			Name   string `json:"name"`
-			Url    string `json:"url"`
 			Branch string `json:"branch"`
 		}
 
@@ -316,40 +937,50 @@ func Setup(m *http.ServeMux, provider SearcherProvider, defaultMaxResults int) {
 			return
 		}
 
-		idx := getIdx()
-		if idx[req.Name] != nil {
-			writeError(w, fmt.Errorf("Repository %s already exists", req.Name), http.StatusConflict)
+		repo := &req.Repo
+		if req.Branch != "" {
+			msg, err := vcsConfigWithRef(repo.VcsConfig(), req.Branch)
+			if err != nil {
+				writeError(w, fmt.Errorf("Invalid vcs config: %v", err), http.StatusBadRequest)
+				return
+			}
+			repo.VcsConfigMessage = msg
+		}
+
+		// Initialize repo with defaults
+		config.InitRepo(repo)
+
+		if err := repo.Validate(); err != nil {
+			writeError(w, fmt.Errorf("Invalid repo config: %v", err), http.StatusBadRequest)
 			return
 		}
 
+		reposLck.Lock()
+		defer reposLck.Unlock()
+
 		cfg := provider.GetConfig()
 		if cfg == nil {
 			writeError(w, errors.New("Config not available"), http.StatusInternalServerError)
 			return
 		}
 
-		// Create new repo config
-		repo := &config.Repo{
-			Url: req.Url,
-			Vcs: "git",
+		// A repo that is still being added is in the config but has no searcher yet
+		idx := getIdx()
+		if idx[req.Name] != nil || cfg.Repos[req.Name] != nil {
+			writeError(w, fmt.Errorf("Repository %s already exists", req.Name), http.StatusConflict)
+			return
 		}
 
-		// Set branch if provided
-		if req.Branch != "" {
-			vcsConfig := map[string]interface{}{
-				"ref": req.Branch,
-			}
-			vcsConfigBytes, err := json.Marshal(vcsConfig)
-			if err != nil {
-				writeError(w, fmt.Errorf("Failed to create vcs config: %v", err), http.StatusInternalServerError)
-				return
-			}
-			secretMsg := config.SecretMessage(vcsConfigBytes)
-			repo.VcsConfigMessage = &secretMsg
+		if err := cfg.MergeVCSConfig(repo); err != nil {
+			writeError(w, fmt.Errorf("Invalid vcs config: %v", err), http.StatusBadRequest)
+			return
 		}
 
-		// Initialize repo with defaults
-		config.InitRepo(repo)
+		// Make sure the driver accepts its config before the repo is saved
+		if _, err := vcs.New(repo.Vcs, repo.VcsConfig()); err != nil {
+			writeError(w, fmt.Errorf("Invalid vcs config: %v", err), http.StatusBadRequest)
+			return
+		}
 
 		// Add to config
 		if cfg.Repos == nil {
@@ -358,85 +989,76 @@ func Setup(m *http.ServeMux, provider SearcherProvider, defaultMaxResults int) {
 		cfg.Repos[req.Name] = repo
 
 		// Save config file
-		configFile := provider.GetConfigFile()
-		if configFile == "" {
-			configFile = "config.json"
-		}
-		if err := cfg.SaveToFile(configFile); err != nil {
+		if err := saveConfig(provider, cfg); err != nil {
+			delete(cfg.Repos, req.Name)
 			writeError(w, fmt.Errorf("Failed to save config: %v", err), http.StatusInternalServerError)
 			return
 		}
 		log.Printf("save config file success")
 
-		// Create new searcher
-		newSearcher, err := searcher.New(cfg.DbPath, req.Name, repo)
-		if err != nil {
-			writeError(w, fmt.Errorf("Failed to create searcher: %v", err), http.StatusInternalServerError)
-			// Remove from config on error
-			delete(cfg.Repos, req.Name)
-			cfg.SaveToFile(configFile)
-			return
-		}
-
-		// Add searcher to server
-		provider.AddSearcher(req.Name, newSearcher)
-
-		// Trigger update
-		if !newSearcher.Update() {
-			// If update fails, log but don't fail the request
-			log.Printf("Warning: Failed to trigger update for repository %s", req.Name)
-		}
+		// Clone and index the repo in the background, the client follows along
+		// through /api/v1/repos/{name}/status.
+		name := req.Name
+		job := buildSearcher(cfg, name, repo, nil, func(s *searcher.Searcher, err error) {
+			if err != nil {
+				log.Printf("failed to add repository %s: %s", name, err)
+
+				// Remove from config on error
+				reposLck.Lock()
+				if cfg.Repos[name] == repo {
+					delete(cfg.Repos, name)
+					if err := saveConfig(provider, cfg); err != nil {
+						log.Printf("failed to save config: %s", err)
+					}
+				}
+				reposLck.Unlock()
+				return
+			}
 
-		writeResp(w, map[string]string{
-			"status":  "ok",
-			"message": fmt.Sprintf("Repository %s added successfully", req.Name),
+			provider.AddSearcher(name, s)
 		})
+
+		writeJson(w, map[string]string{
+			"status":  "accepted",
+			"id":      job.Id,
+			"message": fmt.Sprintf("Repository %s is being added", name),
+		}, http.StatusAccepted)
 	})
 
-	m.HandleFunc("/api/v1/github-webhook", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			writeError(w,
-				errors.New(http.StatusText(http.StatusMethodNotAllowed)),
-				http.StatusMethodNotAllowed)
+	m.HandleFunc("/api/v1/repos/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/v1/repos/")
+		if name == "" {
+			writeError(w, errors.New("No repository given"), http.StatusNotFound)
 			return
 		}
 
-		type Webhook struct {
-			Repository struct {
-				Name      string
-				Full_name string
+		if strings.HasSuffix(name, "/status") {
+			if r.Method != "GET" {
+				writeError(w,
+					errors.New(http.StatusText(http.StatusMethodNotAllowed)),
+					http.StatusMethodNotAllowed)
+				return
 			}
-		}
-
-		var h Webhook
-
-		err := json.NewDecoder(r.Body).Decode(&h)
-
-		if err != nil {
-			writeError(w,
-				errors.New(http.StatusText(http.StatusBadRequest)),
-				http.StatusBadRequest)
+			repoStatus(w, r, provider, strings.TrimSuffix(name, "/status"))
 			return
 		}
 
-		repo := h.Repository.Full_name
-		idx := getIdx()
-		searcher := idx[h.Repository.Full_name]
-
-		if searcher == nil {
-			writeError(w,
-				fmt.Errorf("No such repository: %s", repo),
-				http.StatusNotFound)
+		if strings.HasSuffix(name, "/revs") {
+			repoRevs(w, r, provider, strings.TrimSuffix(name, "/revs"))
 			return
 		}
 
-		if !searcher.Update() {
+		switch r.Method {
+		case "DELETE":
+			deleteRepo(w, provider, name)
+		case "PATCH":
+			patchRepo(w, r, provider, name)
+		default:
 			writeError(w,
-				fmt.Errorf("Push updates are not enabled for repository %s", repo),
-				http.StatusForbidden)
-			return
+				errors.New(http.StatusText(http.StatusMethodNotAllowed)),
+				http.StatusMethodNotAllowed)
 		}
-
-		writeResp(w, "ok")
 	})
+
+	setupWebhooks(m, provider)
 }
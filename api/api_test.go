@@ -1,34 +1,378 @@
 package api
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+
+	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/index"
+	"github.com/hound-search/hound/searcher"
 )
 
 var parseAsIntAndUintTests = map[string]struct {
 	numResults string
-	min int
-	max	int
-	def	int
-	expected int
-} {
-	"parse error test case": {"not a parsable integer", 101, 1000, 5000, 5000},
-	"less than min test case": {"100", 101, 1000, 5000, 101},
+	min        int
+	max        int
+	def        int
+	expected   int
+}{
+	"parse error test case":      {"not a parsable integer", 101, 1000, 5000, 5000},
+	"less than min test case":    {"100", 101, 1000, 5000, 101},
 	"greater than max test case": {"1001", 101, 1000, 5000, 1000},
-	"within limits test case": {"100", 0, 100, 5000, 100},
+	"within limits test case":    {"100", 0, 100, 5000, 100},
 }
 
 func TestParseAsIntAndUint(t *testing.T) {
 	for name, td := range parseAsIntAndUintTests {
 		t.Run(name, func(t *testing.T) {
-			if got, expected := 
+			if got, expected :=
 				parseAsUintValue(td.numResults, uint(td.min), uint(td.max), uint(td.def)), uint(td.expected); got != expected {
-					t.Fatalf("parseAsUintValue - %s: returned %d; expected %d", name, got, expected)
-				}
+				t.Fatalf("parseAsUintValue - %s: returned %d; expected %d", name, got, expected)
+			}
 
-			if got, expected := 
+			if got, expected :=
 				parseAsIntValue(td.numResults, td.min, td.max, td.def), td.expected; got != expected {
-					t.Fatalf("parseAsIntValue - %s: returned %d; expected %d", name, got, expected)
-				}
-		})	
+				t.Fatalf("parseAsIntValue - %s: returned %d; expected %d", name, got, expected)
+			}
+		})
+	}
+}
+
+func TestRepoPatchApply(t *testing.T) {
+	vcsConfig := config.SecretMessage(`{"ref":"main","detect-ref":true}`)
+	repo := &config.Repo{
+		Url:              "https://github.com/hound-search/hound.git",
+		DisplayName:      "hound",
+		VcsConfigMessage: &vcsConfig,
+	}
+	config.InitRepo(repo)
+
+	var p repoPatch
+	if err := json.Unmarshal([]byte(`{"ref":"release","ms-between-poll":1000}`), &p); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := p.apply(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r == repo {
+		t.Fatal("expected apply to return a copy of the repo")
+	}
+
+	if r.MsBetweenPolls != 1000 || r.DisplayName != "hound" {
+		t.Fatalf("unexpected repo after patch: %+v", r)
+	}
+
+	var vals map[string]interface{}
+	if err := json.Unmarshal(r.VcsConfig(), &vals); err != nil {
+		t.Fatal(err)
+	}
+
+	if vals["ref"] != "release" || vals["detect-ref"] != true {
+		t.Fatalf("unexpected vcs-config after patch: %v", vals)
+	}
+
+	for _, body := range []string{
+		`{"content-store":"pakced"}`,
+		`{"content-compression":"flate"}`,
+	} {
+		var p repoPatch
+		if err := json.Unmarshal([]byte(body), &p); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := p.apply(repo); err == nil {
+			t.Errorf("expected %s to be rejected", body)
+		}
+	}
+}
+
+func TestSplitRepoRef(t *testing.T) {
+	idx := map[string]*searcher.Searcher{
+		"hound":       {},
+		"team@hound":  {},
+		"team@hound2": {},
+	}
+
+	for v, expected := range map[string][2]string{
+		"hound":            {"hound", ""},
+		"hound@main":       {"hound", "main"},
+		"hound@fix@2":      {"hound@fix@2", ""},
+		"team@hound":       {"team@hound", ""},
+		"team@hound@main":  {"team@hound", "main"},
+		"team@hound2@v1.0": {"team@hound2", "v1.0"},
+		"team@hound2@a@b":  {"team@hound2@a@b", ""},
+		"unknown@main":     {"unknown@main", ""},
+	} {
+		name, ref := splitRepoRef(v, idx)
+		if name != expected[0] || ref != expected[1] {
+			t.Errorf("%s: expected %v, got [%s %s]", v, expected, name, ref)
+		}
+	}
+}
+
+func TestDiffRepos(t *testing.T) {
+	newRepo := func(url, vcsConfig string) *config.Repo {
+		msg := config.SecretMessage(vcsConfig)
+		repo := &config.Repo{
+			Url:              url,
+			VcsConfigMessage: &msg,
+		}
+		config.InitRepo(repo)
+		return repo
+	}
+
+	running := map[string]*config.Repo{
+		"same":    newRepo("https://example.com/same.git", `{"ref":"main","detect-ref":true}`),
+		"changed": newRepo("https://example.com/changed.git", `{"ref":"main"}`),
+		"removed": newRepo("https://example.com/removed.git", `{}`),
+	}
+
+	repos := map[string]*config.Repo{
+		// the same vcs-config, encoded differently
+		"same":    newRepo("https://example.com/same.git", `{ "detect-ref": true, "ref": "main" }`),
+		"changed": newRepo("https://example.com/changed.git", `{"ref":"release"}`),
+		"added":   newRepo("https://example.com/added.git", `{}`),
+	}
+
+	added, removed, changed := diffRepos(running, repos)
+
+	for _, c := range []struct {
+		what     string
+		got      []string
+		expected string
+	}{
+		{"added", added, "added"},
+		{"removed", removed, "removed"},
+		{"changed", changed, "changed"},
+	} {
+		if len(c.got) != 1 || c.got[0] != c.expected {
+			t.Errorf("expected %s to be [%s], got %v", c.what, c.expected, c.got)
+		}
+	}
+}
+
+func TestNormalizeUrl(t *testing.T) {
+	for _, u := range []string{
+		"https://github.com/org/repo.git",
+		"https://user@GitHub.com/org/repo/",
+		"git@github.com:org/repo.git",
+		"ssh://git@github.com/org/repo",
+		"git://github.com/org/repo.git",
+	} {
+		if got := normalizeUrl(u); got != "github.com/org/repo" {
+			t.Errorf("normalizeUrl(%q): got %q", u, got)
+		}
+	}
+}
+
+func TestVerifyHmac(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/master"}`)
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	sig := hex.EncodeToString(mac.Sum(nil))
+
+	if !verifyHmac("sha256="+sig, "sha256=", body, "s3cret") {
+		t.Error("expected a valid signature to verify")
+	}
+	if verifyHmac("sha256="+sig, "sha256=", body, "other") {
+		t.Error("expected a signature with the wrong secret to fail")
+	}
+	if verifyHmac(sig, "sha256=", body, "s3cret") {
+		t.Error("expected a signature without the prefix to fail")
 	}
-}
\ No newline at end of file
+	if verifyHmac("sha256=nothex", "sha256=", body, "s3cret") {
+		t.Error("expected a malformed signature to fail")
+	}
+}
+
+func TestPushEventMatches(t *testing.T) {
+	vcsConfig := func(c string) *config.SecretMessage {
+		msg := config.SecretMessage(c)
+		return &msg
+	}
+
+	ev := &pushEvent{
+		names: []string{"org/repo"},
+		urls:  []string{"https://github.com/org/repo.git", "git@github.com:org/repo.git"},
+		ref:   "refs/heads/main",
+
+		defaultBranch: "main",
+	}
+
+	tests := []struct {
+		name     string
+		repo     *config.Repo
+		matches  bool
+		matchRef bool
+	}{
+		{"org/repo", &config.Repo{Url: "https://example.com/other.git", Vcs: "git"}, true, false},
+		{"repo", &config.Repo{Url: "git@github.com:org/repo.git", Vcs: "git"}, true, false},
+		{"other", &config.Repo{Url: "https://github.com/org/other.git", Vcs: "git"}, false, false},
+		{"repo", &config.Repo{Url: "https://github.com/org/repo", Vcs: "svn"}, true, true},
+		{"repo", &config.Repo{
+			Url:              "https://github.com/org/repo",
+			Vcs:              "git",
+			VcsConfigMessage: vcsConfig(`{"ref": "main"}`),
+		}, true, true},
+		{"repo", &config.Repo{
+			Url:              "https://github.com/org/repo",
+			Vcs:              "git",
+			VcsConfigMessage: vcsConfig(`{"ref": "release"}`),
+		}, true, false},
+		{"repo", &config.Repo{
+			Url:              "https://github.com/org/repo",
+			Vcs:              "git",
+			VcsConfigMessage: vcsConfig(`{"detect-ref": true}`),
+		}, true, true},
+		{"repo", &config.Repo{
+			Url:              "https://github.com/org/repo",
+			Vcs:              "git",
+			VcsConfigMessage: vcsConfig(`{"refs": ["release/*", "main"]}`),
+		}, true, true},
+		{"repo", &config.Repo{
+			Url:              "https://github.com/org/repo",
+			Vcs:              "git",
+			VcsConfigMessage: vcsConfig(`{"refs": ["release/*"]}`),
+		}, true, false},
+	}
+
+	for _, test := range tests {
+		if got := ev.matches(test.name, test.repo); got != test.matches {
+			t.Errorf("%s (%s): expected matches %v, got %v", test.name, test.repo.Url, test.matches, got)
+		}
+		if got := ev.matchesRef(test.repo); got != test.matchRef {
+			t.Errorf("%s (%s): expected matchesRef %v, got %v", test.name, test.repo.Url, test.matchRef, got)
+		}
+	}
+}
+
+func TestSearchAllReportsTruncatedRepos(t *testing.T) {
+	// The local driver links to the source, which windows does not allow
+	// without privileges.
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks are not available")
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, dbpath := filepath.Join(dir, "src"), filepath.Join(dir, "db")
+	for _, d := range []string{src, dbpath} {
+		if err := os.MkdirAll(d, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("needle\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	poll := false
+	repo := &config.Repo{Url: "file://" + src, Vcs: "local", EnablePollUpdates: &poll}
+	config.InitRepo(repo)
+
+	s, err := searcher.New(dbpath, "repo", repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Destroy() //nolint
+
+	idx := map[string]*searcher.Searcher{"repo": s}
+	search := func(ctx context.Context) map[string]*index.SearchResponse {
+		var filesOpened, duration int
+		res, errs, err := searchAll(ctx, "needle", &index.SearchOptions{}, []string{"repo"}, idx, &filesOpened, &duration)
+		if err != nil || len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v %v", err, errs)
+		}
+		return res
+	}
+
+	res := search(context.Background())
+	if res["repo"] == nil || len(res["repo"].Matches) != 1 || len(truncatedRepos(res)) != 0 {
+		t.Fatalf("expected a complete match, got %v", res["repo"])
+	}
+
+	// Without any budget the repo is reported as truncated, not left out.
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	res = search(ctx)
+	if res["repo"] == nil || !res["repo"].Truncated || len(res["repo"].Matches) != 0 {
+		t.Fatalf("expected a truncated result without matches, got %v", res["repo"])
+	}
+
+	if repos := truncatedRepos(res); len(repos) != 1 || repos[0] != "repo" {
+		t.Errorf("expected repo to be truncated, got %v", repos)
+	}
+}
+
+// A provider of a fixed set of searchers.
+type testProvider struct {
+	cfg       *config.Config
+	searchers map[string]*searcher.Searcher
+}
+
+func (p *testProvider) GetSearchers() map[string]*searcher.Searcher   { return p.searchers }
+func (p *testProvider) AddSearcher(name string, s *searcher.Searcher) {}
+func (p *testProvider) RemoveSearcher(name string)                    {}
+func (p *testProvider) GetConfig() *config.Config                     { return p.cfg }
+func (p *testProvider) GetConfigFile() string                         { return "" }
+func (p *testProvider) ReplaceSearcher(name string, s *searcher.Searcher) *searcher.Searcher {
+	return nil
+}
+
+func TestWebhookResponseIsGeneric(t *testing.T) {
+	enabled := true
+	provider := &testProvider{
+		cfg: &config.Config{WebhookSecret: "s3cret"},
+		searchers: map[string]*searcher.Searcher{
+			"repo": {Repo: &config.Repo{Url: "https://github.com/org/repo.git", Vcs: "git", EnablePushUpdates: &enabled}},
+		},
+	}
+
+	// Post a push of the named repo, signed with the secret unless it is empty.
+	push := func(name, secret string) *httptest.ResponseRecorder {
+		body := `{"ref":"refs/heads/master","repository":{"full_name":"` + name +
+			`","clone_url":"https://github.com/` + name + `.git"}}`
+		r := httptest.NewRequest("POST", "/api/v1/github-webhook", strings.NewReader(body))
+		r.Header.Set("X-GitHub-Event", "push")
+		if secret != "" {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte(body))
+			r.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+
+		w := httptest.NewRecorder()
+		serveWebhook(w, r, provider, webhooks["/api/v1/github-webhook"])
+		return w
+	}
+
+	// Unknown repos, bad signatures and updates look the same.
+	for _, w := range []*httptest.ResponseRecorder{
+		push("org/other", ""),
+		push("org/repo", ""),
+		push("org/repo", "wrong"),
+		push("org/repo", "s3cret"),
+	} {
+		if w.Code != http.StatusAccepted || w.Body.Len() != 0 {
+			t.Errorf("expected an empty 202, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+}
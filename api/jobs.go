@@ -0,0 +1,95 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/searcher"
+)
+
+// The progress of a repo that is being added in the background. Repos that
+// were not added through the API are reported as ready without a job id.
+type repoJob struct {
+	Id        string `json:",omitempty"`
+	Repo      string
+	Phase     searcher.Phase
+	Error     string     `json:",omitempty"`
+	StartedAt *time.Time `json:",omitempty"`
+	UpdatedAt *time.Time `json:",omitempty"`
+
+	// The state of the repo's index once it is ready.
+	Index *searcher.Status `json:",omitempty"`
+
+	repo *config.Repo
+}
+
+// The jobs for repos added through the API, by repo name.
+var (
+	jobs    = map[string]*repoJob{}
+	jobsLck sync.Mutex
+)
+
+func newJobId() string {
+	b := make([]byte, 8)
+	rand.Read(b) //nolint
+	return hex.EncodeToString(b)
+}
+
+// Start tracking a new job for the named repo, replacing any previous job.
+func startJob(name string, repo *config.Repo) *repoJob {
+	jobsLck.Lock()
+	defer jobsLck.Unlock()
+
+	now := time.Now()
+	j := &repoJob{
+		Id:        newJobId(),
+		Repo:      name,
+		Phase:     searcher.PhaseQueued,
+		StartedAt: &now,
+		UpdatedAt: &now,
+		repo:      repo,
+	}
+	jobs[name] = j
+	return j
+}
+
+// Move the job to the given phase, recording the error if there is one.
+func (j *repoJob) setPhase(phase searcher.Phase, err error) {
+	jobsLck.Lock()
+	defer jobsLck.Unlock()
+
+	now := time.Now()
+	j.Phase = phase
+	j.UpdatedAt = &now
+	if err != nil {
+		j.Error = err.Error()
+	}
+}
+
+func (j *repoJob) inProgress() bool {
+	return j.Phase != searcher.PhaseReady && j.Phase != searcher.PhaseFailed
+}
+
+// Get a copy of the current job for the named repo, or nil.
+func jobFor(name string) *repoJob {
+	jobsLck.Lock()
+	defer jobsLck.Unlock()
+
+	j := jobs[name]
+	if j == nil {
+		return nil
+	}
+
+	c := *j
+	return &c
+}
+
+// Stop tracking the job for the named repo.
+func removeJob(name string) {
+	jobsLck.Lock()
+	defer jobsLck.Unlock()
+	delete(jobs, name)
+}
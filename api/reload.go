@@ -0,0 +1,254 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+	"sort"
+
+	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/searcher"
+)
+
+// The repos that a config reload added, removed or rebuilt. Repos that were
+// still being added when the config was reloaded are skipped.
+type ReloadResult struct {
+	Added   []string
+	Removed []string
+	Changed []string
+	Skipped []string `json:",omitempty"`
+}
+
+// Are the two repo configs the same? vcs-config is compared by value since
+// the same config can be encoded in different ways.
+func sameRepo(a, b *config.Repo) bool {
+	ac, bc := *a, *b
+	ac.VcsConfigMessage, bc.VcsConfigMessage = nil, nil
+	if !reflect.DeepEqual(&ac, &bc) {
+		return false
+	}
+
+	var av, bv interface{}
+	if c := a.VcsConfig(); len(c) > 0 {
+		if err := json.Unmarshal(c, &av); err != nil {
+			return false
+		}
+	}
+	if c := b.VcsConfig(); len(c) > 0 {
+		if err := json.Unmarshal(c, &bv); err != nil {
+			return false
+		}
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+// Compare the repos of the running searchers with the repos in a config and
+// return the sorted names of the repos that have to be added, removed and
+// rebuilt.
+func diffRepos(running, repos map[string]*config.Repo) (added, removed, changed []string) {
+	for name, repo := range repos {
+		old, ok := running[name]
+		if !ok {
+			added = append(added, name)
+		} else if !sameRepo(old, repo) {
+			changed = append(changed, name)
+		}
+	}
+
+	for name := range running {
+		if _, ok := repos[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+// Is the url used by any of the repos?
+func urlInUse(repos map[string]*config.Repo, url string) bool {
+	for _, repo := range repos {
+		if repo.Url == url {
+			return true
+		}
+	}
+	return false
+}
+
+// Build a searcher for the repo in the background and track its progress as
+// a job. A repo that changed passes the searcher that serves it as old, which
+// keeps serving it until the new searcher is ready, and goes on updating it if
+// the build fails, see searcher.RebuildAsync. done is called with the new
+// searcher or the error before the job is marked as ready or failed.
+func buildSearcher(cfg *config.Config, name string, repo *config.Repo, old *searcher.Searcher, done func(*searcher.Searcher, error)) *repoJob {
+	job := startJob(name, repo)
+	onPhase := func(phase searcher.Phase) {
+		job.setPhase(phase, nil)
+	}
+	onDone := func(s *searcher.Searcher, err error) {
+		done(s, err)
+		if err != nil {
+			job.setPhase(searcher.PhaseFailed, err)
+			return
+		}
+		job.setPhase(searcher.PhaseReady, nil)
+	}
+
+	if old != nil {
+		searcher.RebuildAsync(old, cfg.DbPath, name, repo, onPhase, onDone)
+	} else {
+		searcher.NewAsync(cfg.DbPath, name, repo, onPhase, onDone)
+	}
+	return job
+}
+
+// Stop a searcher that was removed from the config and remove its index. Its
+// vcs directory is removed as well unless a repo in the config uses it by the
+// time the searcher stopped. Stopping waits for a build that is in progress,
+// so this is meant to run in the background without holding reposLck.
+func destroySearcher(provider SearcherProvider, name string, s *searcher.Searcher) {
+	s.Stop()
+	s.Wait()
+
+	if err := s.Destroy(); err != nil {
+		log.Printf("failed to destroy index (%s): %s", name, err)
+	}
+
+	reposLck.Lock()
+	defer reposLck.Unlock()
+
+	if cfg := provider.GetConfig(); cfg != nil && urlInUse(cfg.Repos, s.Repo.Url) {
+		return
+	}
+
+	if err := s.RemoveVcsDir(); err != nil {
+		log.Printf("failed to remove vcs dir (%s): %s", name, err)
+	}
+}
+
+// Put a rebuilt searcher in place of the one that served the repo, which has
+// stopped by now, and remove the old index. The old vcs directory is removed
+// as well when the repo moved to a url that no repo in the config uses.
+func replaceSearcher(provider SearcherProvider, name string, s *searcher.Searcher) {
+	old := provider.ReplaceSearcher(name, s)
+	if old == nil {
+		return
+	}
+
+	if err := old.Destroy(); err != nil {
+		log.Printf("failed to destroy index (%s): %s", name, err)
+	}
+
+	if old.Repo.Url == s.Repo.Url {
+		return
+	}
+
+	reposLck.Lock()
+	defer reposLck.Unlock()
+
+	if cfg := provider.GetConfig(); cfg != nil && urlInUse(cfg.Repos, old.Repo.Url) {
+		return
+	}
+
+	if err := old.RemoveVcsDir(); err != nil {
+		log.Printf("failed to remove vcs dir (%s): %s", name, err)
+	}
+}
+
+// Reload the config file and bring the running searchers in line with it.
+// Searchers for removed repos are stopped and destroyed in the background, and
+// new and changed repos are built in the background and can be followed
+// through /api/v1/repos/{name}/status. The searchers of changed repos keep serving
+// their current index until the new one is ready, and searchers of unchanged
+// repos are left alone. Only the repos are reloaded, other settings require a
+// restart.
+func ReloadConfig(provider SearcherProvider) (*ReloadResult, error) {
+	var newCfg config.Config
+	if err := newCfg.LoadFromFile(provider.GetConfigFile()); err != nil {
+		return nil, err
+	}
+
+	reposLck.Lock()
+	defer reposLck.Unlock()
+
+	cfg := provider.GetConfig()
+	if newCfg.DbPath != cfg.DbPath {
+		log.Printf("dbpath changed to %s, restart houndd to use it", newCfg.DbPath)
+	}
+
+	idx := provider.GetSearchers()
+	running := map[string]*config.Repo{}
+	for name, s := range idx {
+		running[name] = s.Repo
+	}
+
+	res := &ReloadResult{}
+
+	// Repos that are still being added are left as they are.
+	repos := map[string]*config.Repo{}
+	for name, repo := range newCfg.Repos {
+		if job := jobFor(name); job != nil && job.inProgress() {
+			res.Skipped = append(res.Skipped, name)
+			continue
+		}
+		repos[name] = repo
+	}
+	for name, repo := range cfg.Repos {
+		if job := jobFor(name); job != nil && job.inProgress() {
+			if _, ok := newCfg.Repos[name]; !ok {
+				res.Skipped = append(res.Skipped, name)
+			}
+			repos[name] = repo
+			running[name] = repo
+		}
+	}
+	sort.Strings(res.Skipped)
+
+	res.Added, res.Removed, res.Changed = diffRepos(running, repos)
+
+	for _, name := range res.Removed {
+		s := idx[name]
+		provider.RemoveSearcher(name)
+		removeJob(name)
+		go destroySearcher(provider, name, s)
+	}
+
+	for _, name := range res.Added {
+		name, repo := name, repos[name]
+		buildSearcher(cfg, name, repo, nil, func(s *searcher.Searcher, err error) {
+			if err != nil {
+				log.Printf("failed to add repository %s: %s", name, err)
+
+				reposLck.Lock()
+				if cfg.Repos[name] == repo {
+					delete(cfg.Repos, name)
+				}
+				reposLck.Unlock()
+				return
+			}
+
+			provider.AddSearcher(name, s)
+		})
+	}
+
+	for _, name := range res.Changed {
+		name, repo, old := name, repos[name], idx[name]
+		buildSearcher(cfg, name, repo, old, func(s *searcher.Searcher, err error) {
+			if err != nil {
+				log.Printf("failed to rebuild repository %s, its previous config is still indexed: %s", name, err)
+				return
+			}
+
+			replaceSearcher(provider, name, s)
+		})
+	}
+
+	cfg.Repos = repos
+
+	log.Printf("config reloaded: %d added, %d removed, %d changed",
+		len(res.Added), len(res.Removed), len(res.Changed))
+
+	return res, nil
+}
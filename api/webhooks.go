@@ -0,0 +1,400 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/vcs"
+)
+
+// The largest webhook payload that is accepted, GitHub caps theirs at 25MB.
+const maxWebhookSize = 25 << 20
+
+// A push to a repo, reduced to what is needed to find the searchers to update.
+type pushEvent struct {
+	// The names the code host knows the repo by, like org/repo.
+	names []string
+
+	// The urls the repo can be cloned from.
+	urls []string
+
+	// The ref that was pushed to and the repo's default branch, either of
+	// which may be empty if the code host did not send it.
+	ref           string
+	defaultBranch string
+}
+
+// A code host that sends push events to one of the webhook endpoints.
+type webhook struct {
+	// Parse the request into a push event. A nil event means the request
+	// is not a push and can be ignored.
+	parse func(r *http.Request, body []byte) (*pushEvent, error)
+
+	// Is the request signed with the secret?
+	verify func(r *http.Request, body []byte, secret string) bool
+}
+
+// The webhook endpoints by path.
+var webhooks = map[string]*webhook{
+	"/api/v1/github-webhook": {
+		parse: parseGitHubPush,
+		verify: func(r *http.Request, body []byte, secret string) bool {
+			return verifyHmac(r.Header.Get("X-Hub-Signature-256"), "sha256=", body, secret)
+		},
+	},
+	"/api/v1/gitlab-webhook": {
+		parse: parseGitLabPush,
+		verify: func(r *http.Request, body []byte, secret string) bool {
+			token := r.Header.Get("X-Gitlab-Token")
+			return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+		},
+	},
+	"/api/v1/bitbucket-server-webhook": {
+		parse: parseBitbucketServerPush,
+		verify: func(r *http.Request, body []byte, secret string) bool {
+			return verifyHmac(r.Header.Get("X-Hub-Signature"), "sha256=", body, secret)
+		},
+	},
+	"/api/v1/gitea-webhook": {
+		parse: parseGiteaPush,
+		verify: func(r *http.Request, body []byte, secret string) bool {
+			return verifyHmac(r.Header.Get("X-Gitea-Signature"), "", body, secret)
+		},
+	},
+}
+
+// Is the signature, after the prefix, the hex encoded HMAC-SHA256 of the body?
+func verifyHmac(signature, prefix string, body []byte, secret string) bool {
+	if !strings.HasPrefix(signature, prefix) {
+		return false
+	}
+
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, prefix))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body) //nolint
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+func parseGitHubPush(r *http.Request, body []byte) (*pushEvent, error) {
+	if r.Header.Get("X-GitHub-Event") != "push" {
+		return nil, nil
+	}
+
+	var p struct {
+		Ref        string
+		Repository struct {
+			Full_name      string
+			Clone_url      string
+			Ssh_url        string
+			Git_url        string
+			Html_url       string
+			Default_branch string
+		}
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+
+	repo := p.Repository
+	return &pushEvent{
+		names:         []string{repo.Full_name},
+		urls:          []string{repo.Clone_url, repo.Ssh_url, repo.Git_url, repo.Html_url},
+		ref:           p.Ref,
+		defaultBranch: repo.Default_branch,
+	}, nil
+}
+
+func parseGitLabPush(r *http.Request, body []byte) (*pushEvent, error) {
+	if r.Header.Get("X-Gitlab-Event") != "Push Hook" {
+		return nil, nil
+	}
+
+	var p struct {
+		Ref     string
+		Project struct {
+			Path_with_namespace string
+			Git_http_url        string
+			Git_ssh_url         string
+			Web_url             string
+			Default_branch      string
+		}
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+
+	project := p.Project
+	return &pushEvent{
+		names:         []string{project.Path_with_namespace},
+		urls:          []string{project.Git_http_url, project.Git_ssh_url, project.Web_url},
+		ref:           p.Ref,
+		defaultBranch: project.Default_branch,
+	}, nil
+}
+
+func parseBitbucketServerPush(r *http.Request, body []byte) (*pushEvent, error) {
+	if r.Header.Get("X-Event-Key") != "repo:refs_changed" {
+		return nil, nil
+	}
+
+	var p struct {
+		Repository struct {
+			Slug    string
+			Project struct {
+				Key string
+			}
+			Links struct {
+				Clone []struct {
+					Href string
+				}
+			}
+		}
+		Changes []struct {
+			Ref struct {
+				Id string
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+
+	repo := p.Repository
+	ev := &pushEvent{
+		names: []string{repo.Project.Key + "/" + repo.Slug},
+	}
+	for _, link := range repo.Links.Clone {
+		ev.urls = append(ev.urls, link.Href)
+	}
+
+	// A push can change several refs, in which case any of them may be the
+	// one that is indexed and the event is not filtered by ref.
+	if len(p.Changes) == 1 {
+		ev.ref = p.Changes[0].Ref.Id
+	}
+
+	return ev, nil
+}
+
+func parseGiteaPush(r *http.Request, body []byte) (*pushEvent, error) {
+	if r.Header.Get("X-Gitea-Event") != "push" {
+		return nil, nil
+	}
+
+	var p struct {
+		Ref        string
+		Repository struct {
+			Full_name      string
+			Clone_url      string
+			Ssh_url        string
+			Html_url       string
+			Default_branch string
+		}
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+
+	repo := p.Repository
+	return &pushEvent{
+		names:         []string{repo.Full_name},
+		urls:          []string{repo.Clone_url, repo.Ssh_url, repo.Html_url},
+		ref:           p.Ref,
+		defaultBranch: repo.Default_branch,
+	}, nil
+}
+
+// Reduce a clone url to its host and path so that the https, ssh and scp-like
+// urls of a repo compare equal, e.g. git@github.com:org/repo.git and
+// https://github.com/org/repo both become github.com/org/repo.
+func normalizeUrl(u string) string {
+	u = strings.TrimSpace(u)
+	if u == "" {
+		return ""
+	}
+
+	var host, path string
+	if p, err := url.Parse(u); err == nil && p.Host != "" {
+		host, path = p.Hostname(), p.Path
+	} else if i := strings.Index(u, ":"); i > 0 && !strings.Contains(u[:i], "/") {
+		// scp-like syntax, user@host:path
+		host, path = u[:i], u[i+1:]
+		if j := strings.LastIndex(host, "@"); j >= 0 {
+			host = host[j+1:]
+		}
+	} else {
+		return u
+	}
+
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	return strings.ToLower(host) + "/" + path
+}
+
+// Does the push event belong to the repo, either by url or by name?
+func (ev *pushEvent) matches(name string, repo *config.Repo) bool {
+	if u := normalizeUrl(repo.Url); u != "" {
+		for _, evUrl := range ev.urls {
+			if normalizeUrl(evUrl) == u {
+				return true
+			}
+		}
+	}
+
+	for _, n := range ev.names {
+		if n != "" && n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Is the pushed ref one that the repo indexes? Only git repos are
+// filtered, and events without a ref always match.
+func (ev *pushEvent) matchesRef(repo *config.Repo) bool {
+	if ev.ref == "" || repo.Vcs != "git" {
+		return true
+	}
+
+	wd, err := vcs.New(repo.Vcs, repo.VcsConfig())
+	if err != nil {
+		return true
+	}
+
+	g, ok := wd.Driver.(*vcs.GitDriver)
+	if !ok {
+		return true
+	}
+
+	if len(g.Refs) > 0 {
+		return g.MatchesRefs(strings.TrimPrefix(ev.ref, "refs/heads/"))
+	}
+
+	ref := g.IndexedRef(ev.defaultBranch)
+	if ref == "" {
+		return true
+	}
+
+	return ev.ref == ref ||
+		ev.ref == "refs/heads/"+ref ||
+		ev.ref == "refs/tags/"+ref
+}
+
+// The secret that webhooks for the repo are signed with, if any.
+func webhookSecret(cfg *config.Config, repo *config.Repo) string {
+	if repo.WebhookSecret != "" {
+		return string(repo.WebhookSecret)
+	}
+	return string(cfg.WebhookSecret)
+}
+
+// Handle push events from a code host by updating every repo the push
+// belongs to. Repos with a webhook secret are only updated if the request is
+// signed with it. The endpoints are not authenticated, so every event gets the
+// same empty response, which does not tell which repos exist, and the outcome
+// is only logged.
+func serveWebhook(w http.ResponseWriter, r *http.Request, provider SearcherProvider, hook *webhook) {
+	if r.Method != "POST" {
+		writeError(w,
+			errors.New(http.StatusText(http.StatusMethodNotAllowed)),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookSize))
+	if err != nil {
+		writeError(w,
+			errors.New(http.StatusText(http.StatusBadRequest)),
+			http.StatusBadRequest)
+		return
+	}
+
+	ev, err := hook.parse(r, body)
+	if err != nil {
+		writeError(w,
+			errors.New(http.StatusText(http.StatusBadRequest)),
+			http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	if ev == nil {
+		return
+	}
+
+	cfg := provider.GetConfig()
+
+	var matched, unsigned, disabled, updated []string
+	for name, s := range provider.GetSearchers() {
+		if !ev.matches(name, s.Repo) {
+			continue
+		}
+		matched = append(matched, name)
+
+		if secret := webhookSecret(cfg, s.Repo); secret != "" && !hook.verify(r, body, secret) {
+			unsigned = append(unsigned, name)
+			continue
+		}
+
+		if !ev.matchesRef(s.Repo) {
+			continue
+		}
+
+		if !s.Update() {
+			disabled = append(disabled, name)
+			continue
+		}
+		updated = append(updated, name)
+	}
+
+	if len(matched) == 0 {
+		log.Printf("webhook for unknown repository %s", strings.Join(ev.names, ", "))
+		return
+	}
+
+	if len(unsigned) > 0 {
+		sort.Strings(unsigned)
+		log.Printf("webhook signature is invalid for %s", strings.Join(unsigned, ", "))
+	}
+
+	if len(disabled) > 0 {
+		sort.Strings(disabled)
+		log.Printf("webhook ignored, push updates are not enabled for %s", strings.Join(disabled, ", "))
+	}
+
+	if len(updated) > 0 {
+		sort.Strings(updated)
+		log.Printf("webhook updated %s", strings.Join(updated, ", "))
+	}
+}
+
+// Set up the webhook endpoints for each code host.
+func setupWebhooks(m *http.ServeMux, provider SearcherProvider) {
+	for path, hook := range webhooks {
+		hook := hook
+		m.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			serveWebhook(w, r, provider, hook)
+		})
+	}
+}
+
+// Is the path one of the webhook endpoints?
+func IsWebhook(path string) bool {
+	_, ok := webhooks[path]
+	return ok
+}
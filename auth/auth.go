@@ -0,0 +1,360 @@
+// Package auth identifies the clients of the HTTP API and the role they have.
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/hound-search/hound/config"
+)
+
+// What a client is allowed to do. Each role includes the ones before it.
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleRead
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleRead:
+		return "read"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+// Parse a role as it appears in the config. An empty string is RoleNone.
+func ParseRole(s string) (Role, error) {
+	switch s {
+	case "":
+		return RoleNone, nil
+	case "read":
+		return RoleRead, nil
+	case "admin":
+		return RoleAdmin, nil
+	}
+	return RoleNone, fmt.Errorf("unknown role: %s", s)
+}
+
+// The client that made a request.
+type Identity struct {
+	Name   string
+	Role   Role
+	Groups []string
+}
+
+// Can the client see the repo? Repos without groups are visible to everyone
+// and admins can see every repo. A nil Identity can only see repos without
+// groups.
+func (id *Identity) CanSee(repo *config.Repo) bool {
+	if len(repo.Groups) == 0 {
+		return true
+	}
+
+	if id == nil {
+		return false
+	}
+
+	if id.Role == RoleAdmin {
+		return true
+	}
+
+	for _, g := range repo.Groups {
+		for _, ig := range id.Groups {
+			if g == ig {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returned when a request carries credentials that are not valid.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// An Authenticator identifies the client of a request. It returns a nil
+// Identity if the request has no credentials that it understands, and
+// ErrInvalidCredentials if the credentials are wrong.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// The authenticators of a config, tried in order until one identifies the
+// client.
+type chain struct {
+	auths     []Authenticator
+	anonymous Role
+
+	// The challenge to send with a 401.
+	challenge string
+}
+
+func (c *chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range c.auths {
+		id, err := a.Authenticate(r)
+		if err != nil || id != nil {
+			return id, err
+		}
+	}
+
+	return &Identity{Role: c.anonymous}, nil
+}
+
+// The value for the WWW-Authenticate header of a 401 response.
+func (c *chain) Challenge() string {
+	return c.challenge
+}
+
+// Create the Authenticator for the given config. A nil config means there is
+// no authentication and every request gets the admin role.
+func New(cfg *config.AuthConfig) (Authenticator, error) {
+	if cfg == nil {
+		return &chain{anonymous: RoleAdmin}, nil
+	}
+
+	anonymous, err := ParseRole(cfg.AnonymousRole)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &chain{
+		anonymous: anonymous,
+		challenge: `Bearer realm="Hound"`,
+	}
+
+	if len(cfg.Tokens) > 0 {
+		a, err := newTokenAuth(cfg.Tokens)
+		if err != nil {
+			return nil, err
+		}
+		c.auths = append(c.auths, a)
+	}
+
+	if cfg.HtpasswdFile != "" {
+		users, err := readHtpasswdFile(cfg.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		c.auths = append(c.auths, &basicAuth{users, cfg.AdminUsers, cfg.Groups})
+		c.challenge = `Basic realm="Hound"`
+	}
+
+	if cfg.Proxy != nil {
+		a, err := newProxyAuth(cfg.Proxy, cfg.AdminUsers, cfg.Groups)
+		if err != nil {
+			return nil, err
+		}
+		c.auths = append(c.auths, a)
+	}
+
+	return c, nil
+}
+
+// The challenge to send along with a 401 from the given Authenticator.
+func Challenge(a Authenticator) string {
+	if c, ok := a.(interface{ Challenge() string }); ok {
+		return c.Challenge()
+	}
+	return ""
+}
+
+func roleFor(name string, admins []string) Role {
+	for _, admin := range admins {
+		if admin == name {
+			return RoleAdmin
+		}
+	}
+	return RoleRead
+}
+
+// The groups that have the user as a member.
+func groupsFor(name string, groups map[string][]string) []string {
+	var res []string
+	for group, members := range groups {
+		for _, member := range members {
+			if member == name {
+				res = append(res, group)
+				break
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+type token struct {
+	name   string
+	value  []byte
+	role   Role
+	groups []string
+}
+
+// Authenticates requests with a static bearer token in the Authorization
+// header.
+type tokenAuth struct {
+	tokens []*token
+}
+
+func newTokenAuth(cfgs []*config.TokenConfig) (*tokenAuth, error) {
+	a := &tokenAuth{}
+	for _, cfg := range cfgs {
+		if cfg.Token == "" {
+			return nil, fmt.Errorf("token %s is empty", cfg.Name)
+		}
+
+		role, err := ParseRole(cfg.Role)
+		if err != nil {
+			return nil, err
+		}
+
+		a.tokens = append(a.tokens, &token{cfg.Name, []byte(cfg.Token), role, cfg.Groups})
+	}
+	return a, nil
+}
+
+func (a *tokenAuth) Authenticate(r *http.Request) (*Identity, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil, nil
+	}
+
+	value := []byte(strings.TrimPrefix(h, "Bearer "))
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(t.value, value) == 1 {
+			return &Identity{Name: t.name, Role: t.role, Groups: t.groups}, nil
+		}
+	}
+
+	return nil, ErrInvalidCredentials
+}
+
+// Authenticates requests with HTTP basic auth against the users of a htpasswd
+// file.
+type basicAuth struct {
+	users  map[string]string
+	admins []string
+	groups map[string][]string
+}
+
+func (a *basicAuth) Authenticate(r *http.Request) (*Identity, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	hash, ok := a.users[name]
+	if !ok || !checkPassword(hash, password) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Identity{
+		Name:   name,
+		Role:   roleFor(name, a.admins),
+		Groups: groupsFor(name, a.groups),
+	}, nil
+}
+
+// Trusts the user named in a header that is set by a reverse proxy, as long as
+// the request comes from one of the proxy's networks.
+type proxyAuth struct {
+	header       string
+	groupsHeader string
+	trusted      []*net.IPNet
+	admins       []string
+	groups       map[string][]string
+}
+
+func newProxyAuth(cfg *config.ProxyAuthConfig, admins []string, groups map[string][]string) (*proxyAuth, error) {
+	if cfg.UserHeader == "" {
+		return nil, errors.New("proxy auth requires a user-header")
+	}
+
+	a := &proxyAuth{
+		header:       cfg.UserHeader,
+		groupsHeader: cfg.GroupsHeader,
+		admins:       admins,
+		groups:       groups,
+	}
+
+	for _, cidr := range cfg.TrustedProxies {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		a.trusted = append(a.trusted, n)
+	}
+
+	return a, nil
+}
+
+func (a *proxyAuth) isTrusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range a.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *proxyAuth) Authenticate(r *http.Request) (*Identity, error) {
+	name := r.Header.Get(a.header)
+	if name == "" || !a.isTrusted(r) {
+		return nil, nil
+	}
+
+	groups := groupsFor(name, a.groups)
+	if a.groupsHeader != "" {
+		for _, g := range strings.Split(r.Header.Get(a.groupsHeader), ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				groups = append(groups, g)
+			}
+		}
+	}
+
+	return &Identity{
+		Name:   name,
+		Role:   roleFor(name, a.admins),
+		Groups: groups,
+	}, nil
+}
+
+type identityKey struct{}
+
+// Attach the identity of the client to a request's context.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// Get the identity of the client from a request's context, or nil.
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
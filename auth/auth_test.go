@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hound-search/hound/config"
+)
+
+func TestCheckPassword(t *testing.T) {
+	for hash, expected := range map[string]bool{
+		"$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0": true,
+		"$apr1$saltsalt$LrttParrLPdxvgutaSXWJ1": false,
+		"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=":     true,
+		"secret":                                false,
+	} {
+		if got := checkPassword(hash, "secret"); got != expected {
+			t.Errorf("checkPassword(%q): expected %v, got %v", hash, expected, got)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	f, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString("alice:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	a, err := New(&config.AuthConfig{
+		Tokens: []*config.TokenConfig{
+			{Name: "ci", Token: "t0ken", Role: "admin"},
+		},
+		HtpasswdFile: f.Name(),
+		Proxy: &config.ProxyAuthConfig{
+			UserHeader:     "X-Forwarded-User",
+			TrustedProxies: []string{"10.0.0.0/8"},
+		},
+		AdminUsers:    []string{"alice"},
+		AnonymousRole: "",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		user       string
+		password   string
+		role       Role
+		err        error
+	}{
+		{name: "anonymous", role: RoleNone},
+		{name: "token", headers: map[string]string{"Authorization": "Bearer t0ken"}, role: RoleAdmin},
+		{name: "bad token", headers: map[string]string{"Authorization": "Bearer nope"}, err: ErrInvalidCredentials},
+		{name: "admin user", user: "alice", password: "secret", role: RoleAdmin},
+		{name: "read user", user: "bob", password: "secret", role: RoleRead},
+		{name: "bad password", user: "bob", password: "nope", err: ErrInvalidCredentials},
+		{name: "trusted proxy", remoteAddr: "10.1.2.3:1234", headers: map[string]string{"X-Forwarded-User": "carol"}, role: RoleRead},
+		{name: "untrusted proxy", remoteAddr: "192.168.1.1:1234", headers: map[string]string{"X-Forwarded-User": "alice"}, role: RoleNone},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/search", nil)
+		if test.remoteAddr != "" {
+			r.RemoteAddr = test.remoteAddr
+		}
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		if test.user != "" {
+			r.SetBasicAuth(test.user, test.password)
+		}
+
+		id, err := a.Authenticate(r)
+		if err != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+			continue
+		}
+
+		if err == nil && id.Role != test.role {
+			t.Errorf("%s: expected role %s, got %s", test.name, test.role, id.Role)
+		}
+	}
+}
+
+func TestCanSee(t *testing.T) {
+	public := &config.Repo{}
+	private := &config.Repo{Groups: []string{"team-a", "team-b"}}
+
+	tests := []struct {
+		name     string
+		id       *Identity
+		expected bool
+	}{
+		{"no identity", nil, false},
+		{"anonymous", &Identity{Role: RoleRead}, false},
+		{"member", &Identity{Role: RoleRead, Groups: []string{"team-b"}}, true},
+		{"not a member", &Identity{Role: RoleRead, Groups: []string{"team-c"}}, false},
+		{"admin", &Identity{Role: RoleAdmin}, true},
+	}
+
+	for _, test := range tests {
+		if !test.id.CanSee(public) {
+			t.Errorf("%s: expected to see a repo without groups", test.name)
+		}
+
+		if got := test.id.CanSee(private); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestGroupsFor(t *testing.T) {
+	a, err := New(&config.AuthConfig{
+		Proxy: &config.ProxyAuthConfig{
+			UserHeader:     "X-Forwarded-User",
+			GroupsHeader:   "X-Forwarded-Groups",
+			TrustedProxies: []string{"127.0.0.1"},
+		},
+		Groups: map[string][]string{
+			"team-a": {"alice"},
+			"team-b": {"bob"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/repos", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("X-Forwarded-User", "alice")
+	r.Header.Set("X-Forwarded-Groups", "team-c, team-d")
+
+	id, err := a.Authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(id.Groups, ",") != "team-a,team-c,team-d" {
+		t.Fatalf("unexpected groups: %v", id.Groups)
+	}
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const apr1Magic = "$apr1$"
+
+// Read the users and password hashes from a htpasswd file. Passwords hashed
+// with htpasswd's default MD5 (-m) and SHA1 (-s) are supported.
+func readHtpasswdFile(filename string) (map[string]string, error) {
+	r, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	users := map[string]string{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", filename, n)
+		}
+
+		name, hash := line[:i], line[i+1:]
+		if !strings.HasPrefix(hash, apr1Magic) && !strings.HasPrefix(hash, "{SHA}") {
+			log.Printf("%s:%d: unsupported password hash for %s, use htpasswd -m", filename, n, name)
+			continue
+		}
+
+		users[name] = hash
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// Does the password match the hash from a htpasswd file?
+func checkPassword(hash, password string) bool {
+	var expected string
+	switch {
+	case strings.HasPrefix(hash, apr1Magic):
+		salt := strings.TrimPrefix(hash, apr1Magic)
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		expected = apr1(password, salt)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+}
+
+// Hash a password with the Apache variant of MD5-crypt.
+func apr1(password, salt string) string {
+	pw := []byte(password)
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(apr1Magic))
+	h.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(altSum)
+		} else {
+			h.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pw)
+		}
+		sum = h.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var b strings.Builder
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(sum[i[0]])<<16|uint32(sum[i[1]])<<8|uint32(sum[i[2]]), 4)
+	}
+	to64(uint32(sum[11]), 2)
+
+	return apr1Magic + salt + "$" + b.String()
+}
@@ -64,12 +64,27 @@ func (p *ackPresenter) Present(
 
 	buf := bytes.NewBuffer(make([]byte, 0, 20))
 
+	for repo, msg := range res.Errors {
+		if _, err := fmt.Fprintf(p.f, "%s %s\n\n",
+			c.Fg(repoNameFor(repos, repo), ansi.Red, ansi.Bold),
+			c.Fg("search failed: "+msg, ansi.Yellow, ansi.Bold)); err != nil {
+			return err
+		}
+	}
+
 	for repo, resp := range res.Results {
 		if _, err := fmt.Fprintf(p.f, "%s\n",
 			c.Fg(repoNameFor(repos, repo), ansi.Red, ansi.Bold)); err != nil {
 			return err
 		}
 
+		if resp.Truncated {
+			if _, err := fmt.Fprintf(p.f, "%s\n\n",
+				c.Fg("search ran out of time, results are incomplete", ansi.Yellow, ansi.Bold)); err != nil {
+				return err
+			}
+		}
+
 		for _, file := range resp.Matches {
 			if _, err := fmt.Fprintf(p.f, "%s\n",
 				c.Fg(file.Filename, ansi.Green, ansi.Bold)); err != nil {
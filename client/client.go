@@ -3,6 +3,7 @@ package client
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -12,12 +13,27 @@ import (
 	"github.com/hound-search/hound/index"
 )
 
+type Stats struct {
+	FilesOpened int
+	Duration    int
+}
+
 type Response struct {
-	Results map[string]*index.SearchResponse
-	Stats   *struct {
-		FilesOpened int
-		Duration    int
-	} `json:",omitempty"`
+	Results   map[string]*index.SearchResponse
+	Errors    map[string]string `json:",omitempty"`
+	Truncated []string          `json:",omitempty"`
+	Stats     *Stats            `json:",omitempty"`
+}
+
+// A single record read from the streaming search API. Each record holds either
+// the results for one repo, the error from searching one repo or the final
+// stats for the search along with the repos whose results were truncated.
+type StreamRecord struct {
+	Repo      string
+	Result    *index.SearchResponse
+	Error     string
+	Stats     *Stats
+	Truncated []string
 }
 
 type Presenter interface {
@@ -117,6 +133,44 @@ func Search(r *Response, cfg *Config, pattern, repos, files string, context int,
 	return json.NewDecoder(res.Body).Decode(r)
 }
 
+// Executes a search on the API running on host and streams the results back,
+// calling fn for each record as soon as it arrives.
+func SearchStream(cfg *Config, pattern, repos, files string, context int, ignoreCase bool, fn func(*StreamRecord) error) error {
+	u := fmt.Sprintf("http://%s/api/v1/search/stream?%s",
+		cfg.Host,
+		url.Values{
+			"q":     {pattern},
+			"repos": {repos},
+			"files": {files},
+			"ctx":   {fmt.Sprintf("%d", context)},
+			"i":     {fmt.Sprintf("%t", ignoreCase)},
+		}.Encode())
+
+	res, err := doHttpGet(cfg, u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Status %d", res.StatusCode)
+	}
+
+	dec := json.NewDecoder(res.Body)
+	for {
+		var rec StreamRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := fn(&rec); err != nil {
+			return err
+		}
+	}
+}
+
 // Load the list of repositories from the API running on host.
 func LoadRepos(repos map[string]*config.Repo, cfg *Config) error {
 	res, err := doHttpGet(cfg, fmt.Sprintf("http://%s/api/v1/repos", cfg.Host))
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"log"
 	"os"
@@ -9,6 +10,7 @@ import (
 	"regexp"
 
 	"github.com/hound-search/hound/client"
+	"github.com/hound-search/hound/config"
 	"github.com/hound-search/hound/index"
 )
 
@@ -80,6 +82,41 @@ func defaultFlagForHost() string {
 	return "localhost:6080"
 }
 
+// Search using the streaming API, presenting the results for each repo as soon
+// as they arrive.
+func searchAndPresentStream(cfg *client.Config, reg *regexp.Regexp, pattern, repos, files string, context int, ignoreCase, likeGrep bool) error {
+	rep := map[string]*config.Repo{}
+	if err := client.LoadRepos(rep, cfg); err != nil {
+		return err
+	}
+
+	p := newPresenter(likeGrep)
+	return client.SearchStream(cfg, pattern, repos, files, context, ignoreCase,
+		func(rec *client.StreamRecord) error {
+			if rec.Error != "" && rec.Repo == "" {
+				return errors.New(rec.Error)
+			}
+
+			if rec.Error != "" {
+				return p.Present(reg, context, rep, &client.Response{
+					Errors: map[string]string{
+						rec.Repo: rec.Error,
+					},
+				})
+			}
+
+			if rec.Result == nil {
+				return nil
+			}
+
+			return p.Present(reg, context, rep, &client.Response{
+				Results: map[string]*index.SearchResponse{
+					rec.Repo: rec.Result,
+				},
+			})
+		})
+}
+
 func main() {
 	flagHost := flag.String("host", defaultFlagForHost(), "")
 	flagRepos := flag.String("repos", "*", "")
@@ -88,6 +125,7 @@ func main() {
 	flagCase := flag.Bool("ignore-case", false, "")
 	flagStats := flag.Bool("show-stats", false, "")
 	flagGrep := flag.Bool("like-grep", false, "")
+	flagStream := flag.Bool("stream", false, "")
 
 	flag.Parse()
 
@@ -113,6 +151,13 @@ func main() {
 		log.Panic(err)
 	}
 
+	if *flagStream {
+		if err := searchAndPresentStream(&cfg, reg, flag.Arg(0), *flagRepos, *flagFiles, *flagContext, *flagCase, *flagGrep); err != nil {
+			log.Panic(err)
+		}
+		return
+	}
+
 	res, repos, err := client.SearchAndLoadRepos(&cfg,
 		flag.Arg(0),
 		*flagRepos,
@@ -13,12 +13,14 @@ import (
 	"syscall"
 
 	"github.com/blang/semver/v4"
+	"github.com/hound-search/hound/api"
 	"github.com/hound-search/hound/config"
 	"github.com/hound-search/hound/searcher"
 	"github.com/hound-search/hound/web"
 )
 
 const gracefulShutdownSignal = syscall.SIGTERM
+const reloadSignal = syscall.SIGHUP
 
 var (
 	info_log   *log.Logger
@@ -53,10 +55,11 @@ func makeSearchers(cfg *config.Config) (map[string]*searcher.Searcher, bool, err
 	return searchers, true, nil
 }
 
-func handleShutdown(shutdownCh <-chan os.Signal, searchers map[string]*searcher.Searcher) {
+func handleShutdown(shutdownCh <-chan os.Signal, ws *web.Server) {
 	go func() {
 		<-shutdownCh
 		info_log.Printf("Graceful shutdown requested...")
+		searchers := ws.GetSearchers()
 		for _, s := range searchers {
 			s.Stop()
 		}
@@ -69,6 +72,24 @@ func handleShutdown(shutdownCh <-chan os.Signal, searchers map[string]*searcher.
 	}()
 }
 
+// Reload the config file whenever the reload signal is received.
+func handleReload(reloadCh <-chan os.Signal, ws *web.Server) {
+	go func() {
+		for range reloadCh {
+			info_log.Printf("Config reload requested...")
+			if _, err := api.ReloadConfig(ws); err != nil {
+				error_log.Printf("config reload failed: %s", err)
+			}
+		}
+	}()
+}
+
+func registerReloadSignal() <-chan os.Signal {
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, reloadSignal)
+	return reloadCh
+}
+
 func registerShutdownSignal() <-chan os.Signal {
 	shutdownCh := make(chan os.Signal, 1)
 	signal.Notify(shutdownCh, gracefulShutdownSignal)
@@ -90,13 +111,13 @@ func main() {
 	error_log = log.New(os.Stderr, "", log.LstdFlags)
 
 	flagConf := flag.String("conf", "config.json", "")
-	log.Printf("flag conf: %s", flagConf)
+	log.Printf("flag conf: %v", *flagConf)
 	flagAddr := flag.String("addr", ":6080", "")
-	log.Printf("flag address: %s", flagAddr)
+	log.Printf("flag address: %v", *flagAddr)
 	flagDev := flag.Bool("dev", false, "")
-	log.Printf("flag dev: %s", flagDev)
+	log.Printf("flag dev: %v", *flagDev)
 	flagVer := flag.Bool("version", false, "Display version and exit")
-	log.Printf("flag version: %s", flagVer)
+	log.Printf("flag version: %v", *flagVer)
 	flag.Parse()
 
 	if *flagVer {
@@ -111,11 +132,16 @@ func main() {
 	}
 
 	// Start the web server on a background routine.
-	ws := web.StartWithConfigFile(&cfg, *flagConf, *flagAddr, *flagDev)
+	ws, err := web.StartWithConfigFile(&cfg, *flagConf, *flagAddr, *flagDev)
+	if err != nil {
+		log.Panic(err)
+	}
 
 	// It's not safe to be killed during makeSearchers, so register the
 	// shutdown signal here and defer processing it until we are ready.
+	// The same goes for reloading the config.
 	shutdownCh := registerShutdownSignal()
+	reloadCh := registerReloadSignal()
 	idx, ok, err := makeSearchers(&cfg)
 	if err != nil {
 		log.Panic(err)
@@ -126,7 +152,11 @@ func main() {
 		info_log.Println("All indexes built!")
 	}
 
-	handleShutdown(shutdownCh, idx)
+	// The handlers work on the server's searchers, which change as repos
+	// are added and removed.
+	ws.SetSearchers(idx)
+	handleShutdown(shutdownCh, ws)
+	handleReload(reloadCh, ws)
 
 	host := *flagAddr
 	if strings.HasPrefix(host, ":") { //nolint
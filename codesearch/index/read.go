@@ -176,6 +176,11 @@ func (ix *Index) Name(fileid uint32) string {
   return string(ix.NameBytes(fileid))
 }
 
+// NumNames returns the number of file names in the index.
+func (ix *Index) NumNames() int {
+  return ix.numName
+}
+
 // listAt returns the index list entry at the given offset.
 func (ix *Index) listAt(off uint32) (trigram, count, offset uint32) {
   d := ix.slice(ix.postIndex+off, postEntrySize)
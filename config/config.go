@@ -3,9 +3,11 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 const (
@@ -18,9 +20,59 @@ const (
 	defaultBaseUrl               = "{url}/blob/{rev}/{path}{anchor}"
 	defaultAnchor                = "#L{line}"
 	defaultHealthCheckURI        = "/healthz"
+	defaultCorsOrigin            = "*"
 	defaultResultLimit           = 5000
 )
 
+// The limits of the cache of indexes of revisions, which the searcher also
+// starts out with before a config is loaded.
+const (
+	DefaultMaxRevIndexes = 10
+	DefaultRevIndexTtlMs = 60 * 60 * 1000
+)
+
+// The stores that an index can keep the contents of files in, so that they can
+// be searched once the trigram index has found them.
+const (
+	// A gzip copy of each file, which is the default.
+	StoreFiles = "files"
+
+	// A single file that holds the contents of every file in blocks, and a
+	// table of where each file is. Blocks may be compressed, see
+	// CompressionFlate.
+	StorePacked = "packed"
+)
+
+// The compression of the blocks of a packed store.
+const (
+	CompressionNone  = "none"
+	CompressionFlate = "flate"
+)
+
+var (
+	ErrUnknownStore       = errors.New("unknown content store")
+	ErrUnknownCompression = errors.New("unknown content compression")
+)
+
+// Check that a content store and its compression are known, and that a
+// compression is only given for a packed store. Empty values are the defaults.
+func ValidateStore(store, compression string) error {
+	switch store {
+	case "", StoreFiles:
+		if compression != "" {
+			return fmt.Errorf("compression is only supported by the %s store", StorePacked)
+		}
+		return nil
+	case StorePacked:
+		switch compression {
+		case "", CompressionNone, CompressionFlate:
+			return nil
+		}
+		return fmt.Errorf("%w: %q", ErrUnknownCompression, compression)
+	}
+	return fmt.Errorf("%w: %q", ErrUnknownStore, store)
+}
+
 type UrlPattern struct {
 	BaseUrl string `json:"base-url"`
 	Anchor  string `json:"anchor"`
@@ -37,6 +89,35 @@ type Repo struct {
 	EnablePollUpdates  *bool          `json:"enable-poll-updates"`
 	EnablePushUpdates  *bool          `json:"enable-push-updates"`
 	AutoGeneratedFiles []string       `json:"auto-generated-files"`
+
+	// How long each vcs command may run before it is killed and the poll
+	// fails. The vcs package's default is used when this is 0.
+	MsCommandTimeout int `json:"ms-command-timeout,omitempty"`
+
+	// Globs of the paths to check out and index, or every path if there
+	// are none, and of the paths not to. Globs are relative to the root of
+	// the repo and may use ** to match any number of directories.
+	IncludePaths []string `json:"include-paths,omitempty"`
+	ExcludePaths []string `json:"exclude-paths,omitempty"`
+
+	// Are the patterns in .gitignore files not indexed, along with those in
+	// .houndignore files?
+	UseGitignore bool `json:"use-gitignore,omitempty"`
+
+	// Where the index keeps the contents of files: "files", a gzip file for
+	// each file, which is the default, or "packed", a single file for all of
+	// them. The blocks of a packed store are compressed when the compression
+	// is "flate".
+	ContentStore       string `json:"content-store,omitempty"`
+	ContentCompression string `json:"content-compression,omitempty"`
+
+	// The groups that may see the repo. A repo without groups is visible
+	// to everyone.
+	Groups []string `json:"groups,omitempty"`
+
+	// The secret that webhooks for the repo are signed with. The global
+	// webhook-secret is used when this is empty.
+	WebhookSecret Secret `json:"webhook-secret,omitempty"`
 }
 
 // Used for interpreting the config value for fields that use *bool. If a value
@@ -58,6 +139,21 @@ func (r *Repo) PushUpdatesEnabled() bool {
 	return optionToBool(r.EnablePushUpdates, defaultPushEnabled)
 }
 
+// Check the settings of the repo that are only used once it is indexed, so
+// that mistakes in them are reported as soon as the config is read.
+func (r *Repo) Validate() error {
+	return ValidateStore(r.ContentStore, r.ContentCompression)
+}
+
+// The names of the ignore files whose patterns are not indexed, in increasing
+// order of precedence.
+func (r *Repo) IgnoreFiles() []string {
+	if r.UseGitignore {
+		return []string{".gitignore", ".houndignore"}
+	}
+	return []string{".houndignore"}
+}
+
 type Config struct {
 	DbPath                string                    `json:"dbpath"`
 	Title                 string                    `json:"title"`
@@ -66,6 +162,54 @@ type Config struct {
 	HealthCheckURI        string                    `json:"health-check-uri"`
 	VCSConfigMessages     map[string]*SecretMessage `json:"vcs-config"`
 	ResultLimit           int                       `json:"result-limit"`
+	SearchTimeoutMs       int                       `json:"search-timeout-ms"`
+	MaxRevIndexes         int                       `json:"max-rev-indexes"`
+	RevIndexTtlMs         int                       `json:"rev-index-ttl-ms"`
+	Auth                  *AuthConfig               `json:"auth,omitempty"`
+	WebhookSecret         Secret                    `json:"webhook-secret,omitempty"`
+	CorsOrigins           []string                  `json:"cors-origins"`
+}
+
+// How clients are authenticated. A request is identified by a bearer token,
+// HTTP basic auth against a htpasswd file or a header set by a trusted reverse
+// proxy, in that order. Requests without credentials get the anonymous role,
+// which denies access when it is empty.
+type AuthConfig struct {
+	Tokens        []*TokenConfig      `json:"tokens"`
+	HtpasswdFile  string              `json:"htpasswd-file"`
+	Proxy         *ProxyAuthConfig    `json:"proxy"`
+	AdminUsers    []string            `json:"admin-users"`
+	Groups        map[string][]string `json:"groups"`
+	AnonymousRole string              `json:"anonymous-role"`
+}
+
+// A static bearer token and the role and groups it grants.
+type TokenConfig struct {
+	Name   string   `json:"name"`
+	Token  string   `json:"token"`
+	Role   string   `json:"role"`
+	Groups []string `json:"groups"`
+}
+
+// The headers that a reverse proxy sets to the name of the authenticated user
+// and, optionally, a comma separated list of their groups. The headers are
+// only trusted on requests from the given networks.
+type ProxyAuthConfig struct {
+	UserHeader     string   `json:"user-header"`
+	GroupsHeader   string   `json:"groups-header"`
+	TrustedProxies []string `json:"trusted-proxies"`
+}
+
+// How long an index of a revision that was requested on demand is kept after
+// it was last searched.
+func (c *Config) RevIndexTtl() time.Duration {
+	return time.Duration(c.RevIndexTtlMs) * time.Millisecond
+}
+
+// The time budget for a single search, after which partial results are
+// returned. Zero means searches are allowed to run to completion.
+func (c *Config) SearchTimeout() time.Duration {
+	return time.Duration(c.SearchTimeoutMs) * time.Millisecond
 }
 
 // SecretMessage is just like json.RawMessage but it will not
@@ -87,6 +231,20 @@ func (s *SecretMessage) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// A Secret is a string in the config, like the secret for webhooks, that is
+// never sent to clients.
+type Secret string
+
+// This always marshals to an empty string.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(`""`), nil
+}
+
+// Secrets are not printed either, so that they do not end up in the logs.
+func (s Secret) String() string {
+	return ""
+}
+
 // Get the JSON encode vcs-config for this repo. This returns nil if
 // the repo doesn't declare a vcs-config.
 func (r *Repo) VcsConfig() []byte {
@@ -137,6 +295,20 @@ func initConfig(c *Config) error {
 		c.ResultLimit = defaultResultLimit
 	}
 
+	if c.MaxRevIndexes == 0 {
+		c.MaxRevIndexes = DefaultMaxRevIndexes
+	}
+
+	if c.RevIndexTtlMs == 0 {
+		c.RevIndexTtlMs = DefaultRevIndexTtlMs
+	}
+
+	// Without any origins in the config, responses can be read from any
+	// origin. An empty list turns CORS off.
+	if c.CorsOrigins == nil {
+		c.CorsOrigins = []string{defaultCorsOrigin}
+	}
+
 	return mergeVCSConfigs(c)
 }
 
@@ -147,51 +319,85 @@ func mergeVCSConfigs(cfg *Config) error {
 		return nil
 	}
 
-	globalConfigVals := make(map[string]map[string]interface{}, globalConfigLen)
-	for vcs, configBytes := range cfg.VCSConfigMessages {
+	globalConfigVals, err := cfg.globalVCSConfigVals()
+	if err != nil {
+		return err
+	}
+
+	for _, repo := range cfg.Repos {
+		if err := mergeVCSConfig(globalConfigVals, repo); err != nil {
+			return err
+		}
+	}
+	log.Printf("merge vcs configs success, config: %+v", cfg)
+
+	return nil
+}
+
+// Parse the global vcs configs, keyed by vcs.
+func (c *Config) globalVCSConfigVals() (map[string]map[string]interface{}, error) {
+	globalConfigVals := make(map[string]map[string]interface{}, len(c.VCSConfigMessages))
+	for vcs, configBytes := range c.VCSConfigMessages {
 		var configVals map[string]interface{}
 		if err := json.Unmarshal(*configBytes, &configVals); err != nil {
 			log.Printf("error unmarshal global vcs config: %s", err)
-			return err
+			return nil, err
 		}
 
 		globalConfigVals[vcs] = configVals
 	}
+	return globalConfigVals, nil
+}
 
-	for _, repo := range cfg.Repos {
-		var globalVals map[string]interface{}
-		globalVals, valsExist := globalConfigVals[repo.Vcs]
-		if !valsExist {
-			continue
-		}
-
-		repoBytes := repo.VcsConfig()
-		var repoVals map[string]interface{}
-		if len(repoBytes) == 0 {
-			repoVals = make(map[string]interface{}, len(globalVals))
-		} else if err := json.Unmarshal(repoBytes, &repoVals); err != nil {
-			return err
-		}
+// Merge the global vcs config values into the repo's vcs config. Values that
+// are set on the repo take precedence.
+func mergeVCSConfig(globalConfigVals map[string]map[string]interface{}, repo *Repo) error {
+	var globalVals map[string]interface{}
+	globalVals, valsExist := globalConfigVals[repo.Vcs]
+	if !valsExist {
+		return nil
+	}
 
-		for name, val := range globalVals {
-			if _, ok := repoVals[name]; !ok {
-				repoVals[name] = val
-			}
-		}
+	repoBytes := repo.VcsConfig()
+	var repoVals map[string]interface{}
+	if len(repoBytes) == 0 {
+		repoVals = make(map[string]interface{}, len(globalVals))
+	} else if err := json.Unmarshal(repoBytes, &repoVals); err != nil {
+		return err
+	}
 
-		repoBytes, err := json.Marshal(&repoVals)
-		if err != nil {
-			return err
+	for name, val := range globalVals {
+		if _, ok := repoVals[name]; !ok {
+			repoVals[name] = val
 		}
+	}
 
-		repoMessage := SecretMessage(repoBytes)
-		repo.VcsConfigMessage = &repoMessage
+	repoBytes, err := json.Marshal(&repoVals)
+	if err != nil {
+		return err
 	}
-	log.Printf("merge vcs configs success, config: %+v", cfg)
 
+	repoMessage := SecretMessage(repoBytes)
+	repo.VcsConfigMessage = &repoMessage
 	return nil
 }
 
+// MergeVCSConfig merges the global vcs config into a single repo, as is done
+// for every repo when the config is loaded. This is for repos that are added
+// to a config that has already been loaded.
+func (c *Config) MergeVCSConfig(repo *Repo) error {
+	if len(c.VCSConfigMessages) == 0 {
+		return nil
+	}
+
+	globalConfigVals, err := c.globalVCSConfigVals()
+	if err != nil {
+		return err
+	}
+
+	return mergeVCSConfig(globalConfigVals, repo)
+}
+
 func (c *Config) LoadFromFile(filename string) error {
 	log.Printf("start load config file: %s", filename)
 	r, err := os.Open(filename)
@@ -218,9 +424,13 @@ func (c *Config) LoadFromFile(filename string) error {
 		c.DbPath = path
 	}
 
-	for _, repo := range c.Repos {
+	for name, repo := range c.Repos {
 		log.Printf("start init repo: %s", repo.Url)
 		InitRepo(repo)
+
+		if err := repo.Validate(); err != nil {
+			return fmt.Errorf("repo %s: %w", name, err)
+		}
 	}
 
 	return initConfig(c)
@@ -235,6 +445,47 @@ func (c *Config) ToJsonString() (string, error) {
 	return string(b), nil
 }
 
+// The representation of a Repo in the config file. Unlike the JSON that is
+// sent to clients, this includes the repo's vcs-config.
+type repoFile struct {
+	*Repo
+	VcsConfigMessage json.RawMessage `json:"vcs-config,omitempty"`
+	WebhookSecret    string          `json:"webhook-secret,omitempty"`
+}
+
+// The representation of a Config in the config file.
+type configFile struct {
+	*Config
+	Repos             map[string]*repoFile       `json:"repos"`
+	VCSConfigMessages map[string]json.RawMessage `json:"vcs-config,omitempty"`
+	WebhookSecret     string                     `json:"webhook-secret,omitempty"`
+}
+
+func newConfigFile(c *Config) *configFile {
+	f := &configFile{
+		Config:        c,
+		Repos:         make(map[string]*repoFile, len(c.Repos)),
+		WebhookSecret: string(c.WebhookSecret),
+	}
+
+	for name, repo := range c.Repos {
+		f.Repos[name] = &repoFile{
+			Repo:             repo,
+			VcsConfigMessage: json.RawMessage(repo.VcsConfig()),
+			WebhookSecret:    string(repo.WebhookSecret),
+		}
+	}
+
+	if len(c.VCSConfigMessages) > 0 {
+		f.VCSConfigMessages = make(map[string]json.RawMessage, len(c.VCSConfigMessages))
+		for vcs, msg := range c.VCSConfigMessages {
+			f.VCSConfigMessages[vcs] = json.RawMessage(*msg)
+		}
+	}
+
+	return f
+}
+
 // SaveToFile saves the config to a JSON file.
 func (c *Config) SaveToFile(filename string) error {
 	// Create a temporary file first for atomic write
@@ -248,7 +499,7 @@ func (c *Config) SaveToFile(filename string) error {
 
 	encoder := json.NewEncoder(w)
 	encoder.SetIndent("", "    ")
-	if err := encoder.Encode(c); err != nil {
+	if err := encoder.Encode(newConfigFile(c)); err != nil {
 		os.Remove(tmpFile)
 		return err
 	}
@@ -2,8 +2,11 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/hound-search/hound/vcs"
@@ -57,3 +60,132 @@ func TestExampleConfigsAreValid(t *testing.T) {
 	}
 
 }
+
+// Test that saving a config keeps the vcs-config that is hidden from clients.
+func TestSaveToFileKeepsVcsConfig(t *testing.T) {
+	var cfg Config
+	if err := cfg.LoadFromFile(filepath.Join(rootDir(), exampleConfigFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "config.json")
+	if err := cfg.SaveToFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	var saved Config
+	if err := saved.LoadFromFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(saved.Repos) != len(cfg.Repos) {
+		t.Fatalf("expected %d repos, got %d", len(cfg.Repos), len(saved.Repos))
+	}
+
+	var vcsConfigVals map[string]interface{}
+	json.Unmarshal(saved.Repos["SubversionWithCreds"].VcsConfig(), &vcsConfigVals) //nolint
+	if vcsConfigVals["username"] != "username_for_ro_account" {
+		t.Errorf("expected vcs-config to be saved, got %v", vcsConfigVals)
+	}
+
+	if len(saved.VCSConfigMessages) != len(cfg.VCSConfigMessages) {
+		t.Errorf("expected global vcs-config to be saved")
+	}
+}
+
+func TestWebhookSecretIsHidden(t *testing.T) {
+	cfg := Config{
+		Repos: map[string]*Repo{
+			"hound": {
+				Url:           "https://github.com/hound-search/hound.git",
+				WebhookSecret: "s3cret",
+			},
+		},
+	}
+
+	b, err := json.Marshal(cfg.Repos)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(b), "s3cret") {
+		t.Errorf("expected the webhook secret to be hidden, got %s", b)
+	}
+
+	filename := filepath.Join(t.TempDir(), "config.json")
+	if err := cfg.SaveToFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	var saved Config
+	if err := saved.LoadFromFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if saved.Repos["hound"].WebhookSecret != "s3cret" {
+		t.Errorf("expected the webhook secret to be saved, got %q", saved.Repos["hound"].WebhookSecret)
+	}
+}
+
+func TestSecretsAreNotPrinted(t *testing.T) {
+	cfg := Config{
+		WebhookSecret: "s3cret",
+	}
+
+	if s := fmt.Sprintf("%+v", cfg); strings.Contains(s, "s3cret") {
+		t.Errorf("expected the webhook secret to be hidden, got %s", s)
+	}
+
+	filename := filepath.Join(t.TempDir(), "config.json")
+	if err := cfg.SaveToFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	var saved Config
+	if err := saved.LoadFromFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if saved.WebhookSecret != "s3cret" {
+		t.Errorf("expected the webhook secret to be saved, got %q", string(saved.WebhookSecret))
+	}
+}
+
+func TestLoadFromFileValidatesContentStore(t *testing.T) {
+	for _, repo := range []string{
+		`{"url":"https://github.com/hound-search/hound.git","content-store":"pakced"}`,
+		`{"url":"https://github.com/hound-search/hound.git","content-compression":"flate"}`,
+	} {
+		filename := filepath.Join(t.TempDir(), "config.json")
+		if err := ioutil.WriteFile(filename, []byte(`{"dbpath":"db","repos":{"hound":`+repo+`}}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var cfg Config
+		if err := cfg.LoadFromFile(filename); err == nil {
+			t.Errorf("expected %s to be rejected", repo)
+		}
+	}
+}
+
+func TestValidateStore(t *testing.T) {
+	for _, test := range []struct {
+		store, compression string
+		valid              bool
+	}{
+		{"", "", true},
+		{StoreFiles, "", true},
+		{StorePacked, "", true},
+		{StorePacked, CompressionNone, true},
+		{StorePacked, CompressionFlate, true},
+		{"pakced", "", false},
+		{StorePacked, "zstd", false},
+		{StoreFiles, CompressionFlate, false},
+		{"", CompressionNone, false},
+	} {
+		if err := ValidateStore(test.store, test.compression); (err == nil) != test.valid {
+			t.Errorf("store %q with compression %q: expected valid to be %v, got %v",
+				test.store, test.compression, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package gitrepo
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/hound-search/hound/ignore"
+)
+
+const attributesFile = ".gitattributes"
+
+// Return the slash separated paths of the files of a commit that are given an
+// attribute, such as linguist-generated, by the .gitattributes files of the
+// commit. Only attributes that are set, or set to true, count.
+func (r *Repo) FilesWithAttribute(id ID, attr string) ([]string, error) {
+	var files []string
+	attrFiles := map[string]ID{}
+	err := r.Walk(id, func(p string, e TreeEntry) error {
+		files = append(files, p)
+		if path.Base(p) == attributesFile && e.Mode != ModeSymlink {
+			attrFiles[strings.TrimSuffix(p, attributesFile)] = e.ID
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The patterns of deeper directories take precedence. The directories
+	// end with a slash, except for the root, which is empty.
+	var dirs []string
+	for dir := range attrFiles {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		di, dj := strings.Count(dirs[i], "/"), strings.Count(dirs[j], "/")
+		if di != dj {
+			return di < dj
+		}
+		return dirs[i] < dirs[j]
+	})
+
+	// Attribute patterns are matched like ignore patterns, so the files
+	// that set the attribute are ignored and those that unset it are not.
+	m := ignore.New()
+	for _, dir := range dirs {
+		data, err := r.Blob(attrFiles[dir])
+		if err != nil {
+			return nil, err
+		}
+
+		if err := m.Add(strings.TrimSuffix(dir, "/"), strings.NewReader(attributePatterns(string(data), attr))); err != nil {
+			return nil, err
+		}
+	}
+
+	var matched []string
+	for _, file := range files {
+		if m.Match(file, false) {
+			matched = append(matched, file)
+		}
+	}
+	return matched, nil
+}
+
+// Translate the lines of a .gitattributes file that set or unset the attribute
+// into ignore patterns.
+func attributePatterns(data, attr string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+
+		// Quoted patterns are not supported, and patterns cannot be
+		// negated in .gitattributes files.
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") ||
+			strings.HasPrefix(fields[0], `"`) || strings.HasPrefix(fields[0], "!") {
+			continue
+		}
+
+		set, found := false, false
+		for _, f := range fields[1:] {
+			switch f {
+			case attr, attr + "=true":
+				set, found = true, true
+			case "-" + attr, "!" + attr, attr + "=false":
+				set, found = false, true
+			}
+		}
+
+		if !found {
+			continue
+		}
+
+		if !set {
+			b.WriteString("!")
+		}
+		b.WriteString(fields[0])
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,312 @@
+package gitrepo
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// Check out the tree of a commit into the working directory of the repo and
+// make it the repo's HEAD. Only the files that differ from the commit that was
+// checked out before are written, unless its tree is no longer in the repo.
+func (r *Repo) Checkout(id ID) error {
+	if r.workDir == "" {
+		return errors.New("gitrepo: cannot check out into a bare repo")
+	}
+
+	commit, err := r.Commit(id)
+	if err != nil {
+		return err
+	}
+
+	// The working directory is empty after SetHead, even though the repo
+	// has a HEAD.
+	var oldTree ID
+	if old, err := r.Head(); err == nil && !r.workDirEmpty() {
+		if c, err := r.Commit(old); err == nil {
+			oldTree = c.Tree
+		}
+	}
+
+	if oldTree.IsZero() {
+		if err := r.cleanWorkDir(); err != nil {
+			return err
+		}
+	}
+
+	if err := r.checkoutTree(r.workDir, oldTree, commit.Tree); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(r.gitDir, "HEAD"), []byte(id.String()+"\n"))
+}
+
+// Make a commit the repo's HEAD without checking it out, for repos whose files
+// are only read from its objects. Files that were checked out before are
+// removed, and the next checkout writes every file.
+func (r *Repo) SetHead(id ID) error {
+	if !r.HasObject(id) {
+		return ErrObjectNotFound
+	}
+
+	if r.workDir != "" {
+		if err := r.cleanWorkDir(); err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(filepath.Join(r.gitDir, "HEAD"), []byte(id.String()+"\n"))
+}
+
+// Does the working directory hold nothing but the git directory?
+func (r *Repo) workDirEmpty() bool {
+	infos, err := ioutil.ReadDir(r.workDir)
+	return err == nil && len(infos) == 1 && infos[0].Name() == ".git"
+}
+
+// Remove everything from the working directory but the git directory.
+func (r *Repo) cleanWorkDir() error {
+	infos, err := ioutil.ReadDir(r.workDir)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if info.Name() == ".git" {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(r.workDir, info.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update dir, which holds the tree oldID, or nothing if it is zero, to hold the
+// tree newID.
+func (r *Repo) checkoutTree(dir string, oldID, newID ID) error {
+	if oldID == newID {
+		return nil
+	}
+
+	old := map[string]TreeEntry{}
+	if !oldID.IsZero() {
+		entries, err := r.Tree(oldID)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			old[e.Name] = e
+		}
+	}
+
+	entries, err := r.Tree(newID)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name)
+		o, existed := old[e.Name]
+		delete(old, e.Name)
+
+		if existed && o.Mode == e.Mode && o.ID == e.ID {
+			continue
+		}
+
+		// A path whose kind changed is replaced, as are symlinks, which
+		// cannot be overwritten.
+		if existed && (o.Mode&modeKind != e.Mode&modeKind || e.Mode == ModeSymlink) {
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+			existed = false
+		}
+
+		switch {
+		case e.IsTree():
+			if err := os.MkdirAll(p, os.ModePerm); err != nil {
+				return err
+			}
+
+			var oldSub ID
+			if existed {
+				oldSub = o.ID
+			}
+			if err := r.checkoutTree(p, oldSub, e.ID); err != nil {
+				return err
+			}
+		case e.Mode == ModeSymlink:
+			target, err := r.Blob(e.ID)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(string(target), p); err != nil {
+				return err
+			}
+		case e.IsBlob():
+			if err := r.writeFile(p, e); err != nil {
+				return err
+			}
+		case e.Mode == ModeGitlink:
+			// Submodules are not fetched, so they are checked out as
+			// empty directories, like git does.
+			if err := os.MkdirAll(p, os.ModePerm); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Whatever is left was removed from the tree.
+	for name := range old {
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Repo) writeFile(p string, e TreeEntry) error {
+	data, err := r.Blob(e.ID)
+	if err != nil {
+		return err
+	}
+
+	perm := os.FileMode(0644)
+	if e.Mode == ModeExec {
+		perm = 0755
+	}
+
+	// The file is removed first, so that its mode is set even if it
+	// already existed.
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(p, data, perm)
+}
+
+// Call fn for each file of the tree of a commit, in the order of the tree,
+// with its slash separated path. Submodules are skipped.
+func (r *Repo) Walk(id ID, fn func(path string, e TreeEntry) error) error {
+	commit, err := r.Commit(id)
+	if err != nil {
+		return err
+	}
+	return r.walkTree("", commit.Tree, fn)
+}
+
+func (r *Repo) walkTree(dir string, id ID, fn func(path string, e TreeEntry) error) error {
+	entries, err := r.Tree(id)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		p := path.Join(dir, e.Name)
+		if e.IsTree() {
+			if err := r.walkTree(p, e.ID, fn); err != nil {
+				return err
+			}
+		} else if e.IsBlob() {
+			if err := fn(p, e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Return the slash separated paths of the files that were added, modified or
+// removed between two commits.
+func (r *Repo) ChangedFiles(from, to ID) ([]string, error) {
+	fromCommit, err := r.Commit(from)
+	if err != nil {
+		return nil, err
+	}
+
+	toCommit, err := r.Commit(to)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	err = r.diffTrees("", fromCommit.Tree, toCommit.Tree, func(p string) {
+		files = append(files, p)
+	})
+	return files, err
+}
+
+// Call changed with the path of each file that differs between two trees,
+// either of which may be zero for a tree that does not exist.
+func (r *Repo) diffTrees(dir string, oldID, newID ID, changed func(path string)) error {
+	if oldID == newID {
+		return nil
+	}
+
+	entries := func(id ID) (map[string]TreeEntry, error) {
+		m := map[string]TreeEntry{}
+		if id.IsZero() {
+			return m, nil
+		}
+
+		es, err := r.Tree(id)
+		for _, e := range es {
+			if e.IsTree() || e.IsBlob() {
+				m[e.Name] = e
+			}
+		}
+		return m, err
+	}
+
+	old, err := entries(oldID)
+	if err != nil {
+		return err
+	}
+
+	cur, err := entries(newID)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range cur {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		o, inOld := old[name]
+		n, inNew := cur[name]
+		if inOld && inNew && o.Mode == n.Mode && o.ID == n.ID {
+			continue
+		}
+
+		// Either side is a tree or a file, and either may be missing.
+		var oldTree, newTree ID
+		if inOld && o.IsTree() {
+			oldTree = o.ID
+		}
+		if inNew && n.IsTree() {
+			newTree = n.ID
+		}
+
+		if err := r.diffTrees(path.Join(dir, name), oldTree, newTree, changed); err != nil {
+			return err
+		}
+
+		if (inOld && !o.IsTree()) || (inNew && !n.IsTree()) {
+			changed(path.Join(dir, name))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,485 @@
+package gitrepo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The capabilities of an upload-pack server that are asked for when it
+// advertises them.
+var wantCapabilities = []string{"side-band-64k", "ofs-delta", "shallow", "no-progress"}
+
+// The ref that the remote's HEAD points to, which is fetched when no branch is
+// given.
+const headRef = "HEAD"
+
+// Fetch the latest commit of a branch of the repo at url, which is a local path,
+// a file url or an http or https url, along with its tree. When branch is
+// empty, the branch that the remote's HEAD points to is fetched. The commit is
+// stored as refs/remotes/origin/<branch> and returned with the name of the
+// branch.
+//
+// Only the latest commit is fetched, so the repo is shallow. The objects of the
+// commit are written to a pack of their own, which Prune relies on.
+func (r *Repo) Fetch(ctx context.Context, rawUrl, branch string) (ID, string, error) {
+	var rem remote
+	if u, err := url.Parse(rawUrl); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		rem = &httpRemote{url: strings.TrimSuffix(rawUrl, "/")}
+	} else if err == nil && u.Scheme == "file" {
+		rem = &localRemote{dir: u.Path}
+	} else if err == nil && u.Scheme == "" {
+		rem = &localRemote{dir: rawUrl}
+	} else {
+		return ID{}, "", fmt.Errorf("gitrepo: unsupported url: %s", rawUrl)
+	}
+
+	refs, head, err := rem.refs(ctx)
+	if err != nil {
+		return ID{}, "", err
+	}
+
+	if branch == "" {
+		if !strings.HasPrefix(head, "refs/heads/") {
+			return ID{}, "", fmt.Errorf("gitrepo: cannot tell which branch HEAD is at %s", rawUrl)
+		}
+		branch = strings.TrimPrefix(head, "refs/heads/")
+	}
+
+	id, ok := refs["refs/heads/"+branch]
+	if !ok {
+		return ID{}, "", fmt.Errorf("gitrepo: no branch %s at %s", branch, rawUrl)
+	}
+
+	if !r.HasObject(id) {
+		if err := rem.fetch(ctx, r, id); err != nil {
+			return ID{}, "", err
+		}
+
+		if err := r.loadPacks(); err != nil {
+			return ID{}, "", err
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(r.gitDir, "shallow"), []byte(id.String()+"\n"), 0644); err != nil {
+			return ID{}, "", err
+		}
+	}
+
+	return id, branch, r.SetRef("refs/remotes/origin/"+branch, id)
+}
+
+// A repo that objects are fetched from.
+type remote interface {
+	// Return the refs of the repo, and the ref that its HEAD points to.
+	refs(ctx context.Context) (map[string]ID, string, error)
+
+	// Fetch a commit and its tree into a new pack in r.
+	fetch(ctx context.Context, r *Repo, id ID) error
+}
+
+// A repo on the local file system.
+type localRemote struct {
+	dir string
+}
+
+func (l *localRemote) refs(ctx context.Context) (map[string]ID, string, error) {
+	src, err := Open(l.dir)
+	if err != nil {
+		return nil, "", err
+	}
+	defer src.Close()
+
+	names, err := src.branches()
+	if err != nil {
+		return nil, "", err
+	}
+
+	refs := map[string]ID{}
+	for _, name := range names {
+		id, err := src.Ref(name)
+		if err != nil {
+			return nil, "", err
+		}
+		refs[name] = id
+	}
+
+	head, _ := src.SymbolicRef(headRef)
+	return refs, head, nil
+}
+
+// Return the names of the branches of the repo, from the loose refs and the
+// packed-refs file.
+func (r *Repo) branches() ([]string, error) {
+	var names []string
+	seen := map[string]bool{}
+	root := filepath.Join(r.gitDir, "refs", "heads")
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			rel, err := filepath.Rel(r.gitDir, path)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(rel)
+			names = append(names, name)
+			seen[name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(r.gitDir, "packed-refs"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.HasPrefix(fields[1], "refs/heads/") && !seen[fields[1]] {
+			names = append(names, fields[1])
+		}
+	}
+
+	return names, nil
+}
+
+// Copy the commit and every object of its tree into a new pack. Submodules are
+// left out, since their commits are in other repos.
+func (l *localRemote) fetch(ctx context.Context, r *Repo, id ID) error {
+	src, err := Open(l.dir)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	commit, err := src.Commit(id)
+	if err != nil {
+		return err
+	}
+
+	w, err := newPackWriter(r.packDir())
+	if err != nil {
+		return err
+	}
+
+	// A tag is peeled so that the commit is what is copied.
+	data, err := src.objectOfType(id, ObjCommit)
+	if err == nil {
+		err = w.add(ObjCommit, data)
+	}
+
+	if err == nil {
+		err = copyTree(ctx, src, w, commit.Tree, map[ID]bool{})
+	}
+
+	if err != nil {
+		w.abort()
+		return err
+	}
+
+	_, err = w.finish()
+	return err
+}
+
+func copyTree(ctx context.Context, src *Repo, w *packWriter, id ID, seen map[ID]bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	data, err := src.objectOfType(id, ObjTree)
+	if err != nil {
+		return err
+	}
+
+	entries, err := parseTree(data)
+	if err != nil {
+		return err
+	}
+
+	if err := w.add(ObjTree, data); err != nil {
+		return err
+	}
+	seen[id] = true
+
+	for _, e := range entries {
+		if seen[e.ID] {
+			continue
+		}
+
+		if e.IsTree() {
+			if err := copyTree(ctx, src, w, e.ID, seen); err != nil {
+				return err
+			}
+		} else if e.IsBlob() {
+			blob, err := src.Blob(e.ID)
+			if err != nil {
+				return err
+			}
+
+			if err := w.add(ObjBlob, blob); err != nil {
+				return err
+			}
+			seen[e.ID] = true
+		}
+	}
+
+	return nil
+}
+
+// A repo that is served over git's smart http protocol.
+type httpRemote struct {
+	url  string
+	caps map[string]string
+}
+
+func (h *httpRemote) refs(ctx context.Context) (map[string]ID, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("gitrepo: %s: %s", redactURL(h.url), res.Status)
+	}
+
+	if res.Header.Get("Content-Type") != "application/x-git-upload-pack-advertisement" {
+		return nil, "", fmt.Errorf("gitrepo: %s does not support the smart http protocol", redactURL(h.url))
+	}
+
+	r := bufio.NewReader(res.Body)
+	line, err := readPktLine(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if strings.TrimSpace(string(line)) != "# service=git-upload-pack" {
+		return nil, "", fmt.Errorf("gitrepo: unexpected response from %s: %q", redactURL(h.url), line)
+	}
+
+	if line, err = readPktLine(r); err != nil {
+		return nil, "", err
+	} else if line != nil {
+		return nil, "", fmt.Errorf("gitrepo: unexpected response from %s: %q", redactURL(h.url), line)
+	}
+
+	refs := map[string]ID{}
+	h.caps = map[string]string{}
+	for first := true; ; first = false {
+		line, err := readPktLine(r)
+		if err != nil {
+			return nil, "", err
+		} else if line == nil {
+			break
+		}
+
+		line = bytes.TrimSuffix(line, []byte{'\n'})
+		if first {
+			if i := bytes.IndexByte(line, 0); i >= 0 {
+				for _, c := range strings.Fields(string(line[i+1:])) {
+					kv := strings.SplitN(c, "=", 2)
+					if len(kv) == 2 {
+						h.caps[kv[0]] += kv[1] + " "
+					} else {
+						h.caps[kv[0]] = ""
+					}
+				}
+				line = line[:i]
+			}
+		}
+
+		fields := strings.Fields(string(line))
+		if len(fields) != 2 {
+			return nil, "", fmt.Errorf("gitrepo: unexpected ref from %s: %q", redactURL(h.url), line)
+		}
+
+		id, err := ParseID(fields[0])
+		if err != nil {
+			return nil, "", err
+		}
+		refs[fields[1]] = id
+	}
+
+	// The symrefs capability tells which branch HEAD points to.
+	var head string
+	for _, symref := range strings.Fields(h.caps["symref"]) {
+		if strings.HasPrefix(symref, headRef+":") {
+			head = strings.TrimPrefix(symref, headRef+":")
+		}
+	}
+
+	return refs, head, nil
+}
+
+func (h *httpRemote) fetch(ctx context.Context, r *Repo, id ID) error {
+	var caps []string
+	for _, c := range wantCapabilities {
+		if _, ok := h.caps[c]; ok {
+			caps = append(caps, c)
+		}
+	}
+
+	var body bytes.Buffer
+	writePktLine(&body, fmt.Sprintf("want %s %s\n", id, strings.Join(caps, " ")))
+	_, shallow := h.caps["shallow"]
+	if shallow {
+		writePktLine(&body, "deepen 1\n")
+	}
+	body.WriteString("0000")
+	writePktLine(&body, "done\n")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url+"/git-upload-pack", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Accept", "application/x-git-upload-pack-result")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("gitrepo: %s: %s", redactURL(h.url), res.Status)
+	}
+
+	rd := bufio.NewReader(res.Body)
+
+	// The shallow commits come first, ending with a flush.
+	if shallow {
+		for {
+			line, err := readPktLine(rd)
+			if err != nil {
+				return err
+			} else if line == nil {
+				break
+			}
+		}
+	}
+
+	line, err := readPktLine(rd)
+	if err != nil {
+		return err
+	} else if !bytes.HasPrefix(line, []byte("NAK")) && !bytes.HasPrefix(line, []byte("ACK")) {
+		return fmt.Errorf("gitrepo: unexpected response from %s: %q", redactURL(h.url), line)
+	}
+
+	f, err := ioutil.TempFile(r.packDir(), ".tmp-pack-")
+	if err != nil {
+		return err
+	}
+
+	if _, sideband := h.caps["side-band-64k"]; sideband {
+		err = copySideband(f, rd)
+	} else {
+		_, err = io.Copy(f, rd)
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	_, err = installPack(r.packDir(), f.Name())
+	return err
+}
+
+// Copy the pack data from a response that is multiplexed with progress and
+// error messages.
+func copySideband(w io.Writer, r *bufio.Reader) error {
+	for {
+		line, err := readPktLine(r)
+		if err != nil {
+			return err
+		} else if line == nil {
+			return nil
+		} else if len(line) == 0 {
+			continue
+		}
+
+		switch line[0] {
+		case 1:
+			if _, err := w.Write(line[1:]); err != nil {
+				return err
+			}
+		case 2:
+		case 3:
+			return fmt.Errorf("gitrepo: remote error: %s", bytes.TrimSpace(line[1:]))
+		default:
+			return fmt.Errorf("gitrepo: invalid side band %d", line[0])
+		}
+	}
+}
+
+// Read a pkt-line, returning nil for a flush packet.
+func readPktLine(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	n, err := strconv.ParseUint(string(size[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("gitrepo: invalid pkt-line size: %q", size)
+	}
+
+	// 0000 is a flush, and 0001 and 0002 are delimiters of newer protocol
+	// versions.
+	if n < 4 {
+		return nil, nil
+	}
+
+	line := make([]byte, n-4)
+	if _, err := io.ReadFull(r, line); err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(line, []byte("ERR ")) {
+		return nil, fmt.Errorf("gitrepo: remote error: %s", bytes.TrimSpace(line[4:]))
+	}
+	return line, nil
+}
+
+func writePktLine(w io.Writer, line string) {
+	fmt.Fprintf(w, "%04x%s", len(line)+4, line)
+}
+
+// Remove any password from a url, so that it can be shown in errors.
+func redactURL(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,460 @@
+package gitrepo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// A repo that is built without git, to fetch from.
+type testRepo struct {
+	t     *testing.T
+	dir   string
+	packs map[ID]string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	dir, err := ioutil.TempDir("", "gitrepo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	if err := Init(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	head := filepath.Join(dir, ".git", "HEAD")
+	if err := ioutil.WriteFile(head, []byte("ref: refs/heads/main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return &testRepo{t: t, dir: dir, packs: map[ID]string{}}
+}
+
+// Commit the files, given by their slash separated paths, to the main branch.
+// Every object of the commit is written to a pack of its own.
+func (tr *testRepo) commit(files map[string]string) ID {
+	w, err := newPackWriter(filepath.Join(tr.dir, ".git", "objects", "pack"))
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+
+	add := func(typ ObjectType, data []byte) ID {
+		if err := w.add(typ, data); err != nil {
+			tr.t.Fatal(err)
+		}
+		return hashObject(typ, data)
+	}
+
+	var writeTree func(dir string) ID
+	writeTree = func(dir string) ID {
+		entries := map[string]TreeEntry{}
+		for p, content := range files {
+			if !strings.HasPrefix(p, dir) {
+				continue
+			}
+
+			name := strings.TrimPrefix(p, dir)
+			if i := strings.IndexByte(name, '/'); i >= 0 {
+				name = name[:i]
+				entries[name] = TreeEntry{Name: name, Mode: ModeTree}
+			} else {
+				entries[name] = TreeEntry{Name: name, Mode: ModeFile, ID: add(ObjBlob, []byte(content))}
+			}
+		}
+
+		var names []string
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var buf bytes.Buffer
+		for _, name := range names {
+			e := entries[name]
+			if e.Mode == ModeTree {
+				e.ID = writeTree(dir + name + "/")
+			}
+			fmt.Fprintf(&buf, "%o %s\x00", e.Mode, e.Name)
+			buf.Write(e.ID[:])
+		}
+		return add(ObjTree, buf.Bytes())
+	}
+
+	commit := fmt.Sprintf("tree %s\nauthor a <a@example.com> 0 +0000\ncommitter a <a@example.com> 0 +0000\n\nmsg\n", writeTree(""))
+	id := add(ObjCommit, []byte(commit))
+
+	p, err := w.finish()
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	tr.packs[id] = p
+
+	r := tr.open()
+	defer r.Close()
+	if err := r.SetRef("refs/heads/main", id); err != nil {
+		tr.t.Fatal(err)
+	}
+	return id
+}
+
+func (tr *testRepo) open() *Repo {
+	r, err := Open(tr.dir)
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	return r
+}
+
+// Serve the repo over the smart http protocol, sending the pack that was
+// written for a commit when it is wanted.
+func (tr *testRepo) serve() *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r := tr.open()
+		defer r.Close()
+
+		id, err := r.Ref("refs/heads/main")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		switch req.URL.Path {
+		case "/repo/info/refs":
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+			writePktLine(w, "# service=git-upload-pack\n")
+			fmt.Fprint(w, "0000")
+			writePktLine(w, fmt.Sprintf("%s HEAD\x00side-band-64k ofs-delta shallow symref=HEAD:refs/heads/main\n", id))
+			writePktLine(w, fmt.Sprintf("%s refs/heads/main\n", id))
+			fmt.Fprint(w, "0000")
+		case "/repo/git-upload-pack":
+			body, _ := ioutil.ReadAll(req.Body)
+			if !bytes.Contains(body, []byte("want "+id.String())) || !bytes.Contains(body, []byte("deepen 1")) {
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+
+			data, err := ioutil.ReadFile(tr.packs[id])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			writePktLine(w, fmt.Sprintf("shallow %s\n", id))
+			fmt.Fprint(w, "0000")
+			writePktLine(w, "NAK\n")
+			writePktLine(w, "\x02Counting objects\n")
+			for len(data) > 0 {
+				n := len(data)
+				if n > 1000 {
+					n = 1000
+				}
+				writePktLine(w, "\x01"+string(data[:n]))
+				data = data[n:]
+			}
+			fmt.Fprint(w, "0000")
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	tr.t.Cleanup(s.Close)
+	return s
+}
+
+// Read the files of a working directory, by their slash separated paths.
+func readWorkDir(t *testing.T, dir string) map[string]string {
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Name() == ".git" {
+			return filepath.SkipDir
+		} else if info.IsDir() {
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func testFetchAndCheckout(t *testing.T, url func(tr *testRepo) string) {
+	src := newTestRepo(t)
+	v1 := map[string]string{
+		"README":         "hello\n",
+		"a/b/c.go":       "package b\n",
+		"a/d.txt":        "d\n",
+		"gone/gone.txt":  "gone\n",
+		".gitattributes": "gen/** linguist-generated\n",
+	}
+	id1 := src.commit(v1)
+
+	dst := newTestRepo(t)
+	r := dst.open()
+	defer r.Close()
+
+	id, branch, err := r.Fetch(context.Background(), url(src), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != id1 || branch != "main" {
+		t.Fatalf("expected %s on main, got %s on %s", id1, id, branch)
+	}
+
+	if err := r.Checkout(id); err != nil {
+		t.Fatal(err)
+	}
+	if got := readWorkDir(t, dst.dir); !reflect.DeepEqual(got, v1) {
+		t.Fatalf("expected %v, got %v", v1, got)
+	}
+
+	v2 := map[string]string{
+		"README":         "hello again\n",
+		"a/b/c.go":       "package b\n",
+		"a/d.txt/e.txt":  "d is a directory now\n",
+		"gen/g.go":       "package gen\n",
+		".gitattributes": "gen/** linguist-generated\n",
+	}
+	id2 := src.commit(v2)
+
+	id, _, err = r.Fetch(context.Background(), url(src), "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != id2 {
+		t.Fatalf("expected %s, got %s", id2, id)
+	}
+
+	if err := r.Checkout(id); err != nil {
+		t.Fatal(err)
+	}
+	if got := readWorkDir(t, dst.dir); !reflect.DeepEqual(got, v2) {
+		t.Fatalf("expected %v, got %v", v2, got)
+	}
+
+	if head, err := r.Head(); err != nil || head != id2 {
+		t.Fatalf("expected HEAD %s, got %s (%v)", id2, head, err)
+	}
+
+	changed, err := r.ChangedFiles(id1, id2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"README", "a/d.txt/e.txt", "a/d.txt", "gen/g.go", "gone/gone.txt"}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("expected changed files %v, got %v", expected, changed)
+	}
+
+	if err := r.Prune(id2); err != nil {
+		t.Fatal(err)
+	}
+	if r.HasObject(id1) {
+		t.Errorf("expected %s to be pruned", id1)
+	}
+	if _, err := r.ChangedFiles(id1, id2); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected %v, got %v", ErrObjectNotFound, err)
+	}
+}
+
+func TestFetchFromPath(t *testing.T) {
+	testFetchAndCheckout(t, func(tr *testRepo) string {
+		return tr.dir
+	})
+}
+
+func TestFetchFromFileURL(t *testing.T) {
+	testFetchAndCheckout(t, func(tr *testRepo) string {
+		return "file://" + filepath.ToSlash(tr.dir)
+	})
+}
+
+func TestFetchOverHTTP(t *testing.T) {
+	var s *httptest.Server
+	testFetchAndCheckout(t, func(tr *testRepo) string {
+		if s == nil {
+			s = tr.serve()
+		}
+		return s.URL + "/repo"
+	})
+}
+
+func TestFetchMissingBranch(t *testing.T) {
+	src := newTestRepo(t)
+	src.commit(map[string]string{"a": "a"})
+
+	dst := newTestRepo(t)
+	r := dst.open()
+	defer r.Close()
+
+	if _, _, err := r.Fetch(context.Background(), src.dir, "nope"); err == nil {
+		t.Fatal("expected an error for a missing branch")
+	}
+}
+
+func TestFilesWithAttribute(t *testing.T) {
+	src := newTestRepo(t)
+	id := src.commit(map[string]string{
+		".gitattributes":          "gen/** linguist-generated\n*.pb.go linguist-generated=true\n# a comment\n*.txt text\n",
+		"gen/a.go":                "",
+		"gen/keep/.gitattributes": "b.go -linguist-generated\n",
+		"gen/keep/b.go":           "",
+		"x/y.pb.go":               "",
+		"x/y.go":                  "",
+		"z.txt":                   "",
+	})
+
+	r := src.open()
+	defer r.Close()
+
+	files, err := r.FilesWithAttribute(id, "linguist-generated")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"gen/a.go", "gen/keep/.gitattributes", "x/y.pb.go"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected %v, got %v", expected, files)
+	}
+}
+
+func TestParseTreeRefusesUnsafeNames(t *testing.T) {
+	for _, name := range []string{"..", ".git", ".GIT", "a/b"} {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "%o %s\x00", ModeFile, name)
+		buf.Write(make([]byte, len(ID{})))
+
+		if _, err := parseTree(buf.Bytes()); err == nil {
+			t.Errorf("expected an error for %q", name)
+		}
+	}
+}
+
+// Append the header of a pack entry.
+func appendEntryHeader(b []byte, typ ObjectType, size int) []byte {
+	c := byte(typ)<<4 | byte(size&15)
+	for size >>= 4; size > 0; size >>= 7 {
+		b = append(b, c|0x80)
+		c = byte(size & 0x7f)
+	}
+	return append(b, c)
+}
+
+func deflate(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(data) //nolint
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadOfsDelta(t *testing.T) {
+	tr := newTestRepo(t)
+	dir := filepath.Join(tr.dir, ".git", "objects", "pack")
+
+	base := []byte("the quick brown fox jumps over the lazy dog")
+	target := []byte("the quick brown cat jumps over the lazy dog")
+
+	// Copy "the quick brown ", insert "cat", copy the rest.
+	delta := []byte{byte(len(base)), byte(len(target))}
+	delta = append(delta, 0x80|0x10, 16)
+	delta = append(delta, 3, 'c', 'a', 't')
+	delta = append(delta, 0x80|0x01|0x10, 19, byte(len(base)-19))
+
+	pack := []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x02")
+	baseOff := len(pack)
+	pack = appendEntryHeader(pack, ObjBlob, len(base))
+	pack = append(pack, deflate(t, base)...)
+	deltaOff := len(pack)
+	pack = appendEntryHeader(pack, objOfsDelta, len(delta))
+	pack = append(pack, byte(deltaOff-baseOff))
+	pack = append(pack, deflate(t, delta)...)
+	sum := sha1.Sum(pack)
+	pack = append(pack, sum[:]...)
+
+	tmp := filepath.Join(dir, "tmp")
+	if err := ioutil.WriteFile(tmp, pack, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := installPack(dir, tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	r := tr.open()
+	defer r.Close()
+
+	data, err := r.Blob(hashObject(ObjBlob, target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, target) {
+		t.Errorf("expected %q, got %q", target, data)
+	}
+}
+
+func TestSetHead(t *testing.T) {
+	src := newTestRepo(t)
+	files := map[string]string{"a/b.txt": "b\n", "c.txt": "c\n"}
+	id := src.commit(files)
+
+	dst := newTestRepo(t)
+	r := dst.open()
+	defer r.Close()
+
+	if _, _, err := r.Fetch(context.Background(), src.dir, "main"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Checkout(id); err != nil {
+		t.Fatal(err)
+	}
+
+	// The files that were checked out are removed.
+	if err := r.SetHead(id); err != nil {
+		t.Fatal(err)
+	}
+	if got := readWorkDir(t, dst.dir); len(got) != 0 {
+		t.Fatalf("expected no files, got %v", got)
+	}
+	if head, err := r.Head(); err != nil || head != id {
+		t.Fatalf("expected HEAD %s, got %s (%v)", id, head, err)
+	}
+
+	// A checkout of HEAD writes every file again.
+	if err := r.Checkout(id); err != nil {
+		t.Fatal(err)
+	}
+	if got := readWorkDir(t, dst.dir); !reflect.DeepEqual(got, files) {
+		t.Fatalf("expected %v, got %v", files, got)
+	}
+}
@@ -0,0 +1,207 @@
+package gitrepo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// The id of an object, which is the sha1 of its type, size and content.
+type ID [20]byte
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Is this the id of no object?
+func (id ID) IsZero() bool {
+	return id == ID{}
+}
+
+// Parse the hex form of an id.
+func ParseID(s string) (ID, error) {
+	var id ID
+	if len(s) != 2*len(id) {
+		return id, fmt.Errorf("gitrepo: invalid object id: %q", s)
+	}
+
+	if _, err := hex.Decode(id[:], []byte(s)); err != nil {
+		return id, fmt.Errorf("gitrepo: invalid object id: %q", s)
+	}
+	return id, nil
+}
+
+// The types of objects, as they are numbered in packs.
+type ObjectType int8
+
+const (
+	ObjCommit ObjectType = 1
+	ObjTree   ObjectType = 2
+	ObjBlob   ObjectType = 3
+	ObjTag    ObjectType = 4
+
+	// The types of the entries in packs that are stored as deltas against
+	// another object, given by its offset in the pack or its id.
+	objOfsDelta ObjectType = 6
+	objRefDelta ObjectType = 7
+)
+
+var objectTypeNames = map[ObjectType]string{
+	ObjCommit: "commit",
+	ObjTree:   "tree",
+	ObjBlob:   "blob",
+	ObjTag:    "tag",
+}
+
+func (t ObjectType) String() string {
+	if name, ok := objectTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("type %d", t)
+}
+
+func parseObjectType(name string) (ObjectType, error) {
+	for t, n := range objectTypeNames {
+		if n == name {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("gitrepo: unknown object type: %q", name)
+}
+
+// The id of an object with the given type and content.
+func hashObject(t ObjectType, data []byte) ID {
+	var id ID
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", t, len(data))
+	h.Write(data) //nolint
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+// Returned when a repo does not have an object, which is usually because only
+// the latest commit of a branch was fetched.
+var ErrObjectNotFound = errors.New("gitrepo: object not found")
+
+// The modes of the entries of trees.
+const (
+	ModeTree    = 0040000
+	ModeFile    = 0100644
+	ModeExec    = 0100755
+	ModeSymlink = 0120000
+
+	// A submodule, whose id is a commit of another repo.
+	ModeGitlink = 0160000
+
+	// The bits of a mode that tell the kind of an entry.
+	modeKind = 0170000
+)
+
+// An entry of a tree, which is either a file or a tree of its own.
+type TreeEntry struct {
+	Name string
+	Mode uint32
+	ID   ID
+}
+
+// Is the entry a directory?
+func (e *TreeEntry) IsTree() bool {
+	return e.Mode&modeKind == ModeTree
+}
+
+// Is the entry a file, symlink or otherwise, whose content is a blob?
+func (e *TreeEntry) IsBlob() bool {
+	return e.Mode&modeKind == ModeFile&modeKind || e.Mode&modeKind == ModeSymlink
+}
+
+// Parse the content of a tree object.
+func parseTree(data []byte) ([]TreeEntry, error) {
+	var entries []TreeEntry
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		if sp < 0 {
+			return nil, errors.New("gitrepo: invalid tree entry")
+		}
+
+		mode, err := strconv.ParseUint(string(data[:sp]), 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("gitrepo: invalid tree entry mode: %q", data[:sp])
+		}
+		data = data[sp+1:]
+
+		nul := bytes.IndexByte(data, 0)
+		if nul < 0 || len(data) < nul+1+len(ID{}) {
+			return nil, errors.New("gitrepo: invalid tree entry")
+		}
+
+		e := TreeEntry{
+			Name: string(data[:nul]),
+			Mode: uint32(mode),
+		}
+		copy(e.ID[:], data[nul+1:])
+		data = data[nul+1+len(e.ID):]
+
+		if !validName(e.Name) {
+			return nil, fmt.Errorf("gitrepo: invalid tree entry name: %q", e.Name)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Can a tree entry with the name be checked out? Names that would escape the
+// working directory or write into the repo are refused, like git does.
+func validName(name string) bool {
+	return name != "" &&
+		name != "." &&
+		name != ".." &&
+		!bytes.ContainsAny([]byte(name), "/\x00") &&
+		!bytes.EqualFold([]byte(name), []byte(".git"))
+}
+
+// The parts of a commit that are needed to check it out.
+type Commit struct {
+	Tree    ID
+	Parents []ID
+}
+
+// Parse the content of a commit object.
+func parseCommit(data []byte) (*Commit, error) {
+	c := &Commit{}
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(line) == 0 {
+			break
+		}
+
+		var err error
+		if bytes.HasPrefix(line, []byte("tree ")) {
+			c.Tree, err = ParseID(string(line[5:]))
+		} else if bytes.HasPrefix(line, []byte("parent ")) {
+			var id ID
+			id, err = ParseID(string(line[7:]))
+			c.Parents = append(c.Parents, id)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Tree.IsZero() {
+		return nil, errors.New("gitrepo: commit has no tree")
+	}
+	return c, nil
+}
+
+// Return the id of the object that a tag points to.
+func parseTagObject(data []byte) (ID, error) {
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if bytes.HasPrefix(line, []byte("object ")) {
+			return ParseID(string(line[7:]))
+		}
+	}
+	return ID{}, errors.New("gitrepo: tag has no object")
+}
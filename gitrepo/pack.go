@@ -0,0 +1,753 @@
+package gitrepo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	packMagic = []byte("PACK")
+	idxMagic  = []byte("\377tOc")
+)
+
+// The most memory that a pack uses to cache the objects that deltas are based
+// on.
+const maxCacheSize = 32 << 20
+
+// A pack of objects and its index.
+type pack struct {
+	path string
+
+	loadOnce sync.Once
+	loadErr  error
+	f        *os.File
+	size     int64
+
+	// The ids of the objects, sorted, and their offsets in the pack.
+	ids     []ID
+	offsets []int64
+
+	// Finds objects while the pack is indexed, before ids is set.
+	byID map[ID]int64
+
+	cacheLck  sync.Mutex
+	cache     map[int64]*cachedObject
+	cacheSize int
+}
+
+type cachedObject struct {
+	typ  ObjectType
+	data []byte
+}
+
+// Create a pack that is loaded once an object is read from it.
+func openPack(path string) *pack {
+	return &pack{path: path}
+}
+
+func (p *pack) load() error {
+	p.loadOnce.Do(func() {
+		p.loadErr = p.readIndex()
+	})
+	return p.loadErr
+}
+
+// Read the version 2 index of the pack.
+func (p *pack) readIndex() error {
+	idx, err := ioutil.ReadFile(strings.TrimSuffix(p.path, ".pack") + ".idx")
+	if err != nil {
+		return err
+	}
+
+	if len(idx) < 8+256*4 || !bytes.Equal(idx[:4], idxMagic) || binary.BigEndian.Uint32(idx[4:]) != 2 {
+		return fmt.Errorf("gitrepo: unsupported pack index: %s", p.path)
+	}
+
+	fanout := idx[8 : 8+256*4]
+	n := int(binary.BigEndian.Uint32(fanout[255*4:]))
+	names := 8 + 256*4
+	offsets := names + n*(len(ID{})+4)
+	large := offsets + n*4
+	if len(idx) < large+2*len(ID{}) {
+		return fmt.Errorf("gitrepo: truncated pack index: %s", p.path)
+	}
+
+	p.ids = make([]ID, n)
+	p.offsets = make([]int64, n)
+	for i := 0; i < n; i++ {
+		copy(p.ids[i][:], idx[names+i*len(ID{}):])
+
+		off := binary.BigEndian.Uint32(idx[offsets+i*4:])
+		if off&0x80000000 == 0 {
+			p.offsets[i] = int64(off)
+			continue
+		}
+
+		at := large + int(off&0x7fffffff)*8
+		if len(idx) < at+8 {
+			return fmt.Errorf("gitrepo: truncated pack index: %s", p.path)
+		}
+		p.offsets[i] = int64(binary.BigEndian.Uint64(idx[at:]))
+	}
+
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	p.f = f
+	p.size = fi.Size()
+	return nil
+}
+
+func (p *pack) close() error {
+	if p.f == nil {
+		return nil
+	}
+	return p.f.Close()
+}
+
+// Return the offset of an object in the pack.
+func (p *pack) find(id ID) (int64, bool) {
+	if p.byID != nil {
+		off, ok := p.byID[id]
+		return off, ok
+	}
+
+	i := sort.Search(len(p.ids), func(i int) bool {
+		return bytes.Compare(p.ids[i][:], id[:]) >= 0
+	})
+	if i < len(p.ids) && p.ids[i] == id {
+		return p.offsets[i], true
+	}
+	return 0, false
+}
+
+// Does the pack hold the object?
+func (p *pack) has(id ID) bool {
+	if err := p.load(); err != nil {
+		return false
+	}
+	_, ok := p.find(id)
+	return ok
+}
+
+// Read an object from the pack, or return ErrObjectNotFound.
+func (p *pack) object(id ID) (ObjectType, []byte, error) {
+	if err := p.load(); err != nil {
+		return 0, nil, err
+	}
+
+	off, ok := p.find(id)
+	if !ok {
+		return 0, nil, ErrObjectNotFound
+	}
+	return p.readAt(off, false)
+}
+
+// Read the header of a pack entry, which is its type and the size of its
+// content, or of its delta.
+func readEntryHeader(r io.ByteReader) (ObjectType, int64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	typ := ObjectType(b >> 4 & 7)
+	size := int64(b & 15)
+	for shift := uint(4); b&0x80 != 0; shift += 7 {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, 0, err
+		}
+		size |= int64(b&0x7f) << shift
+	}
+	return typ, size, nil
+}
+
+// Read how far before an entry the base of its offset delta is.
+func readDeltaOffset(r io.ByteReader) (int64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	off := int64(b & 0x7f)
+	for b&0x80 != 0 {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+		off = (off+1)<<7 | int64(b&0x7f)
+	}
+	return off, nil
+}
+
+// Read size bytes of zlib compressed data.
+func inflate(r io.Reader, size int64) ([]byte, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Read the object at an offset in the pack, applying any deltas. Objects that
+// are read as the bases of deltas are cached, since the objects that are
+// stored as deltas against them are usually read together.
+func (p *pack) readAt(off int64, isBase bool) (ObjectType, []byte, error) {
+	p.cacheLck.Lock()
+	if o, ok := p.cache[off]; ok {
+		p.cacheLck.Unlock()
+		return o.typ, o.data, nil
+	}
+	p.cacheLck.Unlock()
+
+	r := bufio.NewReader(io.NewSectionReader(p.f, off, p.size-off))
+	typ, size, err := readEntryHeader(r)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var data []byte
+	switch typ {
+	case ObjCommit, ObjTree, ObjBlob, ObjTag:
+		data, err = inflate(r, size)
+	case objOfsDelta, objRefDelta:
+		typ, data, err = p.readDelta(r, off, typ, size)
+	default:
+		err = fmt.Errorf("gitrepo: invalid pack entry type %d at %d in %s", typ, off, p.path)
+	}
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if isBase {
+		p.cacheObject(off, typ, data)
+	}
+	return typ, data, nil
+}
+
+// Read a delta entry, whose header was read from r, and apply it to its base.
+func (p *pack) readDelta(r *bufio.Reader, off int64, typ ObjectType, size int64) (ObjectType, []byte, error) {
+	var baseOff int64
+	if typ == objOfsDelta {
+		rel, err := readDeltaOffset(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		baseOff = off - rel
+		if rel <= 0 || baseOff < 0 {
+			return 0, nil, fmt.Errorf("gitrepo: invalid delta base at %d in %s", off, p.path)
+		}
+	} else {
+		var base ID
+		if _, err := io.ReadFull(r, base[:]); err != nil {
+			return 0, nil, err
+		}
+
+		var ok bool
+		if baseOff, ok = p.find(base); !ok {
+			return 0, nil, fmt.Errorf("%w: delta base %s", ErrObjectNotFound, base)
+		}
+	}
+
+	delta, err := inflate(r, size)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	baseType, base, err := p.readAt(baseOff, true)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	data, err := applyDelta(base, delta)
+	return baseType, data, err
+}
+
+func (p *pack) cacheObject(off int64, typ ObjectType, data []byte) {
+	p.cacheLck.Lock()
+	defer p.cacheLck.Unlock()
+
+	if len(data) > maxCacheSize/4 {
+		return
+	}
+
+	if p.cache == nil || p.cacheSize+len(data) > maxCacheSize {
+		p.cache = map[int64]*cachedObject{}
+		p.cacheSize = 0
+	}
+	p.cache[off] = &cachedObject{typ, data}
+	p.cacheSize += len(data)
+}
+
+// Read a size from the header of a delta.
+func readDeltaSize(delta []byte) (int, []byte, error) {
+	size := 0
+	for shift := uint(0); len(delta) > 0; shift += 7 {
+		b := delta[0]
+		delta = delta[1:]
+		size |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return size, delta, nil
+		}
+	}
+	return 0, nil, errors.New("gitrepo: truncated delta")
+}
+
+// Apply a delta, which copies ranges of the base and inserts new data.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	baseSize, delta, err := readDeltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+	if baseSize != len(base) {
+		return nil, errors.New("gitrepo: delta does not match its base")
+	}
+
+	size, delta, err := readDeltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, size)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		if op&0x80 == 0 {
+			// Insert the next op bytes of the delta.
+			if op == 0 || int(op) > len(delta) {
+				return nil, errors.New("gitrepo: invalid delta")
+			}
+			data = append(data, delta[:op]...)
+			delta = delta[op:]
+			continue
+		}
+
+		// Copy a range of the base, whose offset and size are given by
+		// the bytes that the low bits of op select.
+		var off, n int
+		for i := uint(0); i < 7; i++ {
+			if op&(1<<i) == 0 {
+				continue
+			}
+			if len(delta) == 0 {
+				return nil, errors.New("gitrepo: truncated delta")
+			}
+			if i < 4 {
+				off |= int(delta[0]) << (8 * i)
+			} else {
+				n |= int(delta[0]) << (8 * (i - 4))
+			}
+			delta = delta[1:]
+		}
+		if n == 0 {
+			n = 0x10000
+		}
+
+		if off+n > len(base) {
+			return nil, errors.New("gitrepo: delta copies past its base")
+		}
+		data = append(data, base[off:off+n]...)
+	}
+
+	if len(data) != size {
+		return nil, errors.New("gitrepo: delta has the wrong size")
+	}
+	return data, nil
+}
+
+// Counts the bytes read through it, and their crc32, so that the entries of a
+// pack can be read in sequence. zlib does not read ahead of the compressed data
+// from a reader that implements io.ByteReader.
+type countingReader struct {
+	r   *bufio.Reader
+	n   int64
+	crc hash.Hash32
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	r.crc.Write(b[:n]) //nolint
+	return n, err
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.n++
+		r.crc.Write([]byte{b}) //nolint
+	}
+	return b, err
+}
+
+// An entry of a pack that is being indexed.
+type packEntry struct {
+	off      int64
+	crc      uint32
+	id       ID
+	resolved bool
+}
+
+// Write the index of a pack next to it, and return the pack's checksum.
+func indexPack(path string) (ID, error) {
+	var sum ID
+
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return sum, err
+	}
+
+	// Check the checksum at the end of the pack first.
+	if fi.Size() < 12+int64(len(sum)) {
+		return sum, fmt.Errorf("gitrepo: truncated pack: %s", path)
+	}
+
+	h := sha1.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, fi.Size()-int64(len(sum)))); err != nil {
+		return sum, err
+	}
+
+	if _, err := f.ReadAt(sum[:], fi.Size()-int64(len(sum))); err != nil {
+		return sum, err
+	}
+
+	if !bytes.Equal(h.Sum(nil), sum[:]) {
+		return sum, fmt.Errorf("gitrepo: pack checksum mismatch: %s", path)
+	}
+
+	cr := &countingReader{
+		r:   bufio.NewReader(io.NewSectionReader(f, 0, fi.Size())),
+		crc: crc32.NewIEEE(),
+	}
+
+	var header [12]byte
+	if _, err := io.ReadFull(cr, header[:]); err != nil {
+		return sum, err
+	}
+
+	if !bytes.Equal(header[:4], packMagic) {
+		return sum, fmt.Errorf("gitrepo: not a pack: %s", path)
+	}
+
+	if v := binary.BigEndian.Uint32(header[4:]); v != 2 && v != 3 {
+		return sum, fmt.Errorf("gitrepo: unsupported pack version %d: %s", v, path)
+	}
+
+	p := &pack{
+		path: path,
+		f:    f,
+		size: fi.Size(),
+		byID: map[ID]int64{},
+	}
+
+	// Read the entries in order, hashing the objects that are not deltas.
+	n := binary.BigEndian.Uint32(header[8:])
+	entries := make([]*packEntry, n)
+	for i := range entries {
+		e := &packEntry{off: cr.n}
+		cr.crc.Reset()
+
+		typ, size, err := readEntryHeader(cr)
+		if err != nil {
+			return sum, err
+		}
+
+		switch typ {
+		case ObjCommit, ObjTree, ObjBlob, ObjTag:
+		case objOfsDelta:
+			if _, err := readDeltaOffset(cr); err != nil {
+				return sum, err
+			}
+		case objRefDelta:
+			if _, err := io.ReadFull(cr, make([]byte, len(ID{}))); err != nil {
+				return sum, err
+			}
+		default:
+			return sum, fmt.Errorf("gitrepo: invalid pack entry type %d at %d in %s", typ, e.off, path)
+		}
+
+		zr, err := zlib.NewReader(cr)
+		if err != nil {
+			return sum, err
+		}
+
+		if typ == objOfsDelta || typ == objRefDelta {
+			_, err = io.Copy(ioutil.Discard, zr)
+		} else {
+			h := sha1.New()
+			fmt.Fprintf(h, "%s %d\x00", typ, size)
+			if _, err = io.Copy(h, zr); err == nil {
+				copy(e.id[:], h.Sum(nil))
+				e.resolved = true
+				p.byID[e.id] = e.off
+			}
+		}
+		zr.Close()
+
+		if err != nil {
+			return sum, err
+		}
+
+		e.crc = cr.crc.Sum32()
+		entries[i] = e
+	}
+
+	// Resolve the deltas. Bases given by id may come after the deltas
+	// against them, so keep going while any are resolved.
+	for {
+		progress, unresolved := false, 0
+		for _, e := range entries {
+			if e.resolved {
+				continue
+			}
+
+			typ, data, err := p.readAt(e.off, false)
+			if errors.Is(err, ErrObjectNotFound) {
+				unresolved++
+				continue
+			} else if err != nil {
+				return sum, err
+			}
+
+			e.id = hashObject(typ, data)
+			e.resolved = true
+			p.byID[e.id] = e.off
+			progress = true
+		}
+
+		if unresolved == 0 {
+			break
+		} else if !progress {
+			return sum, fmt.Errorf("gitrepo: pack has deltas against missing objects: %s", path)
+		}
+	}
+
+	return sum, writeIndex(strings.TrimSuffix(path, ".pack")+".idx", entries, sum)
+}
+
+// Write a version 2 pack index.
+func writeIndex(path string, entries []*packEntry, sum ID) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].id[:], entries[j].id[:]) < 0
+	})
+
+	h := sha1.New()
+	var buf bytes.Buffer
+	w := io.MultiWriter(&buf, h)
+
+	w.Write(idxMagic)                            //nolint
+	binary.Write(w, binary.BigEndian, uint32(2)) //nolint
+
+	var fanout [256]uint32
+	for _, e := range entries {
+		fanout[e.id[0]]++
+	}
+	for i := 1; i < len(fanout); i++ {
+		fanout[i] += fanout[i-1]
+	}
+	binary.Write(w, binary.BigEndian, fanout) //nolint
+
+	for _, e := range entries {
+		w.Write(e.id[:]) //nolint
+	}
+
+	for _, e := range entries {
+		binary.Write(w, binary.BigEndian, e.crc) //nolint
+	}
+
+	var large []int64
+	for _, e := range entries {
+		off := uint32(e.off)
+		if e.off >= 0x80000000 {
+			off = 0x80000000 | uint32(len(large))
+			large = append(large, e.off)
+		}
+		binary.Write(w, binary.BigEndian, off) //nolint
+	}
+	binary.Write(w, binary.BigEndian, large) //nolint
+
+	w.Write(sum[:])       //nolint
+	buf.Write(h.Sum(nil)) //nolint
+
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// Write a file by renaming a temporary file into place, so that it is never
+// seen partially written.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// Writes objects, without deltas, to a new pack in a directory.
+type packWriter struct {
+	dir string
+	f   *os.File
+	w   *bufio.Writer
+	n   uint32
+}
+
+func newPackWriter(dir string) (*packWriter, error) {
+	f, err := ioutil.TempFile(dir, ".tmp-pack-")
+	if err != nil {
+		return nil, err
+	}
+
+	w := &packWriter{
+		dir: dir,
+		f:   f,
+		w:   bufio.NewWriter(f),
+	}
+
+	// The number of objects is filled in by finish.
+	w.w.Write(packMagic)                                 //nolint
+	binary.Write(w.w, binary.BigEndian, [2]uint32{2, 0}) //nolint
+	return w, nil
+}
+
+// Write an object to the pack.
+func (w *packWriter) add(typ ObjectType, data []byte) error {
+	size := uint64(len(data))
+	b := byte(typ)<<4 | byte(size&15)
+	for size >>= 4; size > 0; size >>= 7 {
+		w.w.WriteByte(b | 0x80) //nolint
+		b = byte(size & 0x7f)
+	}
+	w.w.WriteByte(b) //nolint
+
+	zw := zlib.NewWriter(w.w)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	w.n++
+	return nil
+}
+
+// Remove the pack that was being written.
+func (w *packWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// Finish writing the pack and index it. Returns the path of the pack.
+func (w *packWriter) finish() (string, error) {
+	if err := w.w.Flush(); err != nil {
+		w.abort()
+		return "", err
+	}
+
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], w.n)
+	if _, err := w.f.WriteAt(count[:], 8); err != nil {
+		w.abort()
+		return "", err
+	}
+
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		w.abort()
+		return "", err
+	}
+
+	h := sha1.New()
+	if _, err := io.Copy(h, w.f); err != nil {
+		w.abort()
+		return "", err
+	}
+
+	if _, err := w.f.Write(h.Sum(nil)); err != nil {
+		w.abort()
+		return "", err
+	}
+
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return "", err
+	}
+
+	return installPack(w.dir, w.f.Name())
+}
+
+// Index a pack that was written to a temporary file and move it into place
+// in a directory. Returns the path of the pack.
+func installPack(dir, tmpPath string) (string, error) {
+	tmp := tmpPath + ".pack"
+	if err := os.Rename(tmpPath, tmp); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	sum, err := indexPack(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		os.Remove(strings.TrimSuffix(tmp, ".pack") + ".idx")
+		return "", err
+	}
+
+	name := filepath.Join(dir, "pack-"+hex.EncodeToString(sum[:]))
+	if err := os.Rename(strings.TrimSuffix(tmp, ".pack")+".idx", name+".idx"); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	if err := os.Rename(tmp, name+".pack"); err != nil {
+		os.Remove(name + ".idx")
+		return "", err
+	}
+
+	return name + ".pack", nil
+}
@@ -0,0 +1,385 @@
+// Package gitrepo reads git repositories and fetches their branches without
+// the git binary. It supports the subset of git that is needed to check out the
+// latest commit of a branch: loose and packed objects and refs, shallow fetches
+// from local repos and over smart http, and checking out trees.
+package gitrepo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A repo's objects and refs. Its methods may be called concurrently.
+type Repo struct {
+	// The git directory, and the working directory or the empty string
+	// for bare repos.
+	gitDir  string
+	workDir string
+
+	lck   sync.Mutex
+	packs []*pack
+}
+
+// Open the repo at dir, which is either a working directory with a .git
+// directory or a bare repo.
+func Open(dir string) (*Repo, error) {
+	r := &Repo{gitDir: dir}
+	if fi, err := os.Stat(filepath.Join(dir, ".git")); err == nil && fi.IsDir() {
+		r.gitDir = filepath.Join(dir, ".git")
+		r.workDir = dir
+	}
+
+	if _, err := os.Stat(filepath.Join(r.gitDir, "objects")); err != nil {
+		return nil, fmt.Errorf("gitrepo: not a git repo: %s", dir)
+	}
+
+	if err := r.loadPacks(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Create an empty repo with a working directory at dir, whose origin remote
+// is url.
+func Init(dir, url string) error {
+	gitDir := filepath.Join(dir, ".git")
+	for _, d := range []string{"objects/pack", "refs/heads", "refs/remotes"} {
+		if err := os.MkdirAll(filepath.Join(gitDir, filepath.FromSlash(d)), os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	config := fmt.Sprintf(
+		"[core]\n\trepositoryformatversion = 0\n\tbare = false\n"+
+			"[remote \"origin\"]\n\turl = %s\n\tfetch = +refs/heads/*:refs/remotes/origin/*\n",
+		url)
+	if err := ioutil.WriteFile(filepath.Join(gitDir, "config"), []byte(config), 0644); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(gitDir, "HEAD"), []byte("ref: refs/heads/master\n"), 0644)
+}
+
+// Close the packs of the repo.
+func (r *Repo) Close() error {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	var firstErr error
+	for _, p := range r.packs {
+		if err := p.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	r.packs = nil
+	return firstErr
+}
+
+func (r *Repo) packDir() string {
+	return filepath.Join(r.gitDir, "objects", "pack")
+}
+
+// Find the packs of the repo, keeping those that were already open.
+func (r *Repo) loadPacks() error {
+	names, err := filepath.Glob(filepath.Join(r.packDir(), "pack-*.pack"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	open := map[string]*pack{}
+	for _, p := range r.packs {
+		open[p.path] = p
+	}
+
+	var packs []*pack
+	for _, name := range names {
+		if p, ok := open[name]; ok {
+			packs = append(packs, p)
+			delete(open, name)
+		} else {
+			packs = append(packs, openPack(name))
+		}
+	}
+
+	for _, p := range open {
+		p.close() //nolint
+	}
+
+	r.packs = packs
+	return nil
+}
+
+func (r *Repo) currentPacks() []*pack {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	return r.packs
+}
+
+// Read an object, returning ErrObjectNotFound if the repo does not have it.
+// The returned data must not be modified.
+func (r *Repo) Object(id ID) (ObjectType, []byte, error) {
+	for _, p := range r.currentPacks() {
+		typ, data, err := p.object(id)
+		if err == nil {
+			return typ, data, nil
+		} else if !errors.Is(err, ErrObjectNotFound) {
+			return 0, nil, err
+		}
+	}
+
+	return r.looseObject(id)
+}
+
+// Does the repo have the object?
+func (r *Repo) HasObject(id ID) bool {
+	for _, p := range r.currentPacks() {
+		if p.has(id) {
+			return true
+		}
+	}
+
+	_, err := os.Stat(r.loosePath(id))
+	return err == nil
+}
+
+func (r *Repo) loosePath(id ID) string {
+	s := id.String()
+	return filepath.Join(r.gitDir, "objects", s[:2], s[2:])
+}
+
+func (r *Repo) looseObject(id ID) (ObjectType, []byte, error) {
+	raw, err := ioutil.ReadFile(r.loosePath(id))
+	if os.IsNotExist(err) {
+		return 0, nil, fmt.Errorf("%w: %s", ErrObjectNotFound, id)
+	} else if err != nil {
+		return 0, nil, err
+	}
+
+	// The size is unknown until the header is read, so inflate it all.
+	data, err := inflateAll(raw)
+	if err != nil {
+		return 0, nil, fmt.Errorf("gitrepo: invalid loose object %s: %w", id, err)
+	}
+
+	nul := bytes.IndexByte(data, 0)
+	sp := bytes.IndexByte(data, ' ')
+	if nul < 0 || sp < 0 || sp > nul {
+		return 0, nil, fmt.Errorf("gitrepo: invalid loose object %s", id)
+	}
+
+	typ, err := parseObjectType(string(data[:sp]))
+	if err != nil {
+		return 0, nil, err
+	}
+	return typ, data[nul+1:], nil
+}
+
+func inflateAll(raw []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// Read an object of the given type, peeling tags when a commit is wanted.
+func (r *Repo) objectOfType(id ID, want ObjectType) ([]byte, error) {
+	for i := 0; i < 10; i++ {
+		typ, data, err := r.Object(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if typ == want {
+			return data, nil
+		} else if typ != ObjTag || want != ObjCommit {
+			return nil, fmt.Errorf("gitrepo: %s is a %s, not a %s", id, typ, want)
+		}
+
+		if id, err = parseTagObject(data); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("gitrepo: too many nested tags at %s", id)
+}
+
+// Read a commit, or the commit that a tag points to.
+func (r *Repo) Commit(id ID) (*Commit, error) {
+	data, err := r.objectOfType(id, ObjCommit)
+	if err != nil {
+		return nil, err
+	}
+	return parseCommit(data)
+}
+
+// Read the entries of a tree.
+func (r *Repo) Tree(id ID) ([]TreeEntry, error) {
+	data, err := r.objectOfType(id, ObjTree)
+	if err != nil {
+		return nil, err
+	}
+	return parseTree(data)
+}
+
+// Read the content of a file. The returned data must not be modified.
+func (r *Repo) Blob(id ID) ([]byte, error) {
+	return r.objectOfType(id, ObjBlob)
+}
+
+// Return the url of the origin remote, as it is set in the repo's config.
+func (r *Repo) RemoteURL() (string, error) {
+	f, err := os.Open(filepath.Join(r.gitDir, "config"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	inOrigin := false
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "[") {
+			inOrigin = line == `[remote "origin"]`
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if inOrigin && len(kv) == 2 && strings.TrimSpace(kv[0]) == "url" {
+			return strings.TrimSpace(kv[1]), nil
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("gitrepo: origin remote has no url")
+}
+
+// Resolve a ref, such as HEAD or refs/heads/main, to an id, following
+// symbolic refs.
+func (r *Repo) Ref(name string) (ID, error) {
+	for i := 0; i < 10; i++ {
+		target, id, err := r.readRef(name)
+		if err != nil {
+			return ID{}, err
+		} else if target == "" {
+			return id, nil
+		}
+		name = target
+	}
+	return ID{}, fmt.Errorf("gitrepo: too many symbolic refs at %s", name)
+}
+
+// Return the ref that a symbolic ref, such as HEAD, points to.
+func (r *Repo) SymbolicRef(name string) (string, error) {
+	target, _, err := r.readRef(name)
+	if err != nil {
+		return "", err
+	} else if target == "" {
+		return "", fmt.Errorf("gitrepo: %s is not a symbolic ref", name)
+	}
+	return target, nil
+}
+
+// Read a ref, returning either the ref it points to or its id.
+func (r *Repo) readRef(name string) (string, ID, error) {
+	if strings.Contains(name, "..") {
+		return "", ID{}, fmt.Errorf("gitrepo: invalid ref: %q", name)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(r.gitDir, filepath.FromSlash(name)))
+	if err == nil {
+		line := strings.TrimSpace(string(data))
+		if strings.HasPrefix(line, "ref: ") {
+			return strings.TrimPrefix(line, "ref: "), ID{}, nil
+		}
+		id, err := ParseID(line)
+		return "", id, err
+	} else if !os.IsNotExist(err) {
+		return "", ID{}, err
+	}
+
+	id, err := r.packedRef(name)
+	return "", id, err
+}
+
+// Find a ref in the packed-refs file.
+func (r *Repo) packedRef(name string) (ID, error) {
+	f, err := os.Open(filepath.Join(r.gitDir, "packed-refs"))
+	if os.IsNotExist(err) {
+		return ID{}, fmt.Errorf("gitrepo: no such ref: %s", name)
+	} else if err != nil {
+		return ID{}, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && fields[1] == name {
+			return ParseID(fields[0])
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return ID{}, err
+	}
+	return ID{}, fmt.Errorf("gitrepo: no such ref: %s", name)
+}
+
+// Point a ref at an id.
+func (r *Repo) SetRef(name string, id ID) error {
+	path := filepath.Join(r.gitDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, []byte(id.String()+"\n"))
+}
+
+// Return the commit that is checked out.
+func (r *Repo) Head() (ID, error) {
+	return r.Ref("HEAD")
+}
+
+// Remove the packs that hold none of the given commits. Packs are written with
+// every object of the commits they were fetched for, so removing the others
+// keeps the objects of the commits that are still needed.
+func (r *Repo) Prune(keep ...ID) error {
+	for _, p := range r.currentPacks() {
+		needed := false
+		for _, id := range keep {
+			if p.has(id) {
+				needed = true
+				break
+			}
+		}
+
+		if needed {
+			continue
+		}
+
+		p.close() //nolint
+		if err := os.Remove(p.path); err != nil {
+			return err
+		}
+		if err := os.Remove(strings.TrimSuffix(p.path, ".pack") + ".idx"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return r.loadPacks()
+}
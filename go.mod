@@ -2,7 +2,4 @@ module github.com/hound-search/hound
 
 go 1.16
 
-require (
-	github.com/blang/semver/v4 v4.0.0
-	golang.org/x/mod v0.10.0
-)
+require github.com/blang/semver/v4 v4.0.0
@@ -0,0 +1,211 @@
+// Package ignore matches paths against the patterns of ignore files, like
+// .gitignore, which are read from every directory of a tree, and against the
+// include and exclude globs of a repo.
+package ignore
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A pattern from an ignore file, in gitignore syntax.
+type pattern struct {
+	// The directory of the ignore file, relative to the root of the tree
+	// and slash separated, which the pattern is relative to.
+	base string
+
+	// The globs of each path segment, where ** matches any number of
+	// segments.
+	glob []string
+
+	// Does the pattern re-include paths that an earlier pattern ignored?
+	negate bool
+
+	// Does the pattern only match directories?
+	dirOnly bool
+}
+
+// A Matcher holds the patterns of the ignore files of a tree. The ignore files
+// of a directory are loaded before the paths in it are matched, and the
+// patterns of deeper directories take precedence, as do the patterns of later
+// ignore files in the same directory.
+type Matcher struct {
+	names    []string
+	loaded   map[string]bool
+	patterns []*pattern
+}
+
+// Create a Matcher that reads the ignore files with the given names, in
+// increasing order of precedence.
+func New(names ...string) *Matcher {
+	return &Matcher{
+		names:  names,
+		loaded: map[string]bool{},
+	}
+}
+
+// Parse a line of an ignore file in dir, returning nil if it is blank or a
+// comment.
+func parsePattern(dir, line string) *pattern {
+	line = strings.TrimSuffix(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+
+	if line == "" || line[0] == '#' {
+		return nil
+	}
+
+	p := &pattern{base: dir}
+	if line[0] == '!' {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if line == "" {
+		return nil
+	}
+
+	// A pattern without a slash matches a name at any depth, otherwise it
+	// is relative to the directory of the ignore file.
+	if strings.Contains(line, "/") {
+		p.glob = strings.Split(strings.TrimPrefix(line, "/"), "/")
+	} else {
+		p.glob = []string{"**", line}
+	}
+
+	return p
+}
+
+// Do the path segments match the globs? A trailing ** only matches paths
+// within a directory, not the directory itself.
+func matchSegments(glob, parts []string) bool {
+	if len(glob) == 0 {
+		return len(parts) == 0
+	}
+
+	if glob[0] == "**" {
+		if len(glob) == 1 {
+			return len(parts) > 0
+		}
+
+		for i := 0; i <= len(parts); i++ {
+			if matchSegments(glob[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(parts) == 0 {
+		return false
+	}
+
+	ok, err := path.Match(glob[0], parts[0])
+	return err == nil && ok && matchSegments(glob[1:], parts[1:])
+}
+
+func (p *pattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+
+	if p.base != "" {
+		if !strings.HasPrefix(rel, p.base+"/") {
+			return false
+		}
+		rel = rel[len(p.base)+1:]
+	}
+
+	return matchSegments(p.glob, strings.Split(rel, "/"))
+}
+
+// Read the ignore files in dir, which is relative to root, unless they were
+// read before.
+func (m *Matcher) Load(root, dir string) error {
+	dir = filepath.ToSlash(dir)
+	if dir == "." {
+		dir = ""
+	}
+
+	if m.loaded[dir] {
+		return nil
+	}
+	m.loaded[dir] = true
+
+	for _, name := range m.names {
+		r, err := os.Open(filepath.Join(root, filepath.FromSlash(dir), name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		err = m.Add(dir, r)
+		r.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add the patterns of an ignore file in dir, which is relative to the root and
+// slash separated. The patterns take precedence over those added before.
+func (m *Matcher) Add(dir string, r io.Reader) error {
+	if dir == "." {
+		dir = ""
+	}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if p := parsePattern(dir, s.Text()); p != nil {
+			m.patterns = append(m.patterns, p)
+		}
+	}
+	return s.Err()
+}
+
+// Is the path, which is relative to the root, ignored by the patterns loaded
+// so far? The directories that contain the path are not matched, so a path in
+// an ignored directory is only ignored if a pattern matches it as well.
+func (m *Matcher) Match(rel string, isDir bool) bool {
+	rel = filepath.ToSlash(rel)
+	for i := len(m.patterns) - 1; i >= 0; i-- {
+		if p := m.patterns[i]; p.match(rel, isDir) {
+			return !p.negate
+		}
+	}
+	return false
+}
+
+// Return the outermost directory of the path, or the path itself, that is
+// ignored, or the empty string if it is not ignored. The ignore files of the
+// directories that contain the path are loaded as needed.
+func (m *Matcher) Ignored(root, rel string, isDir bool) (string, error) {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := range parts {
+		if err := m.Load(root, path.Join(parts[:i]...)); err != nil {
+			return "", err
+		}
+
+		p := path.Join(parts[:i+1]...)
+		if m.Match(p, isDir || i < len(parts)-1) {
+			return filepath.FromSlash(p), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,106 @@
+package ignore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	m := New()
+	for _, line := range []string{
+		"# a comment",
+		"",
+		"*.log",
+		"!keep.log",
+		"build/",
+		"/dist",
+		"docs/**/*.pdf",
+		"vendor/**",
+		"\\#hash",
+	} {
+		if p := parsePattern("", line); p != nil {
+			m.patterns = append(m.patterns, p)
+		}
+	}
+
+	for _, test := range []struct {
+		rel      string
+		isDir    bool
+		expected bool
+	}{
+		{"app.log", false, true},
+		{"a/b/app.log", false, true},
+		{"a/keep.log", false, false},
+		{"build", true, true},
+		{"src/build", true, true},
+		{"build", false, false},
+		{"dist", true, true},
+		{"src/dist", true, false},
+		{"docs/a.pdf", false, true},
+		{"docs/a/b/c.pdf", false, true},
+		{"docs/a.txt", false, false},
+		{"vendor", true, false},
+		{"vendor/a/b.go", false, true},
+		{"#hash", false, true},
+		{"main.go", false, false},
+	} {
+		if got := m.Match(test.rel, test.isDir); got != test.expected {
+			t.Errorf("expected match of %s to be %t, got %t", test.rel, test.expected, got)
+		}
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		".gitignore":          "*.tmp\nout/\n",
+		".houndignore":        "!important.tmp\n",
+		"sub/.houndignore":    "/gen\n!out/\n",
+		"sub/gen/a.go":        "",
+		"sub/out/b.go":        "",
+		"out/c.go":            "",
+		"a.tmp":               "",
+		"important.tmp":       "",
+		"other/gen/d.go":      "",
+		"other/important.tmp": "",
+	})
+
+	m := New(".gitignore", ".houndignore")
+	for rel, expected := range map[string]string{
+		"sub/gen/a.go":        "sub/gen",
+		"sub/out/b.go":        "",
+		"out/c.go":            "out",
+		"a.tmp":               "a.tmp",
+		"important.tmp":       "",
+		"other/gen/d.go":      "",
+		"other/important.tmp": "",
+	} {
+		got, err := m.Ignored(dir, rel, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != filepath.FromSlash(expected) {
+			t.Errorf("expected %s to be ignored as %q, got %q", rel, expected, got)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package ignore
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The include and exclude globs of a repo, which limit the paths in it that are
+// indexed. Globs are relative to the root of the repo, a ** segment matches any
+// number of directories and a glob that matches a directory matches everything
+// in it.
+type Paths struct {
+	Include []string
+	Exclude []string
+}
+
+// Split a glob, which is relative to the root of the repo, into the globs of
+// each path segment.
+func splitGlob(glob string) []string {
+	return strings.Split(strings.Trim(glob, "/"), "/")
+}
+
+// Does the path match the glob, or is it within a directory that does? A **
+// segment matches any number of directories.
+func matchGlob(glob, parts []string) bool {
+	if len(glob) == 0 {
+		return true
+	}
+
+	if glob[0] == "**" {
+		return matchGlob(glob[1:], parts) ||
+			(len(parts) > 0 && matchGlob(glob, parts[1:]))
+	}
+
+	if len(parts) == 0 {
+		return false
+	}
+
+	ok, err := path.Match(glob[0], parts[0])
+	return err == nil && ok && matchGlob(glob[1:], parts[1:])
+}
+
+// Could the directory contain paths that match the glob?
+func mayContain(glob, dir []string) bool {
+	if len(dir) == 0 || len(glob) == 0 || glob[0] == "**" {
+		return true
+	}
+
+	ok, err := path.Match(glob[0], dir[0])
+	return err == nil && ok && mayContain(glob[1:], dir[1:])
+}
+
+// Is the path, which is relative to the root of the repo, left out by the
+// include and exclude paths? Directories that may contain included paths are
+// not, so that they are walked. Exclude paths take precedence over include
+// paths.
+func (p *Paths) Excludes(rel string, isDir bool) bool {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for _, glob := range p.Exclude {
+		if matchGlob(splitGlob(glob), parts) {
+			return true
+		}
+	}
+
+	if len(p.Include) == 0 {
+		return false
+	}
+
+	for _, glob := range p.Include {
+		g := splitGlob(glob)
+		if matchGlob(g, parts) || (isDir && mayContain(g, parts)) {
+			return false
+		}
+	}
+	return true
+}
@@ -3,6 +3,7 @@ package index
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"io"
 	"os"
 
@@ -45,23 +46,6 @@ func (g *grepper) grepFile(filename string, re *regexp.Regexp,  //nolint
 	return g.grep(c, re, fn)
 }
 
-func (g *grepper) grep2File(filename string, re *regexp.Regexp, nctx int,
-	fn func(line []byte, lineno int, before [][]byte, after [][]byte) (bool, error)) error {
-	r, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	defer r.Close()
-
-	c, err := gzip.NewReader(r)
-	if err != nil {
-		return err
-	}
-	defer c.Close()
-
-	return g.grep2(c, re, nctx, fn)
-}
-
 func (g *grepper) fillFrom(r io.Reader) ([]byte, error) {
 	if g.buf == nil {
 		g.buf = make([]byte, 1<<20)
@@ -132,6 +116,7 @@ func firstNLines(buf []byte, n int) [][]byte {
 // in memory to do the grep. Fortunately, we limit the size of files that get indexed anyway. 10M files tend
 // to not be source code.
 func (g *grepper) grep2(
+	ctx context.Context,
 	r io.Reader,
 	re *regexp.Regexp,
 	nctx int,
@@ -148,6 +133,11 @@ func (g *grepper) grep2(
 			return nil
 		}
 
+		// give up on the file if the search has been cancelled.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		m := re.Match(buf, true, true)
 		if m < 0 {
 			return nil
@@ -247,6 +237,4 @@ func (g *grepper) grep(r io.Reader, re *regexp.Regexp, fn func(line []byte, line
 			return nil
 		}
 	}
-
-	return nil  //nolint
 }
@@ -2,6 +2,7 @@ package index
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"strings"
 	"testing"
@@ -183,7 +184,7 @@ func assertGrepTest(t *testing.T, buf []byte, exp string, expects []*match) {
 
 	var g grepper
 	var m []*match
-	if err := g.grep2(bytes.NewBuffer(buf), re, 0,
+	if err := g.grep2(context.Background(), bytes.NewBuffer(buf), re, 0,
 		func(line []byte, lineno int, before [][]byte, after [][]byte) (bool, error) {
 			m = append(m, aMatch(string(line), lineno))
 			return true, nil
@@ -237,7 +238,7 @@ func assertContextTest(t *testing.T, buf []byte, exp string, ctx int, expectsBef
 	var gotBefore [][][]byte
 	var gotAfter [][][]byte
 	var g grepper
-	if err := g.grep2(bytes.NewBuffer(buf), re, ctx,
+	if err := g.grep2(context.Background(), bytes.NewBuffer(buf), re, ctx,
 		func(line []byte, lineno int, before [][]byte, after [][]byte) (bool, error) {
 			gotBefore = append(gotBefore, before)
 			gotAfter = append(gotAfter, after)
@@ -1,42 +1,78 @@
 package index
 
 import (
-	"compress/gzip"
+	"context"
 	"encoding/gob"
 	"encoding/json"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 	"unicode/utf8"
 
 	"github.com/hound-search/hound/codesearch/index"
 	"github.com/hound-search/hound/codesearch/regexp"
+	"github.com/hound-search/hound/ignore"
 )
 
 const (
 	manifestFilename         = "metadata.gob"
 	excludedFileJsonFilename = "excluded_files.json"
 	filePeekSize             = 2048
+
+	// Git LFS pointers are small text files that start with the spec version.
+	lfsPointerMaxSize = 1024
+	lfsPointerPrefix  = "version https://git-lfs.github.com/spec/"
 )
 
 const (
 	reasonDotFile     = "Dot files are excluded."
 	reasonInvalidMode = "Invalid file mode."
 	reasonNotText     = "Not a text file."
+	reasonLfsPointer  = "Git LFS pointer, the file's content was not fetched."
+
+	reasonPathExcluded = "path excluded by config"
+	reasonIgnored      = "Matches a pattern in an ignore file."
 )
 
 type Index struct {
 	Ref *IndexRef
 	idx *index.Index
 	lck sync.RWMutex
+
+	// Where the contents of files are read from when they are searched.
+	store storeReader
 }
 
 type IndexOptions struct {
 	ExcludeDotFiles    bool
 	SpecialFiles       []string
 	AutoGeneratedFiles []string
+
+	// Globs of the paths to index, or every path if there are none, and of
+	// the paths not to index, relative to the root of the source tree.
+	IncludePaths []string
+	ExcludePaths []string
+
+	// The files of the repo that the vcs did not check out because of the
+	// include and exclude paths.
+	SparseFiles []string
+
+	// The names of the ignore files, like .houndignore, whose patterns are
+	// not indexed, in increasing order of precedence.
+	IgnoreFiles []string
+
+	// The files of the revision to index instead of the files of the source
+	// directory, see Tree.
+	Tree Tree
+
+	// The store to keep the contents of files in, config.StoreFiles if
+	// empty, and the compression of its blocks for config.StorePacked. Indexes that are built
+	// from a tree read contents from the tree instead.
+	Store       string
+	Compression string
 }
 
 type SearchOptions struct {
@@ -63,6 +99,10 @@ type SearchResponse struct {
 	FilesOpened    int           `json:"-"`
 	Duration       time.Duration `json:"-"`
 	Revision       string
+
+	// Set when the search was cancelled or ran out of time before all files
+	// were searched, meaning the matches are incomplete.
+	Truncated bool
 }
 
 type FileMatch struct {
@@ -82,6 +122,17 @@ type IndexRef struct {
 	Time               time.Time
 	dir                string
 	AutoGeneratedFiles []string
+
+	// The include and exclude paths the index was built with.
+	IncludePaths []string
+	ExcludePaths []string
+
+	// Was the index built from a Tree, which it must be opened with?
+	FromTree bool
+
+	// The store and compression the index was built with, see IndexOptions.
+	Store       string
+	Compression string
 }
 
 func (r *IndexRef) Dir() string {
@@ -99,9 +150,25 @@ func (r *IndexRef) writeManifest() error {
 }
 
 func (r *IndexRef) Open() (*Index, error) {
+	return r.OpenTree(nil)
+}
+
+// Open an index that was built from a tree, which the contents of files are
+// read from when searching. The index closes the tree when it is closed.
+func (r *IndexRef) OpenTree(tree Tree) (*Index, error) {
+	if r.FromTree != (tree != nil) {
+		return nil, errSourceChanged
+	}
+
+	store, err := openStore(r, tree)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Index{
-		Ref: r,
-		idx: index.Open(filepath.Join(r.dir, "tri")),
+		Ref:   r,
+		idx:   index.Open(filepath.Join(r.dir, "tri")),
+		store: store,
 	}, nil
 }
 
@@ -112,13 +179,21 @@ func (r *IndexRef) Remove() error {
 func (n *Index) Close() error {
 	n.lck.Lock()
 	defer n.lck.Unlock()
-	return n.idx.Close()
+	return n.close()
+}
+
+func (n *Index) close() error {
+	if err := n.idx.Close(); err != nil {
+		return err
+	}
+
+	return n.store.close()
 }
 
 func (n *Index) Destroy() error {
 	n.lck.Lock()
 	defer n.lck.Unlock()
-	if err := n.idx.Close(); err != nil {
+	if err := n.close(); err != nil {
 		return err
 	}
 	return n.Ref.Remove()
@@ -128,6 +203,30 @@ func (n *Index) GetDir() string {
 	return n.Ref.dir
 }
 
+// The number of files in the index.
+func (n *Index) NumFiles() int {
+	n.lck.RLock()
+	defer n.lck.RUnlock()
+	return n.idx.NumNames()
+}
+
+// The number of bytes the index takes up on disk, including the store of the
+// contents of the files.
+func (n *Index) Size() (int64, error) {
+	var size int64
+	err := filepath.Walk(n.Ref.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
 func toStrings(lines [][]byte) []string {
 	strs := make([]string, len(lines))
 	for i, n := 0, len(lines); i < n; i++ {
@@ -143,7 +242,10 @@ func GetRegexpPattern(pat string, ignoreCase bool) string {
 	return "(?m)" + pat
 }
 
-func (n *Index) Search(pat string, opt *SearchOptions) (*SearchResponse, error) {
+// Search the index for the given pattern. If ctx is cancelled or its deadline
+// expires before the search completes, the matches found so far are returned
+// and the response is marked as truncated.
+func (n *Index) Search(ctx context.Context, pat string, opt *SearchOptions) (*SearchResponse, error) {
 	startedAt := time.Now()
 
 	n.lck.RLock()
@@ -166,6 +268,7 @@ func (n *Index) Search(pat string, opt *SearchOptions) (*SearchResponse, error)
 		filesFound       int
 		filesCollected   int
 		matchesCollected int
+		truncated        bool
 	)
 
 	var fre *regexp.Regexp
@@ -205,8 +308,13 @@ func (n *Index) Search(pat string, opt *SearchOptions) (*SearchResponse, error)
 			continue
 		}
 
+		if ctx.Err() != nil {
+			truncated = true
+			break
+		}
+
 		filesOpened++
-		if err := g.grep2File(filepath.Join(n.Ref.dir, "raw", name), re, int(opt.LinesOfContext),
+		if err := n.grepFile(ctx, &g, name, re, int(opt.LinesOfContext),
 			func(line []byte, lineno int, before [][]byte, after [][]byte) (bool, error) {
 
 				hasMatch = true
@@ -227,7 +335,11 @@ func (n *Index) Search(pat string, opt *SearchOptions) (*SearchResponse, error)
 				}
 
 				return true, nil
-			}); err != nil {
+			}); err != nil && err == ctx.Err() {
+			// the search was cancelled part way through this file, but
+			// any matches already found in it are still reported.
+			truncated = true
+		} else if err != nil {
 			return nil, err
 		}
 
@@ -253,9 +365,22 @@ func (n *Index) Search(pat string, opt *SearchOptions) (*SearchResponse, error)
 		FilesOpened:    filesOpened,
 		Duration:       time.Now().Sub(startedAt), //nolint
 		Revision:       n.Ref.Rev,
+		Truncated:      truncated,
 	}, nil
 }
 
+// Grep a file of the index, reading its content from the store.
+func (n *Index) grepFile(ctx context.Context, g *grepper, name string, re *regexp.Regexp, nctx int,
+	fn func(line []byte, lineno int, before [][]byte, after [][]byte) (bool, error)) error {
+	r, err := n.store.open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return g.grep2(ctx, r, re, nctx, fn)
+}
+
 func isTextFile(filename string) (bool, error) {
 	buf := make([]byte, filePeekSize)
 	r, err := os.Open(filename)
@@ -269,16 +394,18 @@ func isTextFile(filename string) (bool, error) {
 		return false, err
 	}
 
-	buf = buf[:n]
+	return isText(buf[:n]), nil
+}
 
-	if n < filePeekSize {
+// Is the start of a file, up to filePeekSize bytes of it, valid UTF8?
+func isText(buf []byte) bool {
+	if len(buf) < filePeekSize {
 		// read the whole file, must be valid.
-		return utf8.Valid(buf), nil
+		return utf8.Valid(buf)
 	}
 
 	// read a prefix, allow trailing partial runes.
-	return validUTF8IgnoringPartialTrailingRune(buf), nil
-
+	return validUTF8IgnoringPartialTrailingRune(buf)
 }
 
 // Determines if the buffer contains valid UTF8 encoded string data. The buffer is assumed
@@ -307,7 +434,7 @@ func validUTF8IgnoringPartialTrailingRune(p []byte) bool {
 	return true
 }
 
-func addFileToIndex(ix *index.IndexWriter, dst, src, path string) (string, error) {
+func addFileToIndex(ix *index.IndexWriter, store storeWriter, src, path string) (string, error) {
 	rel, err := filepath.Rel(src, path)
 	if err != nil {
 		return "", err
@@ -319,31 +446,7 @@ func addFileToIndex(ix *index.IndexWriter, dst, src, path string) (string, error
 	}
 	defer r.Close()
 
-	dup := filepath.Join(dst, "raw", rel)
-	w, err := os.Create(dup)
-	if err != nil {
-		return "", err
-	}
-	defer w.Close()
-
-	g := gzip.NewWriter(w)
-	defer g.Close()
-
-	return ix.Add(rel, io.TeeReader(r, g)), nil
-}
-
-func addDirToIndex(dst, src, path string) error {
-	rel, err := filepath.Rel(src, path)
-	if err != nil {
-		return err
-	}
-
-	if rel == "." {
-		return nil
-	}
-
-	dup := filepath.Join(dst, "raw", rel)
-	return os.Mkdir(dup, os.ModePerm)
+	return store.add(ix, rel, r)
 }
 
 // write the list of excluded files to the given filename.
@@ -366,7 +469,63 @@ func containsString(haystack []string, needle string) bool {
 	return false
 }
 
+// Determine whether a regular file should be excluded from the index based on its
+// mode and contents. The returned reason is empty if the file should be indexed.
+func checkFile(path string, info os.FileInfo) (string, error) {
+	if info.Mode()&os.ModeType != 0 {
+		return reasonInvalidMode, nil
+	}
+
+	txt, err := isTextFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	if !txt {
+		return reasonNotText, nil
+	}
+
+	if info.Size() < lfsPointerMaxSize {
+		ptr, err := isLfsPointer(path)
+		if err != nil {
+			return "", err
+		}
+
+		if ptr {
+			return reasonLfsPointer, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Is the file a Git LFS pointer that stands in for content that was not
+// fetched?
+func isLfsPointer(filename string) (bool, error) {
+	buf := make([]byte, len(lfsPointerPrefix))
+	r, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return string(buf) == lfsPointerPrefix, nil
+}
+
 func indexAllFiles(opt *IndexOptions, dst, src string) error {
+	store, err := newStoreWriter(opt, dst)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
 	ix := index.Create(filepath.Join(dst, "tri"))
 	defer ix.Close()
 
@@ -386,6 +545,13 @@ func indexAllFiles(opt *IndexOptions, dst, src string) error {
 		}
 	}
 
+	// Files are collected during the walk and added afterwards in sorted order
+	// so that the names in the trigram index are ordered, which is what allows
+	// the index to later be merged with an incremental update.
+	var files []string
+
+	ignored := ignore.New(opt.IgnoreFiles...)
+
 	if err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error { //nolint
 		name := info.Name()
 		rel, err := filepath.Rel(src, path) //nolint
@@ -414,41 +580,59 @@ func indexAllFiles(opt *IndexOptions, dst, src string) error {
 			return nil
 		}
 
-		if info.IsDir() {
-			return addDirToIndex(dst, src, path)
+		if rel != "." && opt.excludesPath(rel, info.IsDir()) {
+			excluded = append(excluded, &ExcludedFile{rel, reasonPathExcluded})
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
 
-		if info.Mode()&os.ModeType != 0 {
-			excluded = append(excluded, &ExcludedFile{
-				rel,
-				reasonInvalidMode,
-			})
+		if rel != "." && ignored.Match(rel, info.IsDir()) {
+			excluded = append(excluded, &ExcludedFile{rel, reasonIgnored})
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			if err := ignored.Load(src, rel); err != nil {
+				return err
+			}
 			return nil
 		}
 
-		txt, err := isTextFile(path)
+		reason, err := checkFile(path, info)
 		if err != nil {
 			return err
 		}
 
-		if !txt {
-			excluded = append(excluded, &ExcludedFile{
-				rel,
-				reasonNotText,
-			})
+		if reason != "" {
+			excluded = append(excluded, &ExcludedFile{rel, reason})
 			return nil
 		}
 
-		reasonForExclusion, err := addFileToIndex(ix, dst, src, path)
+		files = append(files, rel)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	excluded = addExcludedPaths(opt, excluded, opt.SparseFiles)
+
+	sort.Strings(files)
+	for _, rel := range files {
+		reasonForExclusion, err := addFileToIndex(ix, store, src, filepath.Join(src, rel))
 		if err != nil {
 			return err
 		}
 		if reasonForExclusion != "" {
 			excluded = append(excluded, &ExcludedFile{rel, reasonForExclusion})
 		}
+	}
 
-		return nil
-	}); err != nil {
+	if err := store.close(); err != nil {
 		return err
 	}
 
@@ -492,11 +676,11 @@ func Build(opt *IndexOptions, dst, src, url, rev string) (*IndexRef, error) {
 		}
 	}
 
-	if err := os.Mkdir(filepath.Join(dst, "raw"), os.ModePerm); err != nil {
-		return nil, err
-	}
-
-	if err := indexAllFiles(opt, dst, src); err != nil {
+	if opt.Tree != nil {
+		if err := indexTreeFiles(opt, dst); err != nil {
+			return nil, err
+		}
+	} else if err := indexAllFiles(opt, dst, src); err != nil {
 		return nil, err
 	}
 
@@ -506,6 +690,11 @@ func Build(opt *IndexOptions, dst, src, url, rev string) (*IndexRef, error) {
 		Time:               time.Now(),
 		dir:                dst,
 		AutoGeneratedFiles: opt.AutoGeneratedFiles,
+		IncludePaths:       opt.IncludePaths,
+		ExcludePaths:       opt.ExcludePaths,
+		FromTree:           opt.Tree != nil,
+		Store:              opt.Store,
+		Compression:        opt.Compression,
 	}
 
 	if err := r.writeManifest(); err != nil {
@@ -2,6 +2,7 @@ package index
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -56,7 +57,7 @@ func TestSearch(t *testing.T) {
 	defer idx.Close()
 
 	// Make sure we can carry out a search
-	if _, err := idx.Search("5a1c0dac2d9b3ea4085b30dd14375c18eab993d5", &SearchOptions{}); err != nil {
+	if _, err := idx.Search(context.Background(), "5a1c0dac2d9b3ea4085b30dd14375c18eab993d5", &SearchOptions{}); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -79,7 +80,7 @@ func TestSearchWithLimits(t *testing.T) {
 	// Make sure we can carry out a search within result limits
 	expectedMatches := 100
 	var debugBuf bytes.Buffer
-	if results, err := idx.Search("8365a", &SearchOptions{MaxResults: 100}); err != nil {
+	if results, err := idx.Search(context.Background(), "8365a", &SearchOptions{MaxResults: 100}); err != nil {
 		t.Fatal(err)
 	} else {
 		totalMatches := 0
@@ -96,6 +97,37 @@ func TestSearchWithLimits(t *testing.T) {
 	}
 }
 
+func TestSearchCancelled(t *testing.T) {
+	ref, err := buildIndex(url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	res, err := idx.Search(ctx, "8365a", &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.Truncated {
+		t.Fatal("expected a cancelled search to be truncated")
+	}
+
+	if len(res.Matches) != 0 || res.FilesOpened != 0 {
+		t.Fatalf("expected no files to be searched, got %d matches in %d files",
+			len(res.Matches), res.FilesOpened)
+	}
+}
+
 func TestRemove(t *testing.T) {
 	ref, err := buildIndex(url, rev)
 	if err != nil {
@@ -137,3 +169,372 @@ func TestRead(t *testing.T) {
 	}
 	defer idx.Close()
 }
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func countMatches(t *testing.T, idx *Index, pat string) int {
+	res, err := idx.Search(context.Background(), pat, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(res.Matches)
+}
+
+func TestUpdate(t *testing.T) {
+	src, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	// foo.go is included to ensure that a change to foo does not drop it,
+	// since a changed path shadows everything it is a prefix of.
+	writeFiles(t, src, map[string]string{
+		"foo":    "alpha\n",
+		"foo.go": "bravo\n",
+		"bar":    "charlie\n",
+	})
+
+	var opt IndexOptions
+
+	dir, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := Build(&opt, dir, src, url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Remove() //nolint
+
+	writeFiles(t, src, map[string]string{
+		"foo": "delta\n",
+		"baz": "echo\n",
+	})
+	if err := os.Remove(filepath.Join(src, "bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := Update(&opt, dst, src, base, url, "r421", []string{"foo", "bar", "baz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	if ref.Rev != "r421" {
+		t.Fatalf("expected rev of r421, got %s", ref.Rev)
+	}
+
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	for pat, expected := range map[string]int{
+		"alpha":   0,
+		"bravo":   1,
+		"charlie": 0,
+		"delta":   1,
+		"echo":    1,
+	} {
+		if got := countMatches(t, idx, pat); got != expected {
+			t.Errorf("expected %d files matching %s, got %d", expected, pat, got)
+		}
+	}
+}
+
+func TestNumFilesAndSize(t *testing.T) {
+	src, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	writeFiles(t, src, map[string]string{
+		"foo": "alpha\n",
+		"bar": "bravo\n",
+	})
+
+	dir, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := Build(&IndexOptions{}, dir, src, url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	if n := idx.NumFiles(); n != 2 {
+		t.Fatalf("expected 2 files, got %d", n)
+	}
+
+	size, err := idx.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size == 0 {
+		t.Fatal("expected a non-zero index size")
+	}
+}
+
+func TestLfsPointersExcluded(t *testing.T) {
+	src, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	writeFiles(t, src, map[string]string{
+		"model.bin": "version https://git-lfs.github.com/spec/v1\n" +
+			"oid sha256:4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393\n" +
+			"size 12345\n",
+		"README": "version https://example.com/\n",
+	})
+
+	dir, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := Build(&IndexOptions{}, dir, src, url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	excluded, err := readExcludedFilesJson(filepath.Join(ref.Dir(), excludedFileJsonFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(excluded) != 1 || excluded[0].Filename != "model.bin" || excluded[0].Reason != reasonLfsPointer {
+		t.Fatalf("expected model.bin to be excluded as an LFS pointer, got %v", excluded)
+	}
+}
+
+func TestExcludedPath(t *testing.T) {
+	opt := &IndexOptions{
+		IncludePaths: []string{"services/*", "libs/"},
+		ExcludePaths: []string{"**/testdata"},
+	}
+
+	for rel, expected := range map[string]string{
+		"services/api/main.go":       "",
+		"services/README":            "",
+		"libs/a/b/c.go":              "",
+		"libs/a/testdata/t.txt":      "libs/a/testdata",
+		"services/api/testdata/t.go": "services/api/testdata",
+		"docs/guide/intro.md":        "docs",
+		"README":                     "README",
+		"librarian/x.go":             "librarian",
+	} {
+		if got := opt.excludedPath(rel); got != expected {
+			t.Errorf("expected %s to be excluded as %q, got %q", rel, expected, got)
+		}
+	}
+}
+
+func TestIncludeAndExcludePaths(t *testing.T) {
+	src, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	writeFiles(t, src, map[string]string{
+		"services/api/main.go":  "alpha\n",
+		"services/api/testdata": "bravo\n",
+		"docs/guide.md":         "charlie\n",
+		"README":                "delta\n",
+		"libs/util/strings.go":  "echo\n",
+	})
+
+	dir, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt := &IndexOptions{
+		IncludePaths: []string{"services", "libs/**/*.go"},
+		ExcludePaths: []string{"**/testdata"},
+		SparseFiles:  []string{"vendor/a/a.go", "vendor/b/b.go"},
+	}
+
+	ref, err := Build(opt, dir, src, url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	for pat, expected := range map[string]int{
+		"alpha":   1,
+		"bravo":   0,
+		"charlie": 0,
+		"delta":   0,
+		"echo":    1,
+	} {
+		if got := countMatches(t, idx, pat); got != expected {
+			t.Errorf("expected %d files matching %s, got %d", expected, pat, got)
+		}
+	}
+
+	excluded, err := readExcludedFilesJson(filepath.Join(ref.Dir(), excludedFileJsonFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	for _, file := range excluded {
+		got[file.Filename] = file.Reason
+	}
+
+	for _, name := range []string{"services/api/testdata", "docs", "README", "vendor"} {
+		if got[name] != reasonPathExcluded {
+			t.Errorf("expected %s to be excluded by config, got %v", name, got)
+		}
+	}
+
+	if len(got) != 4 {
+		t.Errorf("expected 4 excluded paths, got %v", got)
+	}
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	src, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	writeFiles(t, src, map[string]string{
+		".houndignore":       "build/\n*.min.js\n",
+		"lib/.houndignore":   "!keep.min.js\n",
+		"main.go":            "alpha\n",
+		"build/out.go":       "bravo\n",
+		"app.min.js":         "charlie\n",
+		"lib/keep.min.js":    "delta\n",
+		"lib/build/other.go": "echo\n",
+	})
+
+	dir, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt := &IndexOptions{
+		IgnoreFiles: []string{".houndignore"},
+	}
+
+	ref, err := Build(opt, dir, src, url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	for pat, expected := range map[string]int{
+		"alpha":   1,
+		"bravo":   0,
+		"charlie": 0,
+		"delta":   1,
+		"echo":    0,
+	} {
+		if got := countMatches(t, idx, pat); got != expected {
+			t.Errorf("expected %d files matching %s, got %d", expected, pat, got)
+		}
+	}
+
+	excluded, err := readExcludedFilesJson(filepath.Join(ref.Dir(), excludedFileJsonFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	for _, file := range excluded {
+		got[file.Filename] = file.Reason
+	}
+
+	for _, name := range []string{"build", "app.min.js", "lib/build"} {
+		if got[name] != reasonIgnored {
+			t.Errorf("expected %s to be ignored, got %v", name, got)
+		}
+	}
+}
+
+func TestUpdateWithChangedIgnoreFile(t *testing.T) {
+	src, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	writeFiles(t, src, map[string]string{
+		"foo": "alpha\n",
+	})
+
+	opt := &IndexOptions{
+		IgnoreFiles: []string{".houndignore"},
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := Build(opt, dir, src, url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Remove() //nolint
+
+	writeFiles(t, src, map[string]string{
+		".houndignore": "foo\n",
+	})
+
+	dst, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	if _, err := Update(opt, dst, src, base, url, "r421", []string{".houndignore"}); err != errIgnoreFilesChanged {
+		t.Fatalf("expected %v, got %v", errIgnoreFilesChanged, err)
+	}
+}
@@ -0,0 +1,62 @@
+package index
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/hound-search/hound/ignore"
+)
+
+// Is the path left out by the include and exclude paths? See ignore.Paths.
+func (opt *IndexOptions) excludesPath(rel string, isDir bool) bool {
+	paths := ignore.Paths{Include: opt.IncludePaths, Exclude: opt.ExcludePaths}
+	return paths.Excludes(rel, isDir)
+}
+
+// The outermost directory of the path, or the path itself, that is left out by
+// the include and exclude paths, or the empty string if it is included. This is
+// what the path is listed as in the excluded files, so that a directory that is
+// left out is listed once rather than with every file in it.
+func (opt *IndexOptions) excludedPath(rel string) string {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := 1; i <= len(parts); i++ {
+		p := filepath.Join(parts[:i]...)
+		if opt.excludesPath(p, i < len(parts)) {
+			return p
+		}
+	}
+	return ""
+}
+
+// Add the paths of files that were left out by the include and exclude paths to
+// the excluded files, unless they are listed already.
+func addExcludedPaths(opt *IndexOptions, excluded []*ExcludedFile, files []string) []*ExcludedFile {
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		p := opt.excludedPath(file)
+		if p == "" {
+			// The vcs left out a file that the globs include, which can
+			// only be due to the vcs matching them differently.
+			p = file
+		}
+		paths = append(paths, p)
+	}
+	return addExcluded(excluded, paths, reasonPathExcluded)
+}
+
+// Add the paths to the excluded files for the reason, unless they are listed
+// already.
+func addExcluded(excluded []*ExcludedFile, paths []string, reason string) []*ExcludedFile {
+	listed := map[string]bool{}
+	for _, file := range excluded {
+		listed[file.Filename] = true
+	}
+
+	for _, p := range paths {
+		if !listed[p] {
+			listed[p] = true
+			excluded = append(excluded, &ExcludedFile{p, reason})
+		}
+	}
+	return excluded
+}
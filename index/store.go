@@ -0,0 +1,647 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/hound-search/hound/codesearch/index"
+	"github.com/hound-search/hound/config"
+)
+
+const (
+	packedFilename = "content.pack"
+	packedMagic    = "HNDPACK1"
+
+	// Files are added to a block until it is at least this large, so most
+	// blocks hold many small files and a large file gets a block of its own.
+	packedBlockSize = 64 << 10
+
+	// The most packs of earlier builds that a packed store links to, beyond
+	// which the kept files of the packs with the least content in use are
+	// copied instead.
+	maxLinkedPacks = 8
+)
+
+// Writes the contents of files to the store of an index as it is built.
+type storeWriter interface {
+
+	// Add a file to the index, copying its content to the store as the
+	// index reads it. Returns the reason the index rejected the file, in
+	// which case its content is not kept.
+	add(ix *index.IndexWriter, name string, r io.Reader) (string, error)
+
+	// Copy the content of a file that is already in the index to the store.
+	put(name string, r io.Reader) error
+
+	// Finish writing the store. Closing it again does nothing.
+	close() error
+}
+
+// Reads the contents of files back from the store of an index.
+type storeReader interface {
+	open(name string) (io.ReadCloser, error)
+	close() error
+}
+
+// Create the writer of the store of opt, see config.StoreFiles and
+// config.StorePacked, in the index directory dst.
+func newStoreWriter(opt *IndexOptions, dst string) (storeWriter, error) {
+	if err := config.ValidateStore(opt.Store, opt.Compression); err != nil {
+		return nil, err
+	}
+
+	switch opt.Store {
+	case "", config.StoreFiles:
+		dir := filepath.Join(dst, "raw")
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, err
+		}
+		return &filesWriter{dir: dir}, nil
+	default:
+		return newPackedWriter(filepath.Join(dst, packedFilename), opt.Compression)
+	}
+}
+
+// Open the store of the index, which is tree for an index that was built from
+// a tree.
+func openStore(r *IndexRef, tree Tree) (storeReader, error) {
+	if r.FromTree {
+		blobs, err := readBlobs(r.dir)
+		if err != nil {
+			return nil, err
+		}
+		return &treeReader{tree: tree, blobs: blobs}, nil
+	}
+
+	switch r.Store {
+	case "", config.StoreFiles:
+		return &filesReader{dir: filepath.Join(r.dir, "raw")}, nil
+	case config.StorePacked:
+		return openPackedReader(filepath.Join(r.dir, packedFilename))
+	}
+	return nil, fmt.Errorf("%w: %q", config.ErrUnknownStore, r.Store)
+}
+
+// Copy the contents of the files of base that were kept by an update to w.
+// Files that are kept in a gzip copy by both are linked rather than compressed
+// again, and the blocks of a packed store are reused by another, see
+// packedWriter.keep.
+func keepContents(w storeWriter, base *IndexRef, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	if pw, ok := w.(*packedWriter); ok && base.Store == config.StorePacked {
+		return pw.keep(base, names)
+	}
+
+	if fw, ok := w.(*filesWriter); ok && (base.Store == "" || base.Store == config.StoreFiles) {
+		for _, name := range names {
+			if err := linkOrCopyFile(
+				filepath.Join(base.dir, "raw", name),
+				filepath.Join(fw.dir, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	r, err := openStore(base, nil)
+	if err != nil {
+		return err
+	}
+	defer r.close()
+
+	for _, name := range names {
+		if err := copyContent(w, r, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyContent(w storeWriter, r storeReader, name string) error {
+	c, err := r.open(name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return w.put(name, c)
+}
+
+// A gzip copy of each file, at its path under dir.
+type filesWriter struct {
+	dir string
+}
+
+func (w *filesWriter) add(ix *index.IndexWriter, name string, r io.Reader) (string, error) {
+	var reason string
+	err := w.write(name, func(c io.Writer) error {
+		reason = ix.Add(name, io.TeeReader(r, c))
+		return nil
+	})
+	return reason, err
+}
+
+func (w *filesWriter) put(name string, r io.Reader) error {
+	return w.write(name, func(c io.Writer) error {
+		_, err := io.Copy(c, r)
+		return err
+	})
+}
+
+// Create the gzip copy of a file, whose content is written by fn.
+func (w *filesWriter) write(name string, fn func(w io.Writer) error) error {
+	dup := filepath.Join(w.dir, name)
+	if err := os.MkdirAll(filepath.Dir(dup), os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := os.Create(dup)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	g := gzip.NewWriter(f)
+	if err := fn(g); err != nil {
+		return err
+	}
+
+	if err := g.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (w *filesWriter) close() error {
+	return nil
+}
+
+type filesReader struct {
+	dir string
+}
+
+func (r *filesReader) open(name string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(r.dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &gzipFile{c, f}, nil
+}
+
+func (r *filesReader) close() error {
+	return nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close() //nolint
+	return g.f.Close()
+}
+
+// The table at the end of a packed store.
+type packedTable struct {
+	Compression string
+	Blocks      []packedBlock
+	Files       map[string]packedFile
+
+	// The packs of earlier builds whose blocks are reused, which are hard
+	// links in the same directory.
+	Packs []packedPack
+
+	// The size of the content that was written to the blocks of this pack.
+	Size int64
+}
+
+// Where a block is in the packed store, and how many bytes it takes up there.
+// Pack is 0 for a block of the pack itself, or one more than the index of the
+// pack in Packs that holds it.
+type packedBlock struct {
+	Pack         int
+	Offset, Size int64
+}
+
+// A pack of an earlier build, and the size of the content that was written to
+// its blocks, some of which may no longer be used.
+type packedPack struct {
+	Name string
+	Size int64
+}
+
+// Where the content of a file is in the uncompressed data of a block.
+type packedFile struct {
+	Block        int
+	Offset, Size int64
+}
+
+// A packed store is laid out as the magic, the blocks, the gob encoded table
+// and the offset of the table as 8 big endian bytes.
+type packedWriter struct {
+	dir    string
+	f      *os.File
+	w      *bufio.Writer
+	off    int64
+	fw     *flate.Writer
+	block  bytes.Buffer
+	table  packedTable
+	closed bool
+}
+
+func newPackedWriter(filename, compression string) (*packedWriter, error) {
+	w := &packedWriter{
+		table: packedTable{
+			Compression: compression,
+			Files:       map[string]packedFile{},
+		},
+	}
+
+	switch compression {
+	case "", config.CompressionNone:
+		w.table.Compression = config.CompressionNone
+	case config.CompressionFlate:
+		fw, err := flate.NewWriter(nil, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		w.fw = fw
+	default:
+		return nil, fmt.Errorf("%w: %q", config.ErrUnknownCompression, compression)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	w.dir = filepath.Dir(filename)
+	w.f = f
+	w.w = bufio.NewWriter(f)
+	if _, err := w.w.WriteString(packedMagic); err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.off = int64(len(packedMagic))
+
+	return w, nil
+}
+
+func (w *packedWriter) add(ix *index.IndexWriter, name string, r io.Reader) (string, error) {
+	start := w.block.Len()
+	if reason := ix.Add(name, io.TeeReader(r, &w.block)); reason != "" {
+		w.block.Truncate(start)
+		return reason, nil
+	}
+	return "", w.added(name, start)
+}
+
+func (w *packedWriter) put(name string, r io.Reader) error {
+	start := w.block.Len()
+	if _, err := io.Copy(&w.block, r); err != nil {
+		return err
+	}
+	return w.added(name, start)
+}
+
+// Record the file whose content was appended to the current block at start.
+func (w *packedWriter) added(name string, start int) error {
+	w.table.Files[name] = packedFile{
+		Block:  len(w.table.Blocks),
+		Offset: int64(start),
+		Size:   int64(w.block.Len() - start),
+	}
+
+	if w.block.Len() >= packedBlockSize {
+		return w.flush()
+	}
+	return nil
+}
+
+// Write the current block to the store.
+func (w *packedWriter) flush() error {
+	var n int64
+	if w.fw != nil {
+		c := &countingWriter{w: w.w}
+		w.fw.Reset(c)
+		if _, err := w.fw.Write(w.block.Bytes()); err != nil {
+			return err
+		}
+		if err := w.fw.Close(); err != nil {
+			return err
+		}
+		n = c.n
+	} else {
+		if _, err := w.w.Write(w.block.Bytes()); err != nil {
+			return err
+		}
+		n = int64(w.block.Len())
+	}
+
+	w.table.Blocks = append(w.table.Blocks, packedBlock{0, w.off, n})
+	w.table.Size += int64(w.block.Len())
+	w.off += n
+	w.block.Reset()
+	return nil
+}
+
+// Keep the contents of the files of base, which is a packed store, while
+// writing only a table entry for most of them. The packs of base are linked
+// into the store and their blocks are used as they are, so an update does not
+// copy the content of every file that did not change. The files of a pack are
+// copied instead when less than half of the pack's content is still used, so
+// that unused content does not pile up, when its blocks are compressed in
+// another way or when too many packs would be linked.
+func (w *packedWriter) keep(base *IndexRef, names []string) error {
+	r, err := openPackedReader(filepath.Join(base.dir, packedFilename))
+	if err != nil {
+		return err
+	}
+	defer r.close()
+
+	packs := append([]packedPack{{packedFilename, r.table.Size}}, r.table.Packs...)
+	total := make([]int64, len(packs))
+	for _, f := range r.table.Files {
+		total[r.table.Blocks[f.Block].Pack] += f.Size
+	}
+
+	used := make([]int64, len(packs))
+	for _, name := range names {
+		f, ok := r.table.Files[name]
+		if !ok {
+			return fmt.Errorf("index: no content for %s", name)
+		}
+		used[r.table.Blocks[f.Block].Pack] += f.Size
+	}
+
+	// The packs that are worth linking, those with the most content in use
+	// first.
+	var candidates []int
+	if r.table.Compression == w.table.Compression {
+		for i, p := range packs {
+			if p.Size > total[i] {
+				total[i] = p.Size
+			}
+			if used[i] > 0 && used[i]*2 >= total[i] {
+				candidates = append(candidates, i)
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return used[candidates[i]] > used[candidates[j]]
+	})
+	if len(candidates) > maxLinkedPacks {
+		candidates = candidates[:maxLinkedPacks]
+	}
+
+	// The pack that each pack of base is in w, or 0 if its files are copied.
+	linked := make([]int, len(packs))
+	for _, i := range candidates {
+		name := packs[i].Name
+		if i == 0 {
+			name = nextPackName(packs)
+		}
+
+		if err := linkOrCopyFile(filepath.Join(base.dir, packs[i].Name), filepath.Join(w.dir, name)); err != nil {
+			return err
+		}
+
+		w.table.Packs = append(w.table.Packs, packedPack{name, total[i]})
+		linked[i] = len(w.table.Packs)
+	}
+
+	// A block that is being filled has to be written before blocks of other
+	// packs are added to the table.
+	if w.block.Len() > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+
+	blocks := map[int]int{}
+	var copied []string
+	for _, name := range names {
+		f := r.table.Files[name]
+		b := r.table.Blocks[f.Block]
+		if linked[b.Pack] == 0 {
+			copied = append(copied, name)
+			continue
+		}
+
+		i, ok := blocks[f.Block]
+		if !ok {
+			i = len(w.table.Blocks)
+			blocks[f.Block] = i
+			w.table.Blocks = append(w.table.Blocks, packedBlock{linked[b.Pack], b.Offset, b.Size})
+		}
+
+		f.Block = i
+		w.table.Files[name] = f
+	}
+
+	for _, name := range copied {
+		if err := copyContent(w, r, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The name of a pack that none of the packs have, for the pack of an earlier
+// build that is linked into a new store.
+func nextPackName(packs []packedPack) string {
+	n := 0
+	for _, p := range packs {
+		var i int
+		if _, err := fmt.Sscanf(p.Name, "content-%d.pack", &i); err == nil && i > n {
+			n = i
+		}
+	}
+	return fmt.Sprintf("content-%d.pack", n+1)
+}
+
+func (w *packedWriter) close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.f.Close()
+
+	if w.block.Len() > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+
+	if err := gob.NewEncoder(w.w).Encode(&w.table); err != nil {
+		return err
+	}
+
+	var off [8]byte
+	binary.BigEndian.PutUint64(off[:], uint64(w.off))
+	if _, err := w.w.Write(off[:]); err != nil {
+		return err
+	}
+
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return w.f.Close()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type packedReader struct {
+	f     *os.File
+	table packedTable
+
+	// The files of the packs that blocks are in, starting with f.
+	packs []*os.File
+
+	// The last block that was decompressed, since the files of a block are
+	// often searched one after the other.
+	lck   sync.Mutex
+	last  int
+	block []byte
+}
+
+func openPackedReader(filename string) (*packedReader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &packedReader{f: f, last: -1, packs: []*os.File{f}}
+	if err := r.readTable(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("index: %s: %w", filename, err)
+	}
+
+	for _, p := range r.table.Packs {
+		pf, err := os.Open(filepath.Join(filepath.Dir(filename), p.Name))
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+		r.packs = append(r.packs, pf)
+	}
+	return r, nil
+}
+
+func (r *packedReader) readTable() error {
+	info, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+	if size < int64(len(packedMagic))+8 {
+		return errors.New("packed store is truncated")
+	}
+
+	magic := make([]byte, len(packedMagic))
+	if _, err := r.f.ReadAt(magic, 0); err != nil {
+		return err
+	}
+	if string(magic) != packedMagic {
+		return errors.New("not a packed store")
+	}
+
+	var buf [8]byte
+	if _, err := r.f.ReadAt(buf[:], size-8); err != nil {
+		return err
+	}
+
+	off := int64(binary.BigEndian.Uint64(buf[:]))
+	if off < int64(len(packedMagic)) || off > size-8 {
+		return errors.New("packed store has a bad table offset")
+	}
+
+	return gob.NewDecoder(io.NewSectionReader(r.f, off, size-8-off)).Decode(&r.table)
+}
+
+func (r *packedReader) open(name string) (io.ReadCloser, error) {
+	e, ok := r.table.Files[name]
+	if !ok {
+		return nil, fmt.Errorf("index: no content for %s", name)
+	}
+	b := r.table.Blocks[e.Block]
+
+	if r.table.Compression == config.CompressionNone {
+		return ioutil.NopCloser(io.NewSectionReader(r.packs[b.Pack], b.Offset+e.Offset, e.Size)), nil
+	}
+
+	data, err := r.readBlock(e.Block)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Offset+e.Size > int64(len(data)) {
+		return nil, fmt.Errorf("index: content of %s is past the end of its block", name)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data[e.Offset : e.Offset+e.Size])), nil
+}
+
+// Decompress a block, or return it from the cache.
+func (r *packedReader) readBlock(i int) ([]byte, error) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	if r.last == i {
+		return r.block, nil
+	}
+
+	b := r.table.Blocks[i]
+	c := flate.NewReader(io.NewSectionReader(r.packs[b.Pack], b.Offset, b.Size))
+	defer c.Close()
+
+	data, err := ioutil.ReadAll(c)
+	if err != nil {
+		return nil, err
+	}
+
+	r.last, r.block = i, data
+	return data, nil
+}
+
+func (r *packedReader) close() error {
+	var firstErr error
+	for _, f := range r.packs {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
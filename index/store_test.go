@@ -0,0 +1,251 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hound-search/hound/config"
+)
+
+// Enough files that a packed store of them has several blocks, each with a
+// line that is unique to the file.
+func manyFiles() map[string]string {
+	files := map[string]string{}
+	for i := 0; i < 300; i++ {
+		files[fmt.Sprintf("d%d/f%03d.txt", i%7, i)] = fmt.Sprintf("line %03d of %s\n", i, strings.Repeat("x", 500))
+	}
+	return files
+}
+
+func checkContents(t *testing.T, idx *Index, files map[string]string) {
+	for name, content := range files {
+		res, err := idx.Search(context.Background(), strings.SplitN(content, " of", 2)[0]+" ", &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res.Matches) != 1 || res.Matches[0].Filename != filepath.FromSlash(name) ||
+			res.Matches[0].Matches[0].Line != strings.TrimSuffix(content, "\n") {
+			t.Fatalf("expected the line of %s, got %v", name, res.Matches)
+		}
+	}
+}
+
+func TestPackedStore(t *testing.T) {
+	src, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	files := manyFiles()
+	writeFiles(t, src, files)
+	writeFiles(t, src, map[string]string{"bin": "\xff\xfe\x00"})
+
+	for _, compression := range []string{"", config.CompressionFlate} {
+		opt := &IndexOptions{Store: config.StorePacked, Compression: compression}
+
+		dir, err := ioutil.TempDir(os.TempDir(), "hound")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ref, err := Build(opt, dir, src, url, rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ref.Remove() //nolint
+
+		if _, err := os.Stat(filepath.Join(dir, "raw")); !os.IsNotExist(err) {
+			t.Errorf("expected no raw copies, got %v", err)
+		}
+
+		idx, err := ref.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := idx.store.(*packedReader)
+		if len(r.table.Blocks) < 2 {
+			t.Errorf("expected several blocks, got %d", len(r.table.Blocks))
+		}
+		if _, ok := r.table.Files["bin"]; ok {
+			t.Errorf("expected no content for an excluded file")
+		}
+
+		checkContents(t, idx, files)
+
+		if err := idx.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUpdateChangesStore(t *testing.T) {
+	src, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	files := manyFiles()
+	writeFiles(t, src, files)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each update keeps the files of the previous index in another store.
+	base, err := Build(&IndexOptions{}, filepath.Join(dir, "0"), src, url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, opt := range []*IndexOptions{
+		{Store: config.StorePacked, Compression: config.CompressionFlate},
+		{Store: config.StorePacked},
+		{Store: config.StoreFiles},
+	} {
+		changed := map[string]string{
+			"d0/f000.txt": fmt.Sprintf("line %03d of an update\n", 300+i),
+		}
+		writeFiles(t, src, changed)
+		files["d0/f000.txt"] = changed["d0/f000.txt"]
+
+		ref, err := Update(opt, filepath.Join(dir, fmt.Sprint(i+1)), src, base, url, rev, []string{filepath.FromSlash("d0/f000.txt")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		idx, err := ref.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkContents(t, idx, files)
+
+		if err := idx.Close(); err != nil {
+			t.Fatal(err)
+		}
+		base = ref
+	}
+}
+
+// Open the index of ref and return the table of its packed store.
+func openPacked(t *testing.T, ref *IndexRef, files map[string]string) packedTable {
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	checkContents(t, idx, files)
+	return idx.store.(*packedReader).table
+}
+
+func TestUpdateReusesPackedBlocks(t *testing.T) {
+	src, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	files := manyFiles()
+	writeFiles(t, src, files)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opt := &IndexOptions{Store: config.StorePacked, Compression: config.CompressionFlate}
+	base, err := Build(opt, filepath.Join(dir, "0"), src, url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Update the files, replacing the index of base as a searcher would.
+	n := len(files)
+	update := func(i int, names ...string) packedTable {
+		var changed []string
+		for _, name := range names {
+			n++
+			files[name] = fmt.Sprintf("line %03d of update %d\n", n, i)
+			writeFiles(t, src, map[string]string{name: files[name]})
+			changed = append(changed, filepath.FromSlash(name))
+		}
+
+		ref, err := Update(opt, filepath.Join(dir, fmt.Sprint(i)), src, base, url, rev, changed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := base.Remove(); err != nil {
+			t.Fatal(err)
+		}
+		base = ref
+		return openPacked(t, ref, files)
+	}
+
+	// Only the changed file is written, the blocks of the build are linked.
+	table := update(1, "d1/f001.txt")
+	if len(table.Packs) != 1 || table.Packs[0].Name != "content-1.pack" {
+		t.Fatalf("expected the pack of the build to be linked, got %v", table.Packs)
+	}
+	if table.Size != int64(len(files["d1/f001.txt"])) {
+		t.Errorf("expected only the changed file to be written, got %d bytes", table.Size)
+	}
+
+	// Each small update links the packs before it, up to a limit.
+	for i := 2; i < 2+2*maxLinkedPacks; i++ {
+		table = update(i, fmt.Sprintf("d%d/f%03d.txt", i%7, i))
+		if len(table.Packs) > maxLinkedPacks {
+			t.Fatalf("expected at most %d linked packs, got %d", maxLinkedPacks, len(table.Packs))
+		}
+	}
+	if table.Packs[0].Name != "content-1.pack" {
+		t.Errorf("expected the pack of the build to stay linked, got %v", table.Packs)
+	}
+
+	// Once less than half of the pack of the build is used, the files that
+	// are left in it are copied.
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	table = update(100, names[:len(names)*2/3]...)
+	for _, p := range table.Packs {
+		if p.Name == "content-1.pack" {
+			t.Errorf("expected the pack of the build not to be linked, got %v", table.Packs)
+		}
+	}
+}
+
+func TestUnknownStore(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := Build(&IndexOptions{Store: "tape"}, dir, thisDir(), url, rev); !errors.Is(err, config.ErrUnknownStore) {
+		t.Errorf("expected %v, got %v", config.ErrUnknownStore, err)
+	}
+
+	opt := &IndexOptions{Store: config.StorePacked, Compression: "zip"}
+	if _, err := Build(opt, filepath.Join(dir, "zip"), thisDir(), url, rev); !errors.Is(err, config.ErrUnknownCompression) {
+		t.Errorf("expected %v, got %v", config.ErrUnknownCompression, err)
+	}
+}
@@ -0,0 +1,298 @@
+package index
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hound-search/hound/codesearch/index"
+	"github.com/hound-search/hound/ignore"
+)
+
+const blobsFilename = "blobs.gob"
+
+// The files of a revision that are read from where a vcs stores them, like the
+// objects of a git repo, rather than from a working directory. An index that is
+// built from a tree keeps the blob ids of its files instead of raw copies, and
+// reads their contents back from the tree when searching.
+type Tree interface {
+
+	// Call fn with the slash separated path, the mode and the blob id of
+	// each file. Symlinks have the os.ModeSymlink mode.
+	Walk(fn func(path string, mode os.FileMode, blob string) error) error
+
+	// Read the content of a file by its blob id.
+	ReadBlob(blob string) ([]byte, error)
+
+	Close() error
+}
+
+type treeFile struct {
+	mode os.FileMode
+	blob string
+}
+
+// The files of a Tree, by their paths relative to the root of the tree.
+type treeSource struct {
+	tree    Tree
+	files   map[string]treeFile
+	dirs    map[string]bool
+	matcher *ignore.Matcher
+
+	// The blob ids of the files that were added to the index.
+	blobs map[string]string
+}
+
+func newTreeSource(opt *IndexOptions) (*treeSource, error) {
+	t := &treeSource{
+		tree:    opt.Tree,
+		files:   map[string]treeFile{},
+		dirs:    map[string]bool{},
+		matcher: ignore.New(),
+		blobs:   map[string]string{},
+	}
+
+	// The blob ids of the ignore files, by directory and name.
+	ignoreFiles := map[string]map[string]string{}
+	err := t.tree.Walk(func(p string, mode os.FileMode, blob string) error {
+		t.files[filepath.FromSlash(p)] = treeFile{mode, blob}
+
+		dir := path.Dir(p)
+		for d := dir; d != "." && !t.dirs[filepath.FromSlash(d)]; d = path.Dir(d) {
+			t.dirs[filepath.FromSlash(d)] = true
+		}
+
+		if mode.IsRegular() && containsString(opt.IgnoreFiles, path.Base(p)) {
+			if ignoreFiles[dir] == nil {
+				ignoreFiles[dir] = map[string]string{}
+			}
+			ignoreFiles[dir][path.Base(p)] = blob
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The patterns of deeper directories take precedence, so they are added
+	// last, like they are loaded as a working directory is walked.
+	var dirs []string
+	for dir := range ignoreFiles {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		di, dj := pathDepth(dirs[i]), pathDepth(dirs[j])
+		if di != dj {
+			return di < dj
+		}
+		return dirs[i] < dirs[j]
+	})
+
+	for _, dir := range dirs {
+		for _, name := range opt.IgnoreFiles {
+			blob, ok := ignoreFiles[dir][name]
+			if !ok {
+				continue
+			}
+
+			data, err := t.tree.ReadBlob(blob)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := t.matcher.Add(dir, bytes.NewReader(data)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return t, nil
+}
+
+// The number of directories in a slash separated directory path, where the
+// root is ".".
+func pathDepth(dir string) int {
+	if dir == "." {
+		return 0
+	}
+	return strings.Count(dir, "/") + 1
+}
+
+// The sorted paths of the files of the tree.
+func (t *treeSource) paths() []string {
+	paths := make([]string, 0, len(t.files))
+	for rel := range t.files {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (t *treeSource) lstat(rel string) (bool, bool, error) {
+	if _, ok := t.files[rel]; ok {
+		return true, false, nil
+	}
+	return t.dirs[rel], t.dirs[rel], nil
+}
+
+// Every ignore file of the tree was added up front, so that only the
+// directories that contain the path have to be matched.
+func (t *treeSource) ignored(rel string) (string, error) {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := range parts {
+		p := path.Join(parts[:i+1]...)
+		if t.matcher.Match(p, i < len(parts)-1) {
+			return filepath.FromSlash(p), nil
+		}
+	}
+	return "", nil
+}
+
+func (t *treeSource) add(ix *index.IndexWriter, rel string) (string, error) {
+	f := t.files[rel]
+	if f.mode&os.ModeType != 0 {
+		return reasonInvalidMode, nil
+	}
+
+	data, err := t.tree.ReadBlob(f.blob)
+	if err != nil {
+		return "", err
+	}
+
+	if reason := checkBlob(data); reason != "" {
+		return reason, nil
+	}
+
+	reason := ix.Add(rel, bytes.NewReader(data))
+	if reason == "" {
+		t.blobs[rel] = f.blob
+	}
+	return reason, nil
+}
+
+// Write the blob ids of the files that were added and of the files of base that
+// were kept.
+func (t *treeSource) finish(dst string, base *IndexRef, kept []string) error {
+	if len(kept) > 0 {
+		baseBlobs, err := readBlobs(base.dir)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range kept {
+			blob, ok := baseBlobs[name]
+			if !ok {
+				return fmt.Errorf("index: no blob id for %s", name)
+			}
+			t.blobs[name] = blob
+		}
+	}
+
+	return writeBlobs(dst, t.blobs)
+}
+
+func (t *treeSource) close() error {
+	return nil
+}
+
+// Determine whether a file of a tree should be excluded from the index based on
+// its contents, like checkFile does for the files of a working directory.
+func checkBlob(data []byte) string {
+	peek := data
+	if len(peek) > filePeekSize {
+		peek = peek[:filePeekSize]
+	}
+
+	if !isText(peek) {
+		return reasonNotText
+	}
+
+	if len(data) < lfsPointerMaxSize && bytes.HasPrefix(data, []byte(lfsPointerPrefix)) {
+		return reasonLfsPointer
+	}
+
+	return ""
+}
+
+func indexTreeFiles(opt *IndexOptions, dst string) error {
+	files, err := newTreeSource(opt)
+	if err != nil {
+		return err
+	}
+
+	ix := index.Create(filepath.Join(dst, "tri"))
+	defer ix.Close()
+
+	excluded, excludedPaths, ignoredPaths, err := addFiles(opt, ix, files, files.paths())
+	if err != nil {
+		return err
+	}
+
+	excluded = addExcludedPaths(opt, excluded, append(excludedPaths, opt.SparseFiles...))
+	excluded = addExcluded(excluded, ignoredPaths, reasonIgnored)
+
+	if err := files.finish(dst, nil, nil); err != nil {
+		return err
+	}
+
+	if err := writeExcludedFilesJson(
+		filepath.Join(dst, excludedFileJsonFilename),
+		excluded); err != nil {
+		return err
+	}
+
+	ix.Flush()
+
+	return nil
+}
+
+func writeBlobs(dir string, blobs map[string]string) error {
+	w, err := os.Create(filepath.Join(dir, blobsFilename))
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	return gob.NewEncoder(w).Encode(blobs)
+}
+
+// Read the blob ids of the files of an index that was built from a tree.
+func readBlobs(dir string) (map[string]string, error) {
+	r, err := os.Open(filepath.Join(dir, blobsFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var blobs map[string]string
+	if err := gob.NewDecoder(r).Decode(&blobs); err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+// The store of an index that was built from a tree, which reads the contents of
+// files back from the tree by their blob ids.
+type treeReader struct {
+	tree  Tree
+	blobs map[string]string
+}
+
+func (r *treeReader) open(name string) (io.ReadCloser, error) {
+	data, err := r.tree.ReadBlob(r.blobs[name])
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (r *treeReader) close() error {
+	return r.tree.Close()
+}
@@ -0,0 +1,214 @@
+package index
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// A tree of files that are kept in memory, with symlinks given by a target
+// that starts with "->".
+type memTree struct {
+	files  map[string]string
+	closed bool
+}
+
+func blobID(content string) string {
+	sum := sha1.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *memTree) Walk(fn func(path string, mode os.FileMode, blob string) error) error {
+	var paths []string
+	for p := range t.files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		var mode os.FileMode = 0644
+		if content := t.files[p]; len(content) > 2 && content[:2] == "->" {
+			mode = os.ModeSymlink
+		}
+
+		if err := fn(p, mode, blobID(t.files[p])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *memTree) ReadBlob(blob string) ([]byte, error) {
+	for _, content := range t.files {
+		if blobID(content) == blob {
+			return []byte(content), nil
+		}
+	}
+	return nil, fmt.Errorf("no blob %s", blob)
+}
+
+func (t *memTree) Close() error {
+	t.closed = true
+	return nil
+}
+
+func excludedReasons(t *testing.T, dir string) map[string]string {
+	excluded, err := readExcludedFilesJson(filepath.Join(dir, excludedFileJsonFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reasons := map[string]string{}
+	for _, file := range excluded {
+		reasons[filepath.ToSlash(file.Filename)] = file.Reason
+	}
+	return reasons
+}
+
+func TestBuildFromTree(t *testing.T) {
+	tree := &memTree{files: map[string]string{
+		"a.go":              "needle alpha\n",
+		"sub/b.go":          "needle bravo\n",
+		".houndignore":      "ignored/\n",
+		"ignored/c.go":      "needle charlie\n",
+		"vendor/v.go":       "needle victor\n",
+		"keep/.houndignore": "*.log\n",
+		"keep/x.log":        "needle xray\n",
+		"link":              "->a.go",
+		"bin":               "\xff\xfe\x00",
+	}}
+
+	opt := &IndexOptions{
+		ExcludePaths: []string{"vendor"},
+		IgnoreFiles:  []string{".houndignore"},
+		Tree:         tree,
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := Build(opt, dir, "", url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	if _, err := os.Stat(filepath.Join(dir, "raw")); !os.IsNotExist(err) {
+		t.Errorf("expected no raw copies, got %v", err)
+	}
+
+	if _, err := ref.Open(); err == nil {
+		t.Errorf("expected an error opening an index of a tree without the tree")
+	}
+
+	idx, err := ref.OpenTree(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := countMatches(t, idx, "needle"); got != 2 {
+		t.Errorf("expected 2 files matching needle, got %d", got)
+	}
+
+	expected := map[string]string{
+		"ignored":    reasonIgnored,
+		"keep/x.log": reasonIgnored,
+		"vendor":     reasonPathExcluded,
+		"link":       reasonInvalidMode,
+		"bin":        reasonNotText,
+	}
+	got := excludedReasons(t, dir)
+	for name, reason := range expected {
+		if got[name] != reason {
+			t.Errorf("expected %s to be excluded with %q, got %q", name, reason, got[name])
+		}
+	}
+	if len(got) != len(expected) {
+		t.Errorf("expected %d excluded files, got %v", len(expected), got)
+	}
+
+	if err := idx.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !tree.closed {
+		t.Errorf("expected the tree to be closed with the index")
+	}
+}
+
+func TestUpdateFromTree(t *testing.T) {
+	opt := &IndexOptions{Tree: &memTree{files: map[string]string{
+		"foo":    "alpha\n",
+		"foo.go": "bravo\n",
+		"bar":    "charlie\n",
+	}}}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := Build(opt, dir, "", url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Remove() //nolint
+
+	tree := &memTree{files: map[string]string{
+		"foo":    "delta\n",
+		"foo.go": "bravo\n",
+		"baz":    "echo\n",
+	}}
+	opt.Tree = tree
+
+	dst, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := Update(opt, dst, "", base, url, "r421", []string{"foo", "bar", "baz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	idx, err := ref.OpenTree(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	for pat, expected := range map[string]int{
+		"alpha":   0,
+		"bravo":   1,
+		"charlie": 0,
+		"delta":   1,
+		"echo":    1,
+	} {
+		if got := countMatches(t, idx, pat); got != expected {
+			t.Errorf("expected %d files matching %s, got %d", expected, pat, got)
+		}
+	}
+
+	// An index of a working directory cannot be updated from a tree.
+	src, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	dirRef, err := Build(&IndexOptions{}, filepath.Join(dir, "idx"), src, url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Update(opt, filepath.Join(dir, "update"), "", dirRef, url, "r421", []string{"foo"}); err != errSourceChanged {
+		t.Errorf("expected %v, got %v", errSourceChanged, err)
+	}
+}
@@ -0,0 +1,434 @@
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hound-search/hound/codesearch/index"
+	"github.com/hound-search/hound/ignore"
+)
+
+var errUnsortedIndex = errors.New("index names are not sorted, a full build is required")
+
+// A changed ignore file may ignore, or stop ignoring, files that did not change.
+var errIgnoreFilesChanged = errors.New("ignore files changed, a full build is required")
+
+// An index of a working directory cannot be updated from a tree, or the other
+// way around.
+var errSourceChanged = errors.New("index was built from other files, a full build is required")
+
+// Update builds a new index in dst for the given rev by applying a set of changed
+// files to an existing index. Rather than walking all of src again, only the changed
+// paths (relative to src, and including files that were removed) are indexed into a
+// delta which is then merged with the trigram index of base. The contents of files
+// that did not change are copied from the store of base, or linked when both keep a
+// gzip copy of each file, instead of being read from src again. When opt has a Tree,
+// the changed paths are read from it instead of from src.
+//
+// An error is returned if base cannot be updated incrementally, in which case the
+// caller should fall back to Build.
+func Update(opt *IndexOptions, dst, src string, base *IndexRef, url, rev string, changed []string) (*IndexRef, error) {
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	if err := updateAllFiles(opt, dst, src, base, changed); err != nil {
+		os.RemoveAll(dst)
+		return nil, err
+	}
+
+	r := &IndexRef{
+		Url:                url,
+		Rev:                rev,
+		Time:               time.Now(),
+		dir:                dst,
+		AutoGeneratedFiles: opt.AutoGeneratedFiles,
+		IncludePaths:       opt.IncludePaths,
+		ExcludePaths:       opt.ExcludePaths,
+		FromTree:           opt.Tree != nil,
+		Store:              opt.Store,
+		Compression:        opt.Compression,
+	}
+
+	if err := r.writeManifest(); err != nil {
+		os.RemoveAll(dst)
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func updateAllFiles(opt *IndexOptions, dst, src string, base *IndexRef, changed []string) error {
+	if base.FromTree != (opt.Tree != nil) {
+		return errSourceChanged
+	}
+
+	names, err := readNames(filepath.Join(base.dir, "tri"))
+	if err != nil {
+		return err
+	}
+
+	for _, rel := range changed {
+		if containsString(opt.IgnoreFiles, filepath.Base(rel)) {
+			return errIgnoreFilesChanged
+		}
+	}
+
+	var files source
+	if opt.Tree != nil {
+		if files, err = newTreeSource(opt); err != nil {
+			return err
+		}
+	} else if files, err = newDirSource(opt, dst, src); err != nil {
+		return err
+	}
+	defer files.close()
+
+	paths := shadowedPaths(names, changed)
+
+	delta := filepath.Join(dst, "tri.delta")
+	ix := index.Create(delta)
+	defer ix.Close()
+	defer os.Remove(delta)
+
+	ix.AddPaths(paths)
+
+	excluded, excludedPaths, ignoredPaths, err := addFiles(opt, ix, files, paths)
+	if err != nil {
+		return err
+	}
+
+	ix.Flush()
+
+	if err := mergeIndexes(
+		filepath.Join(dst, "tri"),
+		filepath.Join(base.dir, "tri"),
+		delta); err != nil {
+		return err
+	}
+
+	// Reuse the content of every file the delta did not replace.
+	var kept []string
+	for _, name := range names {
+		if !containsSorted(paths, name) {
+			kept = append(kept, name)
+		}
+	}
+
+	if err := files.finish(dst, base, kept); err != nil {
+		return err
+	}
+
+	baseExcluded, err := readExcludedFilesJson(filepath.Join(base.dir, excludedFileJsonFilename))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range baseExcluded {
+		if !containsSorted(paths, file.Filename) {
+			excluded = append(excluded, file)
+		}
+	}
+
+	excluded = addExcludedPaths(opt, excluded, excludedPaths)
+	excluded = addExcluded(excluded, ignoredPaths, reasonIgnored)
+
+	return writeExcludedFilesJson(
+		filepath.Join(dst, excludedFileJsonFilename),
+		excluded)
+}
+
+// The files that an index is built from, which are either in a working
+// directory or in a Tree.
+type source interface {
+
+	// Is there a file or directory at the path, which is relative to the
+	// root of the source tree?
+	lstat(rel string) (exists, isDir bool, err error)
+
+	// Return the outermost directory of the path, or the path itself, that
+	// is ignored by the ignore files, or the empty string.
+	ignored(rel string) (string, error)
+
+	// Add the file at the path to the index, unless it is not a text file
+	// or the index rejects it, in which case the reason is returned.
+	add(ix *index.IndexWriter, rel string) (string, error)
+
+	// Store the content of the files that were added to the index in dst,
+	// along with that of the files of base, if any, that were kept.
+	finish(dst string, base *IndexRef, kept []string) error
+
+	// Release what the source holds on to, whether or not it finished.
+	close() error
+}
+
+// Add the files at the paths, which are sorted, to the index by the same rules
+// that indexAllFiles applies as it walks a working directory. Returns the files
+// that were excluded for other reasons than the include and exclude paths or
+// the ignore files, and the paths that those left out.
+func addFiles(opt *IndexOptions, ix *index.IndexWriter, files source, paths []string) ([]*ExcludedFile, []string, []string, error) {
+	excluded := []*ExcludedFile{}
+	var excludedPaths, ignoredPaths []string
+	for _, rel := range paths {
+		skip, reason := filterPath(opt, rel)
+		if skip {
+			continue
+		}
+
+		if opt.excludedPath(rel) != "" {
+			excludedPaths = append(excludedPaths, rel)
+			continue
+		}
+
+		if reason != "" {
+			excluded = append(excluded, &ExcludedFile{rel, reason})
+			continue
+		}
+
+		exists, isDir, err := files.lstat(rel)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		// the file was removed, it is enough that the path shadows it.
+		if !exists || isDir {
+			continue
+		}
+
+		p, err := files.ignored(rel)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if p != "" {
+			ignoredPaths = append(ignoredPaths, p)
+			continue
+		}
+
+		reason, err = files.add(ix, rel)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if reason != "" {
+			excluded = append(excluded, &ExcludedFile{rel, reason})
+		}
+	}
+
+	return excluded, excludedPaths, ignoredPaths, nil
+}
+
+// The files of a working directory, whose contents are written to the store of
+// the index.
+type dirSource struct {
+	src     string
+	store   storeWriter
+	matcher *ignore.Matcher
+}
+
+func newDirSource(opt *IndexOptions, dst, src string) (*dirSource, error) {
+	// Resolve the symbolic link
+	if fi, err := os.Stat(src); err == nil && fi.Mode()|os.ModeSymlink != 0 {
+		if s, err := os.Readlink(src); err == nil {
+			src = s
+		}
+	}
+
+	store, err := newStoreWriter(opt, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dirSource{
+		src:     src,
+		store:   store,
+		matcher: ignore.New(opt.IgnoreFiles...),
+	}, nil
+}
+
+func (d *dirSource) lstat(rel string) (bool, bool, error) {
+	info, err := os.Lstat(filepath.Join(d.src, rel))
+	if os.IsNotExist(err) {
+		return false, false, nil
+	} else if err != nil {
+		return false, false, err
+	}
+	return true, info.IsDir(), nil
+}
+
+func (d *dirSource) ignored(rel string) (string, error) {
+	return d.matcher.Ignored(d.src, rel, false)
+}
+
+func (d *dirSource) add(ix *index.IndexWriter, rel string) (string, error) {
+	path := filepath.Join(d.src, rel)
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+
+	reason, err := checkFile(path, info)
+	if err != nil || reason != "" {
+		return reason, err
+	}
+
+	return addFileToIndex(ix, d.store, d.src, path)
+}
+
+// The contents of the files that were added were written to the store by add,
+// and the others are copied from base.
+func (d *dirSource) finish(dst string, base *IndexRef, kept []string) error {
+	if err := keepContents(d.store, base, kept); err != nil {
+		return err
+	}
+	return d.store.close()
+}
+
+func (d *dirSource) close() error {
+	return d.store.close()
+}
+
+// Read all file names from the trigram index in the given file. The names must
+// be in sorted order for the index to be merged, which is not the case for
+// indexes that were built before names were sorted.
+func readNames(file string) ([]string, error) {
+	ix := index.Open(file)
+	defer ix.Close()
+
+	n := ix.NumNames()
+	names := make([]string, n)
+	for i := 0; i < n; i++ {
+		names[i] = ix.Name(uint32(i))
+		if i > 0 && names[i] < names[i-1] {
+			return nil, errUnsortedIndex
+		}
+	}
+
+	return names, nil
+}
+
+// Determine the sorted list of paths that must be written to the delta index. When
+// indexes are merged, a path in the delta shadows every name in the base that has
+// the path as a prefix (see codesearch/index/merge.go), so any such name has to be
+// added to the delta as well, even though the file itself did not change.
+func shadowedPaths(names, changed []string) []string {
+	set := map[string]bool{}
+	work := make([]string, 0, len(changed))
+	for _, path := range changed {
+		if path != "" && !set[path] {
+			set[path] = true
+			work = append(work, path)
+		}
+	}
+
+	for len(work) > 0 {
+		path := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		for i := sort.SearchStrings(names, path); i < len(names); i++ {
+			if !strings.HasPrefix(names[i], path) {
+				break
+			}
+
+			if !set[names[i]] {
+				set[names[i]] = true
+				work = append(work, names[i])
+			}
+		}
+	}
+
+	paths := make([]string, 0, len(set))
+	for path := range set {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Apply the same name based rules that indexAllFiles uses to a path relative to the
+// root of the source tree. skip is true if the path is in a directory that is never
+// walked, otherwise a non-empty reason indicates that the file is excluded.
+func filterPath(opt *IndexOptions, rel string) (bool, string) {
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i, part := range parts {
+		if containsString(opt.SpecialFiles, part) {
+			return true, ""
+		}
+
+		if opt.ExcludeDotFiles && part != "" && part[0] == '.' {
+			if i == len(parts)-1 {
+				return false, reasonDotFile
+			}
+			return true, ""
+		}
+	}
+	return false, ""
+}
+
+// Merge the trigram index in src2 on top of the one in src1. The codesearch merge
+// panics on inconsistent input, which is turned into an error here.
+func mergeIndexes(dst, src1, src2 string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("index merge failed: %v", r)
+		}
+	}()
+
+	index.Merge(dst, src1, src2)
+	return nil
+}
+
+func containsSorted(haystack []string, needle string) bool {
+	i := sort.SearchStrings(haystack, needle)
+	return i < len(haystack) && haystack[i] == needle
+}
+
+// Hard link src to dst, falling back to a copy if links are not possible.
+func linkOrCopyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// read the list of excluded files from the given filename.
+func readExcludedFilesJson(filename string) ([]*ExcludedFile, error) {
+	r, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var files []*ExcludedFile
+	if err := json.NewDecoder(r).Decode(&files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
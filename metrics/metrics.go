@@ -0,0 +1,293 @@
+// Package metrics is a small implementation of counters, histograms and gauges
+// that are served in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Buckets for histograms of durations in seconds.
+var DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Buckets for histograms of counts, such as the number of files opened.
+var CountBuckets = []float64{0, 1, 5, 10, 50, 100, 500, 1000, 5000, 10000}
+
+type metric interface {
+	writeTo(w *bufio.Writer)
+}
+
+// All metrics by name. Registering a metric with a name that is already taken
+// replaces the existing metric.
+var (
+	registry    = map[string]metric{}
+	registryLck sync.Mutex
+)
+
+func register(name string, m metric) {
+	registryLck.Lock()
+	defer registryLck.Unlock()
+	registry[name] = m
+}
+
+// Write all metrics, sorted by name, in the text exposition format.
+func Write(w io.Writer) error {
+	registryLck.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	metrics := make([]metric, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		metrics[i] = registry[name]
+	}
+	registryLck.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.writeTo(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serves all metrics in the text exposition format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w) //nolint
+	})
+}
+
+// The description of a metric. Samples are keyed by their label values joined
+// with a NUL.
+type series struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (s *series) key(values []string) string {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d",
+			s.name, len(s.labels), len(values)))
+	}
+	return strings.Join(values, "\x00")
+}
+
+func (s *series) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", s.name, escapeHelp(s.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", s.name, s.typ)
+}
+
+// Write a sample with the labels given by key plus any extra label pairs.
+func (s *series) writeSample(w *bufio.Writer, name, key string, v float64, extra ...string) {
+	var pairs []string
+	if len(s.labels) > 0 {
+		for i, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, s.labels[i], value)
+		}
+	}
+	pairs = append(pairs, extra...)
+
+	w.WriteString(name)
+	if len(pairs) > 0 {
+		w.WriteByte('{')
+		for i := 0; i < len(pairs); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", pairs[i], escapeLabel(pairs[i+1]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A CounterVec is a set of counters, one for each combination of label values.
+type CounterVec struct {
+	series
+	lck  sync.Mutex
+	vals map[string]float64
+}
+
+// Create and register a counter with the given label names.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		series: series{name, help, "counter", labels},
+		vals:   map[string]float64{},
+	}
+	register(name, c)
+	return c
+}
+
+// Increment the counter for the given label values by one.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Increment the counter for the given label values by v, which must not be
+// negative.
+func (c *CounterVec) Add(v float64, values ...string) {
+	k := c.key(values)
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.vals[k] += v
+}
+
+func (c *CounterVec) writeTo(w *bufio.Writer) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	c.writeHeader(w)
+	for _, k := range sortedKeys(c.vals) {
+		c.writeSample(w, c.name, k, c.vals[k])
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// A HistogramVec is a set of histograms, one for each combination of label
+// values, that share the same buckets.
+type HistogramVec struct {
+	series
+	buckets []float64
+	lck     sync.Mutex
+	vals    map[string]*histogram
+}
+
+// Create and register a histogram with the given upper bounds of its buckets,
+// which must be sorted, and label names.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		series:  series{name, help, "histogram", labels},
+		buckets: buckets,
+		vals:    map[string]*histogram{},
+	}
+	register(name, h)
+	return h
+}
+
+// Record an observation of v in the histogram for the given label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	k := h.key(values)
+	h.lck.Lock()
+	defer h.lck.Unlock()
+
+	hist := h.vals[k]
+	if hist == nil {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.vals[k] = hist
+	}
+
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *HistogramVec) writeTo(w *bufio.Writer) {
+	h.lck.Lock()
+	defer h.lck.Unlock()
+
+	keys := make([]string, 0, len(h.vals))
+	for k := range h.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h.writeHeader(w)
+	for _, k := range keys {
+		hist := h.vals[k]
+
+		// buckets are cumulative in the exposition format
+		var n uint64
+		for i, le := range h.buckets {
+			n += hist.counts[i]
+			h.writeSample(w, h.name+"_bucket", k, float64(n), "le", formatFloat(le))
+		}
+		h.writeSample(w, h.name+"_bucket", k, float64(hist.count), "le", "+Inf")
+		h.writeSample(w, h.name+"_sum", k, hist.sum)
+		h.writeSample(w, h.name+"_count", k, float64(hist.count))
+	}
+}
+
+// A GaugeFunc is a set of gauges whose values are collected each time the
+// metrics are written.
+type GaugeFunc struct {
+	series
+	collect func(set func(v float64, values ...string))
+}
+
+// Create and register a gauge with the given label names. collect is called
+// when the metrics are written and should call set for each combination of
+// label values.
+func NewGaugeFunc(name, help string, labels []string, collect func(set func(v float64, values ...string))) *GaugeFunc {
+	g := &GaugeFunc{
+		series:  series{name, help, "gauge", labels},
+		collect: collect,
+	}
+	register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) writeTo(w *bufio.Writer) {
+	vals := map[string]float64{}
+	g.collect(func(v float64, values ...string) {
+		vals[g.key(values)] = v
+	})
+
+	g.writeHeader(w)
+	for _, k := range sortedKeys(vals) {
+		g.writeSample(w, g.name, k, vals[k])
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func write(t *testing.T) string {
+	var buf bytes.Buffer
+	if err := Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("test_counter_total", "A test counter.", "repo")
+	c.Inc("a")
+	c.Add(2, "a")
+	c.Inc(`b"c`)
+
+	out := write(t)
+	for _, line := range []string{
+		"# HELP test_counter_total A test counter.",
+		"# TYPE test_counter_total counter",
+		`test_counter_total{repo="a"} 3`,
+		`test_counter_total{repo="b\"c"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected %q in output:\n%s", line, out)
+		}
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("test_histogram", "A test histogram.", []float64{1, 5}, "repo")
+	h.Observe(0.5, "a")
+	h.Observe(1, "a")
+	h.Observe(3, "a")
+	h.Observe(10, "a")
+
+	out := write(t)
+	for _, line := range []string{
+		"# TYPE test_histogram histogram",
+		`test_histogram_bucket{repo="a",le="1"} 2`,
+		`test_histogram_bucket{repo="a",le="5"} 3`,
+		`test_histogram_bucket{repo="a",le="+Inf"} 4`,
+		`test_histogram_sum{repo="a"} 14.5`,
+		`test_histogram_count{repo="a"} 4`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected %q in output:\n%s", line, out)
+		}
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	NewGaugeFunc("test_gauge", "A test gauge.", nil, func(set func(float64, ...string)) {
+		set(42)
+	})
+
+	out := write(t)
+	if !strings.Contains(out, "# TYPE test_gauge gauge\ntest_gauge 42\n") {
+		t.Errorf("expected gauge in output:\n%s", out)
+	}
+}
@@ -0,0 +1,172 @@
+package searcher
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/hound-search/hound/index"
+	"github.com/hound-search/hound/vcs"
+)
+
+// The commit history is stored next to the index of the rev it leads up to,
+// so that it is reclaimed and removed along with the index.
+const commitsFilename = "commits.gob.gz"
+
+// Returned when searching the history of a repo whose history is not kept.
+var ErrNoHistory = errors.New("commit history is not indexed")
+
+type CommitSearchOptions struct {
+	// Matched against the commit message.
+	MessageRegexp string
+
+	// Matched against the author's name and email.
+	AuthorRegexp string
+
+	// Only commits that touched a path matching FileRegexp, and not only
+	// paths matching ExcludeFileRegexp, are returned.
+	FileRegexp        string
+	ExcludeFileRegexp string
+
+	IgnoreCase bool
+	Offset     int
+	Limit      int
+}
+
+type CommitSearchResponse struct {
+	Matches []*vcs.Commit
+
+	// The number of matching commits, of which Matches holds the ones
+	// between Offset and Limit.
+	Total    int
+	Revision string
+}
+
+func writeCommits(dir string, commits []*vcs.Commit) error {
+	w, err := os.Create(filepath.Join(dir, commitsFilename))
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	gz := gzip.NewWriter(w)
+	if err := gob.NewEncoder(gz).Encode(commits); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func readCommits(dir string) ([]*vcs.Commit, error) {
+	r, err := os.Open(filepath.Join(dir, commitsFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var commits []*vcs.Commit
+	if err := gob.NewDecoder(gz).Decode(&commits); err != nil {
+		return nil, err
+	}
+	return commits, nil
+}
+
+// Get the history that leads up to the rev of the index, reading it from the
+// index directory if it was stored there before and asking the vcs otherwise.
+// Returns nil if the vcs does not keep the history.
+func commitsFor(wd *vcs.WorkDir, vcsDir string, idx *index.Index) ([]*vcs.Commit, error) {
+	if commits, err := readCommits(idx.GetDir()); err == nil {
+		return commits, nil
+	}
+
+	commits, err := wd.Log(vcsDir, idx.Ref.Rev)
+	if err != nil || commits == nil {
+		return nil, err
+	}
+
+	if err := writeCommits(idx.GetDir(), commits); err != nil {
+		return nil, err
+	}
+	return commits, nil
+}
+
+// Compile a regexp from the search options, or return nil if it is empty.
+func compileOpt(pat string, ignoreCase bool) (*regexp.Regexp, error) {
+	if pat == "" {
+		return nil, nil
+	}
+
+	if ignoreCase {
+		pat = "(?i)" + pat
+	}
+	return regexp.Compile(pat)
+}
+
+// Does any of the paths match re but not exclude?
+func matchesPaths(paths []string, re, exclude *regexp.Regexp) bool {
+	for _, path := range paths {
+		if re != nil && !re.MatchString(path) {
+			continue
+		}
+		if exclude != nil && exclude.MatchString(path) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Find the commits that match the options, newest first.
+func searchCommits(commits []*vcs.Commit, opt *CommitSearchOptions) (*CommitSearchResponse, error) {
+	msgRe, err := compileOpt(opt.MessageRegexp, opt.IgnoreCase)
+	if err != nil {
+		return nil, err
+	}
+
+	authorRe, err := compileOpt(opt.AuthorRegexp, opt.IgnoreCase)
+	if err != nil {
+		return nil, err
+	}
+
+	fileRe, err := compileOpt(opt.FileRegexp, opt.IgnoreCase)
+	if err != nil {
+		return nil, err
+	}
+
+	excludeRe, err := compileOpt(opt.ExcludeFileRegexp, opt.IgnoreCase)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &CommitSearchResponse{
+		Matches: []*vcs.Commit{},
+	}
+	for _, c := range commits {
+		if msgRe != nil && !msgRe.MatchString(c.Message) {
+			continue
+		}
+
+		if authorRe != nil && !authorRe.MatchString(c.Author) && !authorRe.MatchString(c.Email) {
+			continue
+		}
+
+		if (fileRe != nil || excludeRe != nil) && !matchesPaths(c.Paths, fileRe, excludeRe) {
+			continue
+		}
+
+		if res.Total >= opt.Offset && (opt.Limit <= 0 || len(res.Matches) < opt.Limit) {
+			res.Matches = append(res.Matches, c)
+		}
+		res.Total++
+	}
+
+	return res, nil
+}
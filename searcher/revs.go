@@ -0,0 +1,315 @@
+package searcher
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/index"
+)
+
+// The state of an index of a revision, like a tag, that was requested on
+// demand. Rev is the commit that the requested revision resolved to.
+type RevStatus struct {
+	Name  string
+	Phase Phase
+	Error string `json:",omitempty"`
+	IndexStatus
+	LastUsed time.Time
+}
+
+type revKey struct {
+	s    *Searcher
+	name string
+}
+
+// An index of a revision in the cache.
+type revEntry struct {
+	key  revKey
+	elem *list.Element
+
+	// Guarded by the cache's lock.
+	status  RevStatus
+	evicted bool
+
+	// Guards idx so that it is not destroyed during a search.
+	lck sync.RWMutex
+	idx *index.Index
+}
+
+// The indexes of revisions that were requested on demand. They are kept until
+// they have not been searched for the ttl or until the cache holds more than
+// max indexes, in which case the least recently used are evicted first.
+type revCache struct {
+	lck     sync.Mutex
+	max     int
+	ttl     time.Duration
+	lru     *list.List
+	entries map[revKey]*revEntry
+	sweeper sync.Once
+}
+
+var revIdxs = newRevCache(config.DefaultMaxRevIndexes,
+	config.DefaultRevIndexTtlMs*time.Millisecond)
+
+func newRevCache(max int, ttl time.Duration) *revCache {
+	return &revCache{
+		max:     max,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: map[revKey]*revEntry{},
+	}
+}
+
+// Set the limits of the cache of revision indexes.
+func SetRevIndexLimits(max int, ttl time.Duration) {
+	revIdxs.lck.Lock()
+	defer revIdxs.lck.Unlock()
+	revIdxs.max = max
+	revIdxs.ttl = ttl
+}
+
+// Generate a new directory for an index of a revision, or for the worktree it
+// is built from, in the dbpath.
+func nextRevDir(dbpath, prefix string) string {
+	r := uint64(rand.Uint32())<<32 | uint64(rand.Uint32())
+	return filepath.Join(dbpath, fmt.Sprintf("%s-%08x", prefix, r))
+}
+
+// Remove the indexes and worktrees of revisions that were left in the dbpath
+// by a previous run.
+func removeRevDirs(dbpath string) error {
+	for _, pattern := range []string{"rev-*", "wt-*"} {
+		dirs, err := filepath.Glob(filepath.Join(dbpath, pattern))
+		if err != nil {
+			return err
+		}
+
+		for _, dir := range dirs {
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Evict the entry. Its index is destroyed once searches using it are done, or
+// once it is built. The caller must hold the cache's lock.
+func (c *revCache) evict(e *revEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.key)
+	e.evicted = true
+
+	go e.destroy()
+}
+
+func (e *revEntry) destroy() {
+	e.lck.Lock()
+	defer e.lck.Unlock()
+
+	if e.idx == nil {
+		return
+	}
+
+	if err := e.idx.Destroy(); err != nil {
+		log.Printf("failed to destroy index (%s@%s): %s", e.key.s.Repo.Url, e.key.name, err)
+	}
+	e.idx = nil
+}
+
+// Evict the entries that have expired and, while there are too many, the
+// least recently used ones that are not being built. The caller must hold the
+// cache's lock.
+func (c *revCache) evictUnused() {
+	now := time.Now()
+	for el := c.lru.Back(); el != nil; {
+		e := el.Value.(*revEntry)
+		el = el.Prev()
+
+		if e.status.Phase != PhaseReady && e.status.Phase != PhaseFailed {
+			continue
+		}
+
+		if c.lru.Len() > c.max || now.Sub(e.status.LastUsed) > c.ttl {
+			c.evict(e)
+		}
+	}
+}
+
+// Periodically evict expired entries, so that indexes which are not searched
+// again are removed from disk.
+func (c *revCache) sweep() {
+	for range time.Tick(time.Minute) {
+		c.lck.Lock()
+		c.evictUnused()
+		c.lck.Unlock()
+	}
+}
+
+// Get the entry of a revision of the searcher, along with its status, and mark
+// it as used. This returns false if there is none. The caller must hold the
+// cache's lock.
+func (c *revCache) get(s *Searcher, name string) (*revEntry, RevStatus, bool) {
+	e, ok := c.entries[revKey{s, name}]
+	if !ok {
+		return nil, RevStatus{}, false
+	}
+
+	e.status.LastUsed = time.Now()
+	c.lru.MoveToFront(e.elem)
+	return e, e.status, true
+}
+
+// Add an entry for a revision that is about to be built, unless there already
+// is one that has not failed. Returns the status of the entry and the entry if
+// it was added.
+func (c *revCache) add(s *Searcher, name string) (RevStatus, *revEntry) {
+	c.sweeper.Do(func() {
+		go c.sweep()
+	})
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	if e, status, ok := c.get(s, name); ok {
+		if status.Phase != PhaseFailed {
+			return status, nil
+		}
+		c.evict(e)
+	}
+
+	e := &revEntry{
+		key: revKey{s, name},
+		status: RevStatus{
+			Name:     name,
+			Phase:    PhaseQueued,
+			LastUsed: time.Now(),
+		},
+	}
+	e.elem = c.lru.PushFront(e)
+	c.entries[e.key] = e
+
+	c.evictUnused()
+
+	return e.status, e
+}
+
+// Record the phase of an entry that is being built.
+func (c *revCache) setPhase(e *revEntry, phase Phase) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	e.status.Phase = phase
+}
+
+// Record the outcome of building the index of an entry. If the entry was
+// evicted in the meantime, the index is destroyed.
+func (c *revCache) built(e *revEntry, idx *index.Index, d time.Duration, err error) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	if e.evicted {
+		if idx != nil {
+			if err := idx.Destroy(); err != nil {
+				log.Printf("failed to destroy index (%s@%s): %s", e.key.s.Repo.Url, e.key.name, err)
+			}
+		}
+		return
+	}
+
+	// Entries are not evicted while they are being built, so the cache may
+	// have grown past its limit in the meantime.
+	defer c.evictUnused()
+
+	if err != nil {
+		e.status.Phase = PhaseFailed
+		e.status.Error = err.Error()
+		return
+	}
+
+	size, err := idx.Size()
+	if err != nil {
+		log.Printf("failed to get index size (%s@%s): %s", e.key.s.Repo.Url, e.key.name, err)
+	}
+
+	e.lck.Lock()
+	e.idx = idx
+	e.lck.Unlock()
+
+	e.status.Phase = PhaseReady
+	e.status.IndexStatus = IndexStatus{
+		Rev:           idx.Ref.Rev,
+		IndexedAt:     idx.Ref.Time,
+		BuildDuration: int(d.Nanoseconds() / 1e6),
+		Files:         idx.NumFiles(),
+		IndexSize:     size,
+	}
+}
+
+// Search the index of a revision of the searcher.
+func (c *revCache) search(
+	ctx context.Context,
+	s *Searcher,
+	name,
+	pat string,
+	opt *index.SearchOptions) (*index.SearchResponse, error) {
+	c.lck.Lock()
+	e, status, ok := c.get(s, name)
+	c.lck.Unlock()
+	if !ok {
+		return nil, ErrNoSuchRef
+	}
+
+	e.lck.RLock()
+	defer e.lck.RUnlock()
+
+	if e.idx == nil {
+		switch status.Phase {
+		case PhaseFailed:
+			return nil, fmt.Errorf("indexing %s failed: %s", name, status.Error)
+		case PhaseReady:
+			return nil, ErrNoSuchRef
+		}
+		return nil, fmt.Errorf("%s is still being indexed", name)
+	}
+
+	return e.idx.Search(ctx, pat, opt)
+}
+
+// The status of each revision index of the searcher, sorted by name.
+func (c *revCache) list(s *Searcher) []RevStatus {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	res := []RevStatus{}
+	for key, e := range c.entries {
+		if key.s == s {
+			res = append(res, e.status)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// Evict every revision index of the searcher.
+func (c *revCache) removeAll(s *Searcher) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	for key, e := range c.entries {
+		if key.s == s {
+			c.evict(e)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package searcher
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hound-search/hound/config"
+)
+
+// The names of the revisions in the cache.
+func cachedRevs(c *revCache) []string {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	var names []string
+	for key := range c.entries {
+		names = append(names, key.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func expectRevs(t *testing.T, c *revCache, expected ...string) {
+	t.Helper()
+	got := cachedRevs(c)
+	if !equalStrings(got, expected) {
+		t.Errorf("expected revs %v, got %v", expected, got)
+	}
+}
+
+// Add an entry for the revision that is done building, without an index.
+func addBuilt(c *revCache, s *Searcher, name string) *revEntry {
+	_, e := c.add(s, name)
+	c.built(e, nil, 0, errors.New("no index"))
+	return e
+}
+
+func newRevSearcher() *Searcher {
+	return &Searcher{Repo: &config.Repo{Url: "test://repo"}}
+}
+
+func TestRevCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newRevCache(2, time.Hour)
+	s := newRevSearcher()
+
+	addBuilt(c, s, "a")
+	addBuilt(c, s, "b")
+
+	c.lck.Lock()
+	c.get(s, "a")
+	c.lck.Unlock()
+
+	addBuilt(c, s, "c")
+	expectRevs(t, c, "a", "c")
+}
+
+func TestRevCacheEvictsExpired(t *testing.T) {
+	c := newRevCache(10, time.Hour)
+	s := newRevSearcher()
+
+	a := addBuilt(c, s, "a")
+	addBuilt(c, s, "b")
+
+	c.lck.Lock()
+	a.status.LastUsed = time.Now().Add(-2 * time.Hour)
+	c.evictUnused()
+	c.lck.Unlock()
+
+	expectRevs(t, c, "b")
+}
+
+func TestRevCacheKeepsEntriesBeingBuilt(t *testing.T) {
+	c := newRevCache(1, time.Hour)
+	s := newRevSearcher()
+
+	_, a := c.add(s, "a")
+	_, b := c.add(s, "b")
+
+	c.lck.Lock()
+	a.status.LastUsed = time.Now().Add(-2 * time.Hour)
+	c.evictUnused()
+	c.lck.Unlock()
+
+	expectRevs(t, c, "a", "b")
+
+	// Once a is built the cache is back within its limit by evicting it,
+	// since b was used more recently.
+	c.built(a, nil, 0, errors.New("no index"))
+	expectRevs(t, c, "b")
+
+	c.built(b, nil, 0, errors.New("no index"))
+	expectRevs(t, c, "b")
+}
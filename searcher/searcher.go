@@ -1,8 +1,10 @@
 package searcher
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -10,18 +12,32 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hound-search/hound/config"
 	"github.com/hound-search/hound/index"
+	"github.com/hound-search/hound/metrics"
 	"github.com/hound-search/hound/vcs"
 )
 
 type Searcher struct {
-	idx  *index.Index
-	lck  sync.RWMutex
-	Repo *config.Repo
+	// The index of each indexed ref, in the order of refs. The first ref is
+	// the default that is searched when no ref is given. Repos that index
+	// their working directory as it is pulled have a single, empty ref.
+	idxs map[string]*index.Index
+	refs []string
+
+	// The commit history leading up to each index, for repos whose vcs
+	// keeps the history.
+	commits map[string][]*vcs.Commit
+
+	lck    sync.RWMutex
+	Repo   *config.Repo
+	dbpath string
+	vcsDir string
+	wd     *vcs.WorkDir
 
 	// The channel is used to request updates from the API and
 	// to signal that it is ok for searchers to begin polling.
@@ -29,9 +45,48 @@ type Searcher struct {
 	// update at a time.
 	updateCh chan time.Time
 
-	shutdownRequested bool
-	shutdownCh        chan empty
-	doneCh            chan empty
+	// Closed by Stop, which may be called more than once.
+	shutdownCh   chan empty
+	shutdownOnce sync.Once
+	doneCh       chan empty
+
+	// Held for each poll, by RebuildAsync to keep the searcher from polling
+	// while a new searcher uses its vcs directory and while a worktree of a
+	// revision is added to it.
+	pollLck sync.Mutex
+
+	status    Status
+	statusLck sync.Mutex
+}
+
+// The state of one of a searcher's indexes. Durations are in milliseconds.
+type IndexStatus struct {
+	Rev           string
+	IndexedAt     time.Time
+	BuildDuration int
+	Files         int
+	IndexSize     int64
+}
+
+// The state of a searcher's default index and the outcome of its most recent
+// poll of the repo.
+type Status struct {
+	IndexStatus
+	LastPoll    time.Time
+	LastSuccess time.Time
+	LastError   string `json:",omitempty"`
+
+	// Set when the last poll failed, so the index may be behind the repo.
+	Stale bool
+
+	// The vcs command that made the last poll fail, if it was one.
+	LastCommandError *vcs.CommandError `json:",omitempty"`
+
+	// The number of polls in a row that failed.
+	Failures int `json:",omitempty"`
+
+	// The state of the index of each ref, for repos that index several refs.
+	Refs map[string]IndexStatus `json:",omitempty"`
 }
 
 // Struct used to send the results from newSearcherConcurrent function.
@@ -43,6 +98,66 @@ type searcherResult struct {
 	err      error
 }
 
+// The combined size of the indexes of all refs.
+func (s *Status) TotalIndexSize() int64 {
+	if len(s.Refs) == 0 {
+		return s.IndexSize
+	}
+
+	var size int64
+	for _, st := range s.Refs {
+		size += st.IndexSize
+	}
+	return size
+}
+
+var errDestroyed = errors.New("searcher has been destroyed")
+
+// The bounds of the delay before polling a repo again after a failed poll, see
+// retryDelay.
+const (
+	minRetryDelay = 10 * time.Second
+	maxRetryDelay = 30 * time.Minute
+)
+
+// Returned when searching a ref that the searcher does not index.
+var ErrNoSuchRef = errors.New("ref is not indexed")
+
+// The phases a searcher goes through as it is created in the background.
+type Phase string
+
+const (
+	PhaseQueued   Phase = "queued"
+	PhaseCloning  Phase = "cloning"
+	PhaseIndexing Phase = "indexing"
+	PhaseReady    Phase = "ready"
+	PhaseFailed   Phase = "failed"
+)
+
+// The limiter that bounds the number of concurrent clones and index builds.
+// MakeAll sizes it from cfg.MaxConcurrentIndexers, and searchers that are
+// created later with New or NewAsync share it.
+var (
+	sharedLim    limiter
+	sharedLimLck sync.Mutex
+)
+
+var (
+	indexBuildSeconds = metrics.NewHistogramVec(
+		"hound_index_build_duration_seconds",
+		"Time taken to build an index.",
+		metrics.DurationBuckets,
+		"repo")
+	indexBuildFailures = metrics.NewCounterVec(
+		"hound_index_build_failures_total",
+		"Number of index builds that failed.",
+		"repo")
+	pollErrors = metrics.NewCounterVec(
+		"hound_poll_errors_total",
+		"Number of failed pulls or clones of a repo.",
+		"vcs")
+)
+
 type empty struct{}
 type limiter chan bool
 
@@ -60,6 +175,23 @@ func makeLimiter(n int) limiter {
 	return limiter(make(chan bool, n))
 }
 
+// Replace the shared limiter with one that allows n concurrent operations.
+func setSharedLimiter(n int) limiter {
+	sharedLimLck.Lock()
+	defer sharedLimLck.Unlock()
+	sharedLim = makeLimiter(n)
+	return sharedLim
+}
+
+func sharedLimiter() limiter {
+	sharedLimLck.Lock()
+	defer sharedLimLck.Unlock()
+	if sharedLim == nil {
+		sharedLim = makeLimiter(1)
+	}
+	return sharedLim
+}
+
 func (l limiter) Acquire() {
 	l <- true
 }
@@ -69,27 +201,42 @@ func (l limiter) Release() {
 }
 
 /**
- * Find an Index ref for the repo url and rev, returns nil if no such
- * ref exists.
+ * Find an unclaimed Index ref for the repo url and rev and claim it for
+ * reuse, which ensures the ref will not be garbage collected at the end
+ * of startup. Returns nil if no such ref exists. Several branches can be
+ * at the same rev, so each ref is only handed out once. Indexes that were
+ * built with other include or exclude paths, from a tree when opt has none
+ * or the other way around, or with another content store, are not reused.
  */
-func (r *foundRefs) find(url, rev string) *index.IndexRef {
+func (r *foundRefs) claimFor(repo *config.Repo, rev string, opt *index.IndexOptions) *index.IndexRef {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
 	for _, ref := range r.refs {
-		if ref.Url == url && ref.Rev == rev {
+		if ref.Url == repo.Url && ref.Rev == rev && !r.claimed[ref] &&
+			ref.FromTree == (opt.Tree != nil) &&
+			ref.Store == opt.Store && ref.Compression == opt.Compression &&
+			equalStrings(ref.IncludePaths, repo.IncludePaths) &&
+			equalStrings(ref.ExcludePaths, repo.ExcludePaths) {
+			r.claimed[ref] = true
 			return ref
 		}
 	}
 	return nil
 }
 
-/**
- * Claim a ref for reuse. This ensures they ref will not be garbage
- * collected at the end of startup.
- */
-func (r *foundRefs) claim(ref *index.IndexRef) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
+// Do a and b hold the same strings in the same order?
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
 
-	r.claimed[ref] = true
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 /**
@@ -112,32 +259,238 @@ func (r *foundRefs) removeUnclaimed() error {
 	return nil
 }
 
-// Perform atomic swap of index in the searcher so that the new
-// index is made "live".
-func (s *Searcher) swapIndexes(idx *index.Index) error {
+// Perform atomic swap of the index of a ref, and the commit history that leads
+// up to it, in the searcher so that the new index is made "live".
+func (s *Searcher) swapIndexes(ref string, idx *index.Index, commits []*vcs.Commit) error {
 	s.lck.Lock()
 	defer s.lck.Unlock()
 
-	oldIdx := s.idx
-	s.idx = idx
+	oldIdx := s.idxs[ref]
+	s.idxs[ref] = idx
+	s.setCommits(ref, commits)
 
+	if oldIdx == nil {
+		return nil
+	}
 	return oldIdx.Destroy()
 }
 
+// Set the refs that are indexed, in order, and return the indexes of the refs
+// that are no longer indexed so they can be destroyed.
+func (s *Searcher) setRefs(refs []string) []*index.Index {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	keep := map[string]bool{}
+	for _, ref := range refs {
+		keep[ref] = true
+	}
+
+	var removed []*index.Index
+	for ref, idx := range s.idxs {
+		if !keep[ref] {
+			removed = append(removed, idx)
+			delete(s.idxs, ref)
+			delete(s.commits, ref)
+			s.refRemoved(ref)
+		}
+	}
+
+	s.refs = refs
+	return removed
+}
+
+// Set the commit history of a ref, or forget it if commits is nil. The caller
+// must hold the lock.
+func (s *Searcher) setCommits(ref string, commits []*vcs.Commit) {
+	if commits == nil {
+		delete(s.commits, ref)
+		return
+	}
+
+	if s.commits == nil {
+		s.commits = map[string][]*vcs.Commit{}
+	}
+	s.commits[ref] = commits
+}
+
+// The ref itself, or the default ref if ref is empty. The caller must hold
+// the lock.
+func (s *Searcher) resolveRef(ref string) string {
+	if ref == "" && len(s.refs) > 0 {
+		return s.refs[0]
+	}
+	return ref
+}
+
+// The index of the ref, or of the default ref if ref is empty. The caller
+// must hold the lock.
+func (s *Searcher) indexFor(ref string) (*index.Index, error) {
+	if s.idxs == nil {
+		return nil, errDestroyed
+	}
+
+	idx := s.idxs[s.resolveRef(ref)]
+	if idx == nil {
+		return nil, ErrNoSuchRef
+	}
+	return idx, nil
+}
+
+// The refs that are indexed, with the default first, or nil if the searcher
+// indexes the working directory as it is pulled.
+func (s *Searcher) Refs() []string {
+	s.lck.RLock()
+	defer s.lck.RUnlock()
+
+	if len(s.refs) == 1 && s.refs[0] == "" {
+		return nil
+	}
+	return append([]string(nil), s.refs...)
+}
+
 // Perform a basic search on the current index using the supplied pattern
 // and the options.
 //
 // TODO(knorton): pat should really just be a part of SearchOptions
-func (s *Searcher) Search(pat string, opt *index.SearchOptions) (*index.SearchResponse, error) {
+func (s *Searcher) Search(ctx context.Context, pat string, opt *index.SearchOptions) (*index.SearchResponse, error) {
+	return s.SearchRef(ctx, "", pat, opt)
+}
+
+// Search the index of the given ref, or of the default ref if ref is empty. A
+// ref that is not one of the indexed refs is looked up among the revisions that
+// were indexed with IndexRev.
+func (s *Searcher) SearchRef(ctx context.Context, ref, pat string, opt *index.SearchOptions) (*index.SearchResponse, error) {
+	s.lck.RLock()
+	idx, err := s.indexFor(ref)
+	if err == ErrNoSuchRef && ref != "" {
+		s.lck.RUnlock()
+		return revIdxs.search(ctx, s, ref, pat, opt)
+	}
+	defer s.lck.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return idx.Search(ctx, pat, opt)
+}
+
+// Search the commit history that leads up to the given ref, or to the default
+// ref if ref is empty.
+func (s *Searcher) SearchCommits(ref string, opt *CommitSearchOptions) (*CommitSearchResponse, error) {
+	s.lck.RLock()
+	defer s.lck.RUnlock()
+
+	idx, err := s.indexFor(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	commits, ok := s.commits[s.resolveRef(ref)]
+	if !ok {
+		return nil, ErrNoHistory
+	}
+
+	res, err := searchCommits(commits, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	res.Revision = idx.Ref.Rev
+	return res, nil
+}
+
+// Does the searcher have the commit history of its repo?
+func (s *Searcher) HasHistory() bool {
 	s.lck.RLock()
 	defer s.lck.RUnlock()
-	return s.idx.Search(pat, opt)
+	return len(s.commits) > 0
+}
+
+// Request an index of a revision of the repo, such as a tag, which is built
+// in the background from a separate worktree. Once it is ready, the revision
+// can be passed as the ref to SearchRef. Indexes of revisions are evicted when
+// they have not been searched for a while or when too many were requested.
+func (s *Searcher) IndexRev(rev string) (RevStatus, error) {
+	if rev == "" || strings.HasPrefix(rev, "-") {
+		return RevStatus{}, fmt.Errorf("invalid revision: %q", rev)
+	}
+
+	if _, ok := s.wd.Driver.(vcs.WorktreeDriver); !ok {
+		return RevStatus{}, fmt.Errorf("%s repos do not support indexing revisions", s.Repo.Vcs)
+	}
+
+	status, e := revIdxs.add(s, rev)
+	if e != nil {
+		go s.buildRevIndex(e)
+	}
+	return status, nil
+}
+
+// The revisions that were requested with IndexRev and have not been evicted.
+func (s *Searcher) Revs() []RevStatus {
+	return revIdxs.list(s)
+}
+
+// Check out the revision of an entry into a worktree and build its index.
+func (s *Searcher) buildRevIndex(e *revEntry) {
+	// The worktree is added from the vcs directory that polls fetch into, so
+	// no poll runs until it is. As with polls, pollLck is taken before the
+	// limiter.
+	s.pollLck.Lock()
+	lim := sharedLimiter()
+	lim.Acquire()
+	defer lim.Release()
+
+	rev := e.key.name
+	revIdxs.setPhase(e, PhaseCloning)
+	wtDir := nextRevDir(s.dbpath, "wt")
+	commit, err := s.wd.AddWorktree(s.vcsDir, wtDir, rev)
+	s.pollLck.Unlock()
+	if err != nil {
+		log.Printf("failed to check out %s of %s: %s", rev, s.Repo.Url, err)
+		os.RemoveAll(wtDir) //nolint
+		revIdxs.built(e, nil, 0, err)
+		return
+	}
+
+	defer func() {
+		if err := s.wd.RemoveWorktree(s.vcsDir, wtDir); err != nil {
+			log.Printf("failed to remove worktree %s: %s", wtDir, err)
+			os.RemoveAll(wtDir) //nolint
+		}
+	}()
+
+	revIdxs.setPhase(e, PhaseIndexing)
+	start := time.Now()
+	idxDir := nextRevDir(s.dbpath, "rev")
+	idx, err := buildAndOpenIndex(
+		indexOptions(s.Repo, s.wd, wtDir),
+		s.dbpath,
+		wtDir,
+		idxDir,
+		s.Repo.Url,
+		commit)
+	if err != nil {
+		log.Printf("failed index build (%s@%s): %s", s.Repo.Url, rev, err)
+		os.RemoveAll(idxDir) //nolint
+	}
+
+	revIdxs.built(e, idx, time.Since(start), err)
 }
 
 // Get the excluded files as a JSON string. This is only used for returning
 // the data directly to clients (thus JSON).
 func (s *Searcher) GetExcludedFiles() string {
-	path := filepath.Join(s.idx.GetDir(), "excluded_files.json")
+	s.lck.RLock()
+	defer s.lck.RUnlock()
+
+	idx, err := s.indexFor("")
+	if err != nil {
+		return ""
+	}
+
+	path := filepath.Join(idx.GetDir(), "excluded_files.json")
 	dat, err := ioutil.ReadFile(path)
 	if err != nil {
 		log.Printf("Couldn't read excluded_files.json %v\n", err)
@@ -145,6 +498,129 @@ func (s *Searcher) GetExcludedFiles() string {
 	return string(dat)
 }
 
+// Get a snapshot of the searcher's status.
+func (s *Searcher) Status() Status {
+	s.statusLck.Lock()
+	defer s.statusLck.Unlock()
+
+	status := s.status
+	if s.status.Refs != nil {
+		status.Refs = make(map[string]IndexStatus, len(s.status.Refs))
+		for ref, st := range s.status.Refs {
+			status.Refs[ref] = st
+		}
+	}
+	return status
+}
+
+// Record a newly built index of a ref, which took d to build, as the one being
+// served.
+func (s *Searcher) indexBuilt(ref string, idx *index.Index, d time.Duration) {
+	size, err := idx.Size()
+	if err != nil {
+		log.Printf("failed to get index size (%s): %s", s.Repo.Url, err)
+	}
+
+	st := IndexStatus{
+		Rev:           idx.Ref.Rev,
+		IndexedAt:     idx.Ref.Time,
+		BuildDuration: int(d.Nanoseconds() / 1e6),
+		Files:         idx.NumFiles(),
+		IndexSize:     size,
+	}
+
+	s.lck.RLock()
+	isDefault := len(s.refs) == 0 || s.refs[0] == ref
+	s.lck.RUnlock()
+
+	s.statusLck.Lock()
+	defer s.statusLck.Unlock()
+	if isDefault {
+		s.status.IndexStatus = st
+	}
+
+	if ref != "" {
+		if s.status.Refs == nil {
+			s.status.Refs = map[string]IndexStatus{}
+		}
+		s.status.Refs[ref] = st
+	}
+}
+
+// Forget the status of a ref that is no longer indexed.
+func (s *Searcher) refRemoved(ref string) {
+	s.statusLck.Lock()
+	defer s.statusLck.Unlock()
+	delete(s.status.Refs, ref)
+}
+
+// Record the outcome of a poll of the repo, err is nil if it succeeded.
+func (s *Searcher) polled(err error) {
+	s.statusLck.Lock()
+	defer s.statusLck.Unlock()
+
+	now := time.Now()
+	s.status.LastPoll = now
+	if err != nil {
+		var cmdErr *vcs.CommandError
+		if !errors.As(err, &cmdErr) {
+			cmdErr = nil
+		}
+
+		s.status.LastError = err.Error()
+		s.status.LastCommandError = cmdErr
+		s.status.Stale = true
+		s.status.Failures++
+		return
+	}
+
+	s.status.LastSuccess = now
+	s.status.LastError = ""
+	s.status.LastCommandError = nil
+	s.status.Stale = false
+	s.status.Failures = 0
+}
+
+// The number of polls in a row that failed.
+func (s *Searcher) failures() int {
+	s.statusLck.Lock()
+	defer s.statusLck.Unlock()
+	return s.status.Failures
+}
+
+// How long to wait for the next poll of a repo that is polled every delay, or
+// that is not polled when delay is 0, after the given number of polls in a row
+// failed. A repo is never polled sooner than it is while its polls succeed, and
+// is only polled on a timer if it is polled at all.
+func pollDelay(delay time.Duration, failures int) time.Duration {
+	if delay <= 0 || failures == 0 {
+		return delay
+	}
+	return retryDelay(delay, failures)
+}
+
+// The delay doubles with each failure, starting from the poll delay or
+// minRetryDelay, whichever is longer, up to maxRetryDelay.
+func retryDelay(delay time.Duration, failures int) time.Duration {
+	if delay < minRetryDelay {
+		delay = minRetryDelay
+	}
+
+	for i := 0; i < failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return delay
+}
+
+// The number of updates that have been requested but not yet started.
+func (s *Searcher) PendingUpdates() int {
+	return len(s.updateCh)
+}
+
 // Triggers an immediate poll of the repository.
 func (s *Searcher) Update() bool {
 	if !s.Repo.PushUpdatesEnabled() {
@@ -161,13 +637,15 @@ func (s *Searcher) Update() bool {
 	return true
 }
 
-// Shut down the searcher cleanly, waiting for any indexing operations to complete.
+// Shut down the searcher cleanly, killing any vcs command that is running but
+// waiting for any indexing operations to complete.
 func (s *Searcher) Stop() {
-	select {
-	case s.shutdownCh <- empty{}:
-		s.shutdownRequested = true
-	default:
-	}
+	s.shutdownOnce.Do(func() {
+		close(s.shutdownCh)
+	})
+
+	// Don't wait for a pull that is in progress to finish.
+	s.wd.Stop()
 }
 
 // Blocks until the searcher's associated goroutine is stopped.
@@ -175,6 +653,45 @@ func (s *Searcher) Wait() {
 	<-s.doneCh
 }
 
+// Remove the searcher's index from disk. This waits for in-flight searches to
+// finish, but the searcher should already be stopped so that it does not build
+// a new index. Searches made after this return an error.
+func (s *Searcher) Destroy() error {
+	revIdxs.removeAll(s)
+
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	idxs := s.idxs
+	s.idxs = nil
+	s.commits = nil
+
+	var firstErr error
+	for _, idx := range idxs {
+		if err := idx.Destroy(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Remove the vcs working directory of the searcher's repo. Since repos with the
+// same url share a working directory, this should only be done for the last
+// searcher using it.
+func (s *Searcher) RemoveVcsDir() error {
+	return os.RemoveAll(s.vcsDir)
+}
+
+// Has Stop been called?
+func (s *Searcher) shutdownRequested() bool {
+	select {
+	case <-s.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *Searcher) completeShutdown() {
 	close(s.doneCh)
 }
@@ -243,10 +760,44 @@ func buildAndOpenIndex(
 			return nil, err
 		}
 
-		return r.Open()
+		return r.OpenTree(opt.Tree)
+	}
+
+	r, err := index.Read(idxDir)
+	if err != nil {
+		return nil, err
 	}
 
-	return index.Open(idxDir)
+	return r.OpenTree(opt.Tree)
+}
+
+// Build an index for newRev by applying the files that changed since the base
+// index was built. This returns an error if the vcs driver is unable to report the
+// changes or if the index cannot be updated incrementally, in which case the caller
+// should fall back to a full build.
+func updateAndOpenIndex(
+	base *index.IndexRef,
+	opt *index.IndexOptions,
+	vcsDir,
+	idxDir,
+	url,
+	newRev string,
+	wd *vcs.WorkDir) (*index.Index, error) {
+	if base == nil {
+		return nil, vcs.ErrChangesUnknown
+	}
+
+	changed, err := wd.ChangedFiles(vcsDir, base.Rev, newRev)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := index.Update(opt, idxDir, vcsDir, base, url, newRev, changed)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.OpenTree(opt.Tree)
 }
 
 // Simply prints out statistics about the heap. When hound rebuilds a new
@@ -291,7 +842,13 @@ func MakeAll(cfg *config.Config) (map[string]*Searcher, map[string]error, error)
 		return nil, nil, err
 	}
 
-	lim := makeLimiter(cfg.MaxConcurrentIndexers)
+	lim := setSharedLimiter(cfg.MaxConcurrentIndexers)
+
+	// Indexes of revisions are only kept for as long as hound runs.
+	SetRevIndexLimits(cfg.MaxRevIndexes, cfg.RevIndexTtl())
+	if err := removeRevDirs(cfg.DbPath); err != nil {
+		return nil, nil, err
+	}
 
 	n := len(cfg.Repos)
 	// Channel to receive the results from newSearcherConcurrent function.
@@ -329,7 +886,10 @@ func MakeAll(cfg *config.Config) (map[string]*Searcher, map[string]error, error)
 // Creates a new Searcher that is available for searches as soon as this returns.
 // This will pull or clone the target repo and start watching the repo for changes.
 func New(dbpath, name string, repo *config.Repo) (*Searcher, error) {
-	s, err := newSearcher(dbpath, name, repo, &foundRefs{}, makeLimiter(1))
+	lim := sharedLimiter()
+	lim.Acquire()
+	s, err := newSearcher(dbpath, name, repo, &foundRefs{}, lim, nil)
+	lim.Release()
 	if err != nil {
 		return nil, err
 	}
@@ -339,55 +899,321 @@ func New(dbpath, name string, repo *config.Repo) (*Searcher, error) {
 	return s, nil
 }
 
-// Update the vcs and reindex the given repo.
-func updateAndReindex(
+// Creates a new Searcher in the background. The clone and the index build wait
+// their turn on the limiter that is shared with all other searchers. onPhase is
+// called as the searcher moves from one phase to the next and done is called
+// with either the new searcher, which has begun watching the repo, or an error.
+func NewAsync(
+	dbpath, name string,
+	repo *config.Repo,
+	onPhase func(Phase),
+	done func(*Searcher, error)) {
+
+	go func() {
+		lim := sharedLimiter()
+		onPhase(PhaseQueued)
+
+		lim.Acquire()
+		s, err := newSearcher(dbpath, name, repo, &foundRefs{}, lim, onPhase)
+		lim.Release()
+		if err != nil {
+			done(nil, err)
+			return
+		}
+
+		s.begin()
+		done(s, nil)
+	}()
+}
+
+// Creates a new Searcher for a changed repo in the background, like NewAsync,
+// while old keeps serving searches. If both use the same vcs directory, old
+// does not poll while the new searcher is built. Once the new searcher is ready
+// old is stopped, while if the build fails old goes back to polling.
+func RebuildAsync(
+	old *Searcher,
+	dbpath, name string,
+	repo *config.Repo,
+	onPhase func(Phase),
+	done func(*Searcher, error)) {
+
+	go func() {
+		lim := sharedLimiter()
+		onPhase(PhaseQueued)
+
+		// A poll of old that is in progress is finished first.
+		shared := vcsDirFor(old.Repo) == vcsDirFor(repo)
+		if shared {
+			old.pollLck.Lock()
+		}
+
+		lim.Acquire()
+		s, err := newSearcher(dbpath, name, repo, &foundRefs{}, lim, onPhase)
+		lim.Release()
+
+		if err == nil {
+			old.Stop()
+		}
+		if shared {
+			old.pollLck.Unlock()
+		}
+		if err != nil {
+			done(nil, err)
+			return
+		}
+
+		old.Wait()
+		s.begin()
+		done(s, nil)
+	}()
+}
+
+// The options for indexing the working directory as it is currently checked
+// out.
+func indexOptions(repo *config.Repo, wd *vcs.WorkDir, vcsDir string) *index.IndexOptions {
+	var autoFiles []string
+	if len(repo.AutoGeneratedFiles) > 0 {
+		autoFiles = repo.AutoGeneratedFiles
+	} else {
+		autoFiles = wd.AutoGeneratedFiles(vcsDir)
+	}
+
+	sparseFiles, err := wd.SparseFiles(vcsDir)
+	if err != nil {
+		log.Printf("failed to list sparse files (%s): %s", repo.Url, err)
+	}
+
+	return &index.IndexOptions{
+		ExcludeDotFiles:    repo.ExcludeDotFiles,
+		SpecialFiles:       wd.SpecialFiles(),
+		AutoGeneratedFiles: autoFiles,
+		IncludePaths:       repo.IncludePaths,
+		ExcludePaths:       repo.ExcludePaths,
+		SparseFiles:        sparseFiles,
+		IgnoreFiles:        repo.IgnoreFiles(),
+		Store:              repo.ContentStore,
+		Compression:        repo.ContentCompression,
+	}
+}
+
+// Open the tree of rev into the index options, for drivers that index the
+// objects of the repo rather than its working directory. The tree is owned by
+// the index that is opened with the options, or has to be closed with
+// closeTree if none is.
+func openTree(opt *index.IndexOptions, wd *vcs.WorkDir, vcsDir, rev string) error {
+	tree, err := wd.OpenTree(vcsDir, rev)
+	if err != nil {
+		return err
+	}
+
+	// A nil vcs.Tree converts to a nil index.Tree.
+	opt.Tree = tree
+	return nil
+}
+
+func closeTree(opt *index.IndexOptions) {
+	if opt.Tree != nil {
+		opt.Tree.Close() //nolint
+	}
+}
+
+// The refs to index in the working directory, which is empty for drivers that
+// index the working directory as it is pulled.
+func listRefs(wd *vcs.WorkDir, vcsDir string) ([]string, error) {
+	refs, err := wd.ListRefs(vcsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if refs == nil {
+		return []string{""}, nil
+	}
+	return refs, nil
+}
+
+// Check out the ref in the working directory, unless it is the empty ref whose
+// rev is the one that was pulled.
+func checkout(wd *vcs.WorkDir, vcsDir, ref, pulledRev string) (string, error) {
+	if ref == "" {
+		return pulledRev, nil
+	}
+	return wd.Checkout(vcsDir, ref)
+}
+
+// Rebuild the index of a ref, which is checked out at newRev, and make it live.
+func reindexRef(
 	s *Searcher,
 	dbpath,
 	vcsDir,
 	name,
-	rev string,
-	wd *vcs.WorkDir,
-	opt *index.IndexOptions,
-	lim limiter) (string, bool) {
-
-	// acquire a token from the rate limiter
-	lim.Acquire()
-	defer lim.Release()
+	ref,
+	newRev string,
+	wd *vcs.WorkDir) error {
 
 	repo := s.Repo
-	newRev, err := wd.PullOrClone(vcsDir, repo.Url)
+	opt := indexOptions(repo, wd, vcsDir)
+	if err := openTree(opt, wd, vcsDir, newRev); err != nil {
+		log.Printf("failed to open tree (%s): %s", name, err)
+		return err
+	}
 
-	if err != nil {
-		log.Printf("vcs pull error (%s - %s): %s", name, repo.Url, err)
-		return rev, false
+	s.lck.RLock()
+	var base *index.IndexRef
+	if idx := s.idxs[ref]; idx != nil {
+		base = idx.Ref
 	}
+	s.lck.RUnlock()
 
-	if newRev == rev {
-		return rev, false
+	if ref == "" {
+		log.Printf("Rebuilding %s for %s", name, newRev)
+	} else {
+		log.Printf("Rebuilding %s@%s for %s", name, ref, newRev)
 	}
 
-	log.Printf("Rebuilding %s for %s", name, newRev)
-	idx, err := buildAndOpenIndex(
+	start := time.Now()
+	idx, err := updateAndOpenIndex(
+		base,
 		opt,
-		dbpath,
 		vcsDir,
 		nextIndexDir(dbpath),
 		repo.Url,
-		newRev)
+		newRev,
+		wd)
+	if err != nil {
+		if err != vcs.ErrChangesUnknown {
+			log.Printf("incremental index update failed, doing full build (%s): %s", name, err)
+		}
+
+		idx, err = buildAndOpenIndex(
+			opt,
+			dbpath,
+			vcsDir,
+			nextIndexDir(dbpath),
+			repo.Url,
+			newRev)
+	}
 	if err != nil {
 		log.Printf("failed index build (%s): %s", name, err)
-		return rev, false
+		indexBuildFailures.Inc(name)
+		closeTree(opt)
+		return err
+	}
+	took := time.Since(start)
+	indexBuildSeconds.Observe(took.Seconds(), name)
+
+	commits, err := commitsFor(wd, vcsDir, idx)
+	if err != nil {
+		log.Printf("failed to read commit history (%s): %s", name, err)
 	}
 
-	if err := s.swapIndexes(idx); err != nil {
+	if err := s.swapIndexes(ref, idx, commits); err != nil {
 		log.Printf("failed index swap (%s): %s", name, err)
 		if err := idx.Destroy(); err != nil {
 			log.Printf("failed to destroy index (%s): %s\n", name, err)
 		}
-		return rev, false
+		return err
+	}
+
+	s.indexBuilt(ref, idx, took)
+	return nil
+}
+
+// Update the vcs and reindex each of the refs of the given repo whose rev
+// changed. This returns the revs of the refs that are indexed afterwards and
+// whether any index changed.
+func updateAndReindex(
+	s *Searcher,
+	dbpath,
+	vcsDir,
+	name string,
+	revs map[string]string,
+	wd *vcs.WorkDir,
+	lim limiter) (map[string]string, bool) {
+
+	// acquire a token from the rate limiter
+	lim.Acquire()
+	defer lim.Release()
+
+	repo := s.Repo
+	pulledRev, err := wd.PullOrClone(vcsDir, repo.Url)
+	if err == nil {
+		var refs []string
+		if refs, err = listRefs(wd, vcsDir); err == nil {
+			newRevs, changed := reindexRefs(s, dbpath, vcsDir, name, refs, pulledRev, revs, wd)
+			prune(wd, vcsDir, name, newRevs)
+			return newRevs, changed
+		}
+	}
+
+	log.Printf("vcs pull error (%s - %s): %s", name, repo.Url, err)
+	pollErrors.Inc(repo.Vcs)
+	s.polled(err)
+	return revs, false
+}
+
+// Let the vcs remove the objects that none of the indexed revs need, which is
+// only done once the indexes are live, since a ref that fails to reindex keeps
+// serving the index of its previous rev.
+func prune(wd *vcs.WorkDir, vcsDir, name string, revs map[string]string) {
+	keep := make([]string, 0, len(revs))
+	for _, rev := range revs {
+		keep = append(keep, rev)
+	}
+
+	if err := wd.Prune(vcsDir, keep); err != nil {
+		log.Printf("failed to prune (%s): %s", name, err)
+	}
+}
+
+// Reindex the refs whose rev changed and drop the indexes of refs that no
+// longer exist. A ref that fails to update keeps serving its current index.
+func reindexRefs(
+	s *Searcher,
+	dbpath,
+	vcsDir,
+	name string,
+	refs []string,
+	pulledRev string,
+	revs map[string]string,
+	wd *vcs.WorkDir) (map[string]string, bool) {
+
+	newRevs := map[string]string{}
+	var indexed []string
+	var changed bool
+	var firstErr error
+	for _, ref := range refs {
+		rev, err := checkout(wd, vcsDir, ref, pulledRev)
+		if err == nil && rev != revs[ref] {
+			err = reindexRef(s, dbpath, vcsDir, name, ref, rev, wd)
+			changed = changed || err == nil
+		}
+
+		if err != nil {
+			log.Printf("failed to update %s@%s: %s", name, ref, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			old, ok := revs[ref]
+			if !ok {
+				continue
+			}
+			rev = old
+		}
+
+		newRevs[ref] = rev
+		indexed = append(indexed, ref)
+	}
+
+	for _, idx := range s.setRefs(indexed) {
+		changed = true
+		if err := idx.Destroy(); err != nil {
+			log.Printf("failed to destroy index (%s): %s", name, err)
+		}
 	}
 
-	return newRev, true
+	s.polled(firstErr)
+	return newRevs, changed
 }
 
 // Creates a new Searcher that is capable of re-claiming an existing index directory
@@ -396,7 +1222,8 @@ func newSearcher(
 	dbpath, name string,
 	repo *config.Repo,
 	refs *foundRefs,
-	lim limiter) (*Searcher, error) {
+	lim limiter,
+	onPhase func(Phase)) (*Searcher, error) {
 
 	vcsDir := filepath.Join(dbpath, vcsDirFor(repo))
 
@@ -406,58 +1233,109 @@ func newSearcher(
 	if err != nil {
 		return nil, err
 	}
+	wd.SetSparsePaths(repo.IncludePaths, repo.ExcludePaths)
+	wd.SetIgnoreFiles(repo.IgnoreFiles())
+	wd.SetCommandTimeout(time.Duration(repo.MsCommandTimeout) * time.Millisecond)
 
+	if onPhase != nil {
+		onPhase(PhaseCloning)
+	}
 
-	rev, err := wd.PullOrClone(vcsDir, repo.Url)
+	pulledRev, err := wd.PullOrClone(vcsDir, repo.Url)
 	if err != nil {
+		pollErrors.Inc(repo.Vcs)
 		return nil, err
 	}
 
-	var autoFiles []string
-	if len(repo.AutoGeneratedFiles) > 0 {
-		autoFiles = repo.AutoGeneratedFiles
-	} else {
-		autoFiles = wd.AutoGeneratedFiles(vcsDir)
-	}
-
-	opt := &index.IndexOptions{
-		ExcludeDotFiles:    repo.ExcludeDotFiles,
-		SpecialFiles:       wd.SpecialFiles(),
-		AutoGeneratedFiles: autoFiles,
-	}
-
-	var idxDir string
-	ref := refs.find(repo.Url, rev)
-	if ref == nil {
-		idxDir = nextIndexDir(dbpath)
-	} else {
-		idxDir = ref.Dir()
-		refs.claim(ref)
-	}
-
-	idx, err := buildAndOpenIndex(
-		opt,
-		dbpath,
-		vcsDir,
-		idxDir,
-		repo.Url,
-		rev)
+	idxRefs, err := listRefs(wd, vcsDir)
 	if err != nil {
+		pollErrors.Inc(repo.Vcs)
 		return nil, err
 	}
 
+	if onPhase != nil {
+		onPhase(PhaseIndexing)
+	}
+
 	s := &Searcher{
-		idx:        idx,
+		idxs:       map[string]*index.Index{},
+		refs:       idxRefs,
 		updateCh:   make(chan time.Time, 1),
 		Repo:       repo,
+		dbpath:     dbpath,
+		vcsDir:     vcsDir,
+		wd:         wd,
 		doneCh:     make(chan empty),
-		shutdownCh: make(chan empty, 1),
+		shutdownCh: make(chan empty),
 	}
 
+	revs := map[string]string{}
+	for _, idxRef := range idxRefs {
+		rev, err := checkout(wd, vcsDir, idxRef, pulledRev)
+		if err != nil {
+			s.Destroy() //nolint
+			return nil, err
+		}
+
+		opt := indexOptions(repo, wd, vcsDir)
+		if err := openTree(opt, wd, vcsDir, rev); err != nil {
+			s.Destroy() //nolint
+			return nil, err
+		}
+
+		var idxDir string
+		ref := refs.claimFor(repo, rev, opt)
+		if ref == nil {
+			idxDir = nextIndexDir(dbpath)
+		} else {
+			idxDir = ref.Dir()
+		}
+
+		start := time.Now()
+		idx, err := buildAndOpenIndex(
+			opt,
+			dbpath,
+			vcsDir,
+			idxDir,
+			repo.Url,
+			rev)
+		if err != nil {
+			indexBuildFailures.Inc(name)
+			closeTree(opt)
+			s.Destroy() //nolint
+			return nil, err
+		}
+
+		// An index that was reclaimed from a previous run was not built
+		var took time.Duration
+		if ref == nil {
+			took = time.Since(start)
+			indexBuildSeconds.Observe(took.Seconds(), name)
+		}
+
+		commits, err := commitsFor(wd, vcsDir, idx)
+		if err != nil {
+			log.Printf("failed to read commit history (%s): %s", name, err)
+		}
+
+		s.idxs[idxRef] = idx
+		s.setCommits(idxRef, commits)
+		s.indexBuilt(idxRef, idx, took)
+		revs[idxRef] = rev
+	}
+
+	prune(wd, vcsDir, name, revs)
+	s.polled(nil)
+
 	go func() {
 
 		// each searcher's poller is held until begin is called.
-		<-s.updateCh
+		select {
+		case <-s.updateCh:
+		case <-s.shutdownCh:
+			s.completeShutdown()
+			return
+		}
 
 		// if all forms of updating are turned off, we're done here.
 		if !repo.PollUpdatesEnabled() && !repo.PushUpdatesEnabled() {
@@ -471,22 +1349,24 @@ func newSearcher(
 		}
 
 		for {
-			// Wait for a signal to proceed
-			s.waitForUpdate(delay)
+			// Wait for a signal to proceed, backing off while polls fail
+			s.waitForUpdate(pollDelay(delay, s.failures()))
 
-			if s.shutdownRequested {
+			s.pollLck.Lock()
+			if s.shutdownRequested() {
+				s.pollLck.Unlock()
 				s.completeShutdown()
 				return
 			}
 
 			// attempt to update and reindex this searcher
-			newRev, ok := updateAndReindex(s, dbpath, vcsDir, name, rev, wd, opt, lim)
+			newRevs, ok := updateAndReindex(s, dbpath, vcsDir, name, revs, wd, lim)
+			s.pollLck.Unlock()
+			revs = newRevs
 			if !ok {
 				continue
 			}
 
-			rev = newRev
-
 			// This is just a good time to GC since we know there will be a
 			// whole set of dead posting lists on the heap. Ensuring these
 			// go away quickly helps to prevent the heap from expanding
@@ -514,7 +1394,7 @@ func newSearcherConcurrent(
 	lim.Acquire()
 	defer lim.Release()
 
-	s, err := newSearcher(dbpath, name, repo, refs, lim)
+	s, err := newSearcher(dbpath, name, repo, refs, lim, nil)
 	if err != nil {
 		resultCh <- searcherResult{
 			name: name,
@@ -0,0 +1,344 @@
+package searcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/index"
+	"github.com/hound-search/hound/vcs"
+)
+
+func TestRetryDelay(t *testing.T) {
+	for _, test := range []struct {
+		delay    time.Duration
+		failures int
+		expected time.Duration
+	}{
+		{time.Second, 1, 2 * minRetryDelay},
+		{time.Second, 2, 4 * minRetryDelay},
+		{time.Minute, 1, 2 * time.Minute},
+		{time.Minute, 3, 8 * time.Minute},
+		{time.Minute, 20, maxRetryDelay},
+		{time.Hour, 1, maxRetryDelay},
+	} {
+		if got := retryDelay(test.delay, test.failures); got != test.expected {
+			t.Errorf("retryDelay(%s, %d): expected %s, got %s",
+				test.delay, test.failures, test.expected, got)
+		}
+	}
+}
+
+func TestPollDelay(t *testing.T) {
+	if got := pollDelay(time.Minute, 0); got != time.Minute {
+		t.Errorf("expected the poll delay without failures, got %s", got)
+	}
+
+	for failures := 1; failures < 5; failures++ {
+		if got := pollDelay(30*time.Second, failures); got <= 30*time.Second {
+			t.Errorf("expected a failing repo to be polled less often, got %s after %d failures", got, failures)
+		}
+	}
+
+	// Repos that are not polled wait for a push, however often they fail.
+	for failures := 0; failures < 5; failures++ {
+		if got := pollDelay(0, failures); got != 0 {
+			t.Errorf("expected no poll timer when polling is disabled, got %s after %d failures", got, failures)
+		}
+	}
+}
+
+// A driver that keeps repos without a working directory, like bare git-native
+// repos, whose revs are "rev1", "rev2" and so on with a single file each. The
+// objects of a rev are gone once a prune does not keep it.
+type treeDriver struct {
+	lck    sync.Mutex
+	head   int
+	failed map[string]bool
+	pruned map[string]bool
+}
+
+var testTreeDriver *treeDriver
+
+func init() {
+	vcs.Register(func(b []byte) (vcs.Driver, error) {
+		return testTreeDriver, nil
+	}, "test-tree")
+}
+
+func newTreeDriver() *treeDriver {
+	return &treeDriver{head: 1, failed: map[string]bool{}, pruned: map[string]bool{}}
+}
+
+// Move the head to the given rev, which fails to open as a tree if fail is set.
+func (d *treeDriver) setHead(head int, fail bool) {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	d.head = head
+	d.failed[fmt.Sprintf("rev%d", head)] = fail
+}
+
+func (d *treeDriver) isPruned(rev string) bool {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	return d.pruned[rev]
+}
+
+func (d *treeDriver) rev() string {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	return fmt.Sprintf("rev%d", d.head)
+}
+
+func (d *treeDriver) Clone(dir, url string) (string, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	return d.Pull(dir)
+}
+
+func (d *treeDriver) Pull(dir string) (string, error) {
+	return d.rev(), nil
+}
+
+func (d *treeDriver) HeadRev(dir string) (string, error) {
+	return d.rev(), nil
+}
+
+func (d *treeDriver) SpecialFiles() []string {
+	return nil
+}
+
+func (d *treeDriver) AutoGeneratedFiles(dir string) []string {
+	return nil
+}
+
+func (d *treeDriver) ChangedFiles(dir, fromRev, toRev string) ([]string, error) {
+	return nil, vcs.ErrChangesUnknown
+}
+
+func (d *treeDriver) OpenTree(dir, rev string) (vcs.Tree, error) {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	if d.failed[rev] {
+		return nil, errors.New("cannot read " + rev)
+	}
+	return &revTree{d, rev}, nil
+}
+
+func (d *treeDriver) Prune(dir string, keep []string) error {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	for i := 1; i <= d.head; i++ {
+		rev := fmt.Sprintf("rev%d", i)
+		if i != d.head && !containsString(keep, rev) {
+			d.pruned[rev] = true
+		}
+	}
+	return nil
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+type revTree struct {
+	d   *treeDriver
+	rev string
+}
+
+func (t *revTree) Walk(fn func(path string, mode os.FileMode, blob string) error) error {
+	return fn("file", 0644, t.rev)
+}
+
+func (t *revTree) ReadBlob(blob string) ([]byte, error) {
+	if t.d.isPruned(blob) {
+		return nil, errors.New("object not found: " + blob)
+	}
+	return []byte("content of " + blob + "\n"), nil
+}
+
+func (t *revTree) Close() error {
+	return nil
+}
+
+func TestPruneKeepsServedRevs(t *testing.T) {
+	testTreeDriver = newTreeDriver()
+
+	dbpath, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	repo := &config.Repo{Url: "test://repo", Vcs: "test-tree"}
+	config.InitRepo(repo)
+
+	lim := makeLimiter(1)
+	s, err := newSearcher(dbpath, "repo", repo, &foundRefs{}, lim, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Destroy() //nolint
+
+	// The reindex of rev2 fails, so rev1 is still served through the polls
+	// that follow.
+	testTreeDriver.setHead(2, true)
+
+	revs := map[string]string{"": "rev1"}
+	for i := 0; i < 2; i++ {
+		revs, _ = updateAndReindex(s, dbpath, s.vcsDir, "repo", revs, s.wd, lim)
+		if revs[""] != "rev1" {
+			t.Fatalf("expected rev1 to be served, got %s", revs[""])
+		}
+
+		res, err := s.Search(context.Background(), "content", &index.SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Matches) != 1 || res.Matches[0].Matches[0].Line != "content of rev1" {
+			t.Fatalf("expected the content of rev1, got %v", res.Matches)
+		}
+	}
+
+	// Once rev3 is served, rev1 is no longer needed.
+	testTreeDriver.setHead(3, false)
+	revs, _ = updateAndReindex(s, dbpath, s.vcsDir, "repo", revs, s.wd, lim)
+	if revs[""] != "rev3" {
+		t.Fatalf("expected rev3 to be served, got %s", revs[""])
+	}
+
+	if !testTreeDriver.isPruned("rev1") {
+		t.Errorf("expected rev1 to be pruned")
+	}
+}
+
+// Wait for the searcher to serve the rev, or fail after a while.
+func waitForRev(t *testing.T, s *Searcher, rev string) {
+	for i := 0; i < 500; i++ {
+		if s.Status().Rev == rev {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %s to be served, got %s", rev, s.Status().Rev)
+}
+
+func TestRebuildAsync(t *testing.T) {
+	testTreeDriver = newTreeDriver()
+
+	dbpath, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	repo := &config.Repo{Url: "test://repo", Vcs: "test-tree"}
+	config.InitRepo(repo)
+
+	old, err := New(dbpath, "repo", repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Destroy() //nolint
+
+	rebuild := func(repo *config.Repo) (*Searcher, error) {
+		ch := make(chan error, 1)
+		var s *Searcher
+		RebuildAsync(old, dbpath, "repo", repo, func(Phase) {}, func(n *Searcher, err error) {
+			s = n
+			ch <- err
+		})
+		return s, <-ch
+	}
+
+	// A failed rebuild leaves the old searcher polling the repo.
+	changed := *repo
+	changed.ExcludeDotFiles = !repo.ExcludeDotFiles
+	testTreeDriver.setHead(2, true)
+	if _, err := rebuild(&changed); err == nil {
+		t.Fatal("expected the rebuild to fail")
+	}
+
+	testTreeDriver.setHead(3, false)
+	old.updateCh <- time.Now()
+	waitForRev(t, old, "rev3")
+
+	// A rebuild that succeeds stops the old searcher.
+	s, err := rebuild(&changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Destroy() //nolint
+
+	old.Wait()
+	if s.Status().Rev != "rev3" {
+		t.Errorf("expected the new searcher to serve rev3, got %s", s.Status().Rev)
+	}
+}
+
+// Fail unless the searcher's poller stops within a while.
+func waitForStop(t *testing.T, s *Searcher) {
+	stopped := make(chan empty)
+	go func() {
+		s.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the searcher to stop")
+	}
+}
+
+func TestStopPushOnly(t *testing.T) {
+	testTreeDriver = newTreeDriver()
+
+	dbpath, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	// Without polls the poller only waits for pushes.
+	poll, push := false, true
+	repo := &config.Repo{Url: "test://repo", Vcs: "test-tree", EnablePollUpdates: &poll, EnablePushUpdates: &push}
+	config.InitRepo(repo)
+
+	s, err := New(dbpath, "repo", repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Destroy() //nolint
+
+	testTreeDriver.setHead(2, false)
+	s.updateCh <- time.Now()
+	waitForRev(t, s, "rev2")
+
+	s.Stop()
+	s.Stop()
+	waitForStop(t, s)
+
+	// A searcher that never began stops as well.
+	lim := makeLimiter(1)
+	n, err := newSearcher(dbpath, "repo", repo, &foundRefs{}, lim, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Destroy() //nolint
+
+	n.Stop()
+	waitForStop(t, n)
+}
@@ -170,6 +170,8 @@ var Model = {
         if (params.q == "") {
             _this.results = [];
             _this.resultsByRepo = {};
+            _this.errors = {};
+            _this.truncated = [];
             _this.didSearch.raise(_this, _this.Results);
             return;
         }
@@ -188,7 +190,8 @@ var Model = {
                     stats = data.Stats,
                     results = [];
                 for (var repo in matches) {
-                    if (!matches[repo]) {
+                    // Repos that ran out of time may have no matches.
+                    if (!matches[repo] || !matches[repo].Matches) {
                         continue;
                     }
 
@@ -215,13 +218,21 @@ var Model = {
 
                 _this.results = results;
                 _this.resultsByRepo = byRepo;
+                _this.errors = data.Errors || {};
+                _this.truncated = data.Truncated || [];
                 _this.stats = {
                     Server: stats.Duration,
                     Total: Date.now() - startedAt,
                     Files: stats.FilesOpened,
                 };
 
-                _this.didSearch.raise(_this, _this.results, _this.stats);
+                _this.didSearch.raise(
+                    _this,
+                    _this.results,
+                    _this.stats,
+                    _this.errors,
+                    _this.truncated
+                );
             },
             error: function (xhr, status, err) {
                 _this.didError.raise(this, "The server broke down");
@@ -255,7 +266,7 @@ var Model = {
                 }
 
                 var result = data.Results[repo];
-                results.Matches = results.Matches.concat(result.Matches);
+                results.Matches = results.Matches.concat(result.Matches || []);
                 _this.didLoadMore.raise(_this, repo, _this.results);
             },
             error: function (xhr, status, err) {
@@ -348,11 +359,10 @@ var RepoConfigForm = React.createClass({
             }),
             type: "json",
             success: function (data) {
+                var name = _this.state.name;
                 _this.setState({ loading: false, showForm: false, name: "", url: "", branch: "" });
-                // Reload repos
-                Model.LoadRepos();
-                // Show success message (you could add a toast notification here)
-                alert("Repository added successfully!");
+                // The repo is cloned and indexed in the background
+                _this.waitForRepo(name);
             },
             error: function (xhr, status, err) {
                 var errorMsg = "Failed to add repository";
@@ -368,6 +378,26 @@ var RepoConfigForm = React.createClass({
             }
         });
     },
+    waitForRepo: function (name) {
+        var _this = this;
+        reqwest({
+            url: "api/v1/repos/" + encodeURIComponent(name) + "/status",
+            type: "json",
+            success: function (data) {
+                if (data.Phase == "ready") {
+                    Model.LoadRepos();
+                    alert("Repository " + name + " added successfully!");
+                } else if (data.Phase == "failed") {
+                    alert("Failed to add repository " + name + ": " + data.Error);
+                } else {
+                    setTimeout(function () { _this.waitForRepo(name); }, 2000);
+                }
+            },
+            error: function (xhr, status, err) {
+                alert("Failed to add repository " + name);
+            }
+        });
+    },
     render: function () {
         if (!this.state.showForm) {
             return (
@@ -1082,7 +1112,45 @@ var ResultView = React.createClass({
         this.openOrCloseAll(false);
     },
     getInitialState: function () {
-        return { results: null };
+        return { results: null, repoErrors: {}, truncated: [] };
+    },
+    renderRepoErrors: function () {
+        var errors = this.state.repoErrors || {},
+            repos = Object.keys(errors).sort();
+        if (repos.length === 0) {
+            return "";
+        }
+
+        return (
+            <div className="repo-errors">
+                {repos.map(function (repo) {
+                    return (
+                        <div className="repo-error">
+                            <strong>{Model.NameForRepo(repo)}:</strong>
+                            {errors[repo]}
+                        </div>
+                    );
+                })}
+            </div>
+        );
+    },
+    renderTruncated: function () {
+        var repos = this.state.truncated || [];
+        if (repos.length === 0) {
+            return "";
+        }
+
+        return (
+            <div className="repo-errors">
+                <div className="repo-error">
+                    <strong>Incomplete results:</strong>
+                    The search ran out of time in{" "}
+                    {repos.map(function (repo) {
+                        return Model.NameForRepo(repo);
+                    }).join(", ")}
+                </div>
+            </div>
+        );
     },
     render: function () {
         if (this.state.error) {
@@ -1097,8 +1165,12 @@ var ResultView = React.createClass({
         if (this.state.results !== null && this.state.results.length === 0) {
             // TODO(knorton): We need something better here. :-(
             return (
-                <div id="no-result">
-                    &ldquo;Nothing for you, Dawg.&rdquo;<div>0 results</div>
+                <div>
+                    {this.renderRepoErrors()}
+                    {this.renderTruncated()}
+                    <div id="no-result">
+                        &ldquo;Nothing for you, Dawg.&rdquo;<div>0 results</div>
+                    </div>
                 </div>
             );
         }
@@ -1143,6 +1215,8 @@ var ResultView = React.createClass({
         }
         return (
             <div id="result">
+                {this.renderRepoErrors()}
+                {this.renderTruncated()}
                 {actions}
                 {repos}
             </div>
@@ -1174,7 +1248,7 @@ var App = React.createClass({
             }
         });
 
-        Model.didSearch.tap(function (model, results, stats) {
+        Model.didSearch.tap(function (model, results, stats, errors, truncated) {
             _this.refs.searchBar.setState({
                 stats: stats,
                 repos: repos,
@@ -1182,6 +1256,8 @@ var App = React.createClass({
 
             _this.refs.resultView.setState({
                 results: results,
+                repoErrors: errors || {},
+                truncated: truncated || [],
                 regexp: _this.refs.searchBar.getRegExp(),
                 error: null,
             });
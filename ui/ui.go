@@ -2,6 +2,7 @@ package ui
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	html_template "html/template"
@@ -15,6 +16,10 @@ import (
 	"github.com/hound-search/hound/config"
 )
 
+// Returns the repos that the client of a request may see, these are embedded
+// in the rendered pages.
+type ReposFunc func(r *http.Request) map[string]*config.Repo
+
 // An http.Handler for the dev-mode case.
 type devHandler struct {
 	// A simple file server for serving non-template assets
@@ -28,6 +33,9 @@ type devHandler struct {
 
 	// the config we are running on
 	cfg *config.Config
+
+	// the repos to embed in pages
+	repos ReposFunc
 }
 
 // An http.Handler for the prd-mode case.
@@ -35,11 +43,20 @@ type prdHandler struct {
 	// The collection of templated assets w/ their templates pre-parsed
 	content map[string]*content
 
-	// The config object as a json string
-	cfgJson string
-
 	// the config we are running on
 	cfg *config.Config
+
+	// the repos to embed in pages
+	repos ReposFunc
+}
+
+// The repos that the client of the request may see as a json string.
+func reposAsJson(repos ReposFunc, r *http.Request) (string, error) {
+	b, err := json.Marshal(repos(r))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
 }
 
 func (h *devHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -55,14 +72,14 @@ func (h *devHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// If so, render the HTML
 	w.Header().Set("Content-Type", "text/html;charset=utf-8")
-	if err := renderForDev(w, h.root, cr, h.cfg, r); err != nil {
+	if err := renderForDev(w, h.root, cr, h.cfg, h.repos, r); err != nil {
 		log.Panic(err)
 	}
 }
 
 // Renders a templated asset in dev-mode. This simply embeds external script tags
 // for the source elements.
-func renderForDev(w io.Writer, root string, c *content, cfg *config.Config, r *http.Request) error {
+func renderForDev(w io.Writer, root string, c *content, cfg *config.Config, repos ReposFunc, r *http.Request) error {
 	var err error
 	// For more context, see: https://github.com/etsy/hound/issues/239
 	switch c.tplType {
@@ -84,7 +101,7 @@ func renderForDev(w io.Writer, root string, c *content, cfg *config.Config, r *h
 		return errors.New("invalid tplType for content")
 	}
 
-	json, err := cfg.ToJsonString()
+	reposJson, err := reposAsJson(repos, r)
 	if err != nil {
 		return err
 	}
@@ -96,7 +113,7 @@ func renderForDev(w io.Writer, root string, c *content, cfg *config.Config, r *h
 
 	return c.tpl.Execute(w, map[string]interface{}{
 		"ReactVersion": ReactVersion,
-		"ReposAsJson":  json,
+		"ReposAsJson":  reposJson,
 		"Title":        cfg.Title,
 		"Source":       html_template.HTML(buf.String()),
 		"Host":         r.Host,
@@ -128,7 +145,7 @@ func (h *prdHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ct := h.content[p]
 	if ct != nil {
 		// if so, render it
-		if err := renderForPrd(w, ct, h.cfg, h.cfgJson, r); err != nil {
+		if err := renderForPrd(w, ct, h.cfg, h.repos, r); err != nil {
 			log.Panic(err)
 		}
 		return
@@ -142,7 +159,12 @@ func (h *prdHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // Renders a templated asset in prd-mode. This strategy will embed
 // the sources directly in a script tag on the templated page.
-func renderForPrd(w io.Writer, c *content, cfg *config.Config, cfgJson string, r *http.Request) error {
+func renderForPrd(w io.Writer, c *content, cfg *config.Config, repos ReposFunc, r *http.Request) error {
+	reposJson, err := reposAsJson(repos, r)
+	if err != nil {
+		return err
+	}
+
 	var buf bytes.Buffer
 	buf.WriteString("<script>")
 	for _, src := range c.sources {
@@ -156,7 +178,7 @@ func renderForPrd(w io.Writer, c *content, cfg *config.Config, cfgJson string, r
 
 	return c.tpl.Execute(w, map[string]interface{}{
 		"ReactVersion": ReactVersion,
-		"ReposAsJson":  cfgJson,
+		"ReposAsJson":  reposJson,
 		"Title":        cfg.Title,
 		"Source":       html_template.HTML(buf.String()),
 		"Host":         r.Host,
@@ -176,18 +198,19 @@ func assetDir() string {
 }
 
 // Create an http.Handler for dev-mode.
-func newDevHandler(cfg *config.Config) (http.Handler, error) {
+func newDevHandler(cfg *config.Config, repos ReposFunc) (http.Handler, error) {
 	root := assetDir()
 	return &devHandler{
 		Handler: http.FileServer(http.Dir(root)),
 		content: contents,
 		root:    root,
 		cfg:     cfg,
+		repos:   repos,
 	}, nil
 }
 
 // Create an http.Handler for prd-mode.
-func newPrdHandler(cfg *config.Config) (http.Handler, error) {
+func newPrdHandler(cfg *config.Config, repos ReposFunc) (http.Handler, error) {
 	for _, cnt := range contents {
 		a, err := Asset(cnt.template)
 		if err != nil {
@@ -215,15 +238,10 @@ func newPrdHandler(cfg *config.Config) (http.Handler, error) {
 		}
 	}
 
-	json, err := cfg.ToJsonString()
-	if err != nil {
-		return nil, err
-	}
-
 	return &prdHandler{
 		content: contents,
 		cfg:     cfg,
-		cfgJson: json,
+		repos:   repos,
 	}, nil
 }
 
@@ -232,10 +250,10 @@ func newPrdHandler(cfg *config.Config) (http.Handler, error) {
 // the source directories making rapid web development possible. If dev
 // is false, the http.Handler will serve assets out of data embedded
 // in the executable.
-func Content(dev bool, cfg *config.Config) (http.Handler, error) {
+func Content(dev bool, cfg *config.Config, repos ReposFunc) (http.Handler, error) {
 	if dev {
-		return newDevHandler(cfg)
+		return newDevHandler(cfg, repos)
 	}
 
-	return newPrdHandler(cfg)
+	return newPrdHandler(cfg, repos)
 }
@@ -1,10 +1,7 @@
 package vcs
 
 import (
-	"bytes"
-	"io"
 	"log"
-	"os/exec"
 	"path/filepath"
 	"strings"
 )
@@ -17,38 +14,24 @@ func newBzr(b []byte) (Driver, error) {
 	return &BzrDriver{}, nil
 }
 
-type BzrDriver struct{}
+type BzrDriver struct {
+	commander
+}
 
 func (g *BzrDriver) HeadRev(dir string) (string, error) {
-	cmd := exec.Command(
+	cmd := g.command(
 		"bzr",
 		"revno")
 	cmd.Dir = dir
-	r, err := cmd.StdoutPipe()
-	if err != nil {
-		return "", err
-	}
-	defer r.Close()
-
-	if err := cmd.Start(); err != nil {
-		return "", err
-	}
-
-	var buf bytes.Buffer
-
-	if _, err := io.Copy(&buf, r); err != nil {
-		return "", err
-	}
-
-	return strings.TrimSpace(buf.String()), cmd.Wait()
+	out, err := g.run(cmd)
+	return strings.TrimSpace(string(out)), err
 }
 
 func (g *BzrDriver) Pull(dir string) (string, error) {
-	cmd := exec.Command("bzr", "pull")
+	cmd := g.command("bzr", "pull")
 	cmd.Dir = dir
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("Failed to bzr pull %s, see output below\n%sContinuing...", dir, out)
+	if _, err := g.run(cmd); err != nil {
+		log.Printf("Failed to bzr pull %s: %s", dir, err)
 		return "", err
 	}
 
@@ -57,15 +40,14 @@ func (g *BzrDriver) Pull(dir string) (string, error) {
 
 func (g *BzrDriver) Clone(dir, url string) (string, error) {
 	par, rep := filepath.Split(dir)
-	cmd := exec.Command(
+	cmd := g.command(
 		"bzr",
 		"branch",
 		url,
 		rep)
 	cmd.Dir = par
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("Failed to clone %s, see output below\n%sContinuing...", url, out)
+	if _, err := g.run(cmd); err != nil {
+		log.Printf("Failed to clone %s: %s", url, err)
 		return "", err
 	}
 
@@ -81,3 +63,7 @@ func (g *BzrDriver) SpecialFiles() []string {
 func (g *BzrDriver) AutoGeneratedFiles(dir string) []string {
 	return []string{}
 }
+
+func (g *BzrDriver) ChangedFiles(dir, fromRev, toRev string) ([]string, error) {
+	return nil, ErrChangesUnknown
+}
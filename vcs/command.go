@@ -0,0 +1,141 @@
+package vcs
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// How long a vcs command may run before it is killed, for drivers that are not
+// given a timeout.
+const DefaultCommandTimeout = 10 * time.Minute
+
+// How long a command has to exit once it is asked to before it is killed.
+// Commands that exit by themselves clean up after them, like git removing its
+// lock files.
+const killDelay = 5 * time.Second
+
+// Runs the commands of a driver. A command that runs longer than the timeout,
+// or that is still running when the driver is stopped, is terminated along
+// with any processes it started, such as ssh or a credential helper.
+type commander struct {
+	lck     sync.Mutex
+	timeout time.Duration
+
+	// Done once the driver is stopped.
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+// A command created by commander.command.
+type command struct {
+	*exec.Cmd
+
+	// Kills the command's process, and releases the resources of the
+	// context it was created with.
+	kill context.CancelFunc
+}
+
+// Set how long each command may run, or DefaultCommandTimeout if it is 0.
+func (c *commander) SetCommandTimeout(timeout time.Duration) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.timeout = timeout
+}
+
+// Terminate any running commands. Commands that are run afterwards fail.
+func (c *commander) Stop() {
+	c.context()
+	c.stop()
+}
+
+func (c *commander) context() context.Context {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	if c.ctx == nil {
+		c.ctx, c.stop = context.WithCancel(context.Background())
+	}
+	return c.ctx
+}
+
+func (c *commander) commandTimeout() time.Duration {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	if c.timeout <= 0 {
+		return DefaultCommandTimeout
+	}
+	return c.timeout
+}
+
+// Create a command, like exec.Command, to be run by run.
+func (c *commander) command(name string, args ...string) *command {
+	ctx, kill := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	return &command{cmd, kill}
+}
+
+// Run a command that was created by command and return what it wrote to
+// stdout, or a CommandError if it fails, times out or the driver is stopped.
+func (c *commander) run(cmd *command) ([]byte, error) {
+	defer cmd.kill()
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	stopCtx := c.context()
+	if stopCtx.Err() != nil {
+		return nil, newCommandError(cmd.Args, nil, stopCtx.Err())
+	}
+
+	timeout := c.commandTimeout()
+	if err := cmd.Start(); err != nil {
+		return nil, newCommandError(cmd.Args, nil, err)
+	}
+
+	// The whole process group is terminated, rather than only the command,
+	// so that no process is left holding the output pipes open, which
+	// Wait would block on.
+	doneCh := make(chan struct{})
+	timedOutCh := make(chan bool, 1)
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		timedOut := false
+		select {
+		case <-doneCh:
+			timedOutCh <- false
+			return
+		case <-timer.C:
+			timedOut = true
+		case <-stopCtx.Done():
+		}
+
+		terminateProcessGroup(cmd.Process) //nolint
+		select {
+		case <-doneCh:
+		case <-time.After(killDelay):
+			killProcessGroup(cmd.Process) //nolint
+			cmd.kill()
+		}
+		timedOutCh <- timedOut
+	}()
+
+	err := cmd.Wait()
+	close(doneCh)
+
+	if <-timedOutCh {
+		e := newCommandError(cmd.Args, stderr.Bytes(), err)
+		e.TimedOut = true
+		return stdout.Bytes(), e
+	}
+
+	if err != nil {
+		return stdout.Bytes(), newCommandError(cmd.Args, stderr.Bytes(), err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,84 @@
+//go:build !windows
+// +build !windows
+
+package vcs
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	var c commander
+
+	out, err := c.run(c.command("sh", "-c", "echo out; echo err >&2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "out\n" {
+		t.Errorf("expected output %q, got %q", "out\n", out)
+	}
+
+	_, err = c.run(c.command("sh", "-c", "echo out; echo '  err  ' >&2; exit 3"))
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("expected a CommandError, got %v", err)
+	}
+	if cmdErr.ExitCode != 3 {
+		t.Errorf("expected exit code 3, got %d", cmdErr.ExitCode)
+	}
+	if cmdErr.Stderr != "err" {
+		t.Errorf("expected stderr %q, got %q", "err", cmdErr.Stderr)
+	}
+
+	_, err = c.run(c.command("/no/such/command"))
+	if !errors.As(err, &cmdErr) || cmdErr.ExitCode != -1 || cmdErr.Stderr == "" {
+		t.Errorf("expected a CommandError with exit code -1, got %v", err)
+	}
+}
+
+func TestRunTimesOut(t *testing.T) {
+	var c commander
+	c.SetCommandTimeout(100 * time.Millisecond)
+
+	// The background sleep holds stdout open, so this only returns once
+	// the whole process group is gone.
+	start := time.Now()
+	_, err := c.run(c.command("sh", "-c", "sleep 30 & wait"))
+	if took := time.Since(start); took > killDelay {
+		t.Errorf("expected the command to be stopped, it took %s", took)
+	}
+
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || !cmdErr.TimedOut {
+		t.Fatalf("expected a CommandError that timed out, got %v", err)
+	}
+}
+
+func TestRunStops(t *testing.T) {
+	var c commander
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.run(c.command("sh", "-c", "sleep 30 & wait"))
+		errCh <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	c.Stop()
+
+	select {
+	case err := <-errCh:
+		var cmdErr *CommandError
+		if !errors.As(err, &cmdErr) || cmdErr.TimedOut {
+			t.Errorf("expected a CommandError that did not time out, got %v", err)
+		}
+	case <-time.After(killDelay):
+		t.Fatal("expected the command to be stopped")
+	}
+
+	if _, err := c.run(c.command("true")); err == nil {
+		t.Error("expected commands to fail once stopped")
+	}
+}
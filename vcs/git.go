@@ -3,16 +3,25 @@ package vcs
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"os/exec"
+	"net/url"
+	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const defaultRef = "master"
+
+// The ways that files stored in Git LFS can be checked out.
+const (
+	lfsSkip   = "skip"
+	lfsSmudge = "smudge"
+)
 const autoGeneratedAttribute = "linguist-generated"
 
 var headBranchRegexp = regexp.MustCompile(`HEAD branch: (?P<branch>.+)`)
@@ -22,9 +31,29 @@ func init() {
 }
 
 type GitDriver struct {
-	DetectRef     bool   `json:"detect-ref"`
-	Ref           string `json:"ref"`
+	DetectRef     bool     `json:"detect-ref"`
+	Ref           string   `json:"ref"`
+	Refs          []string `json:"refs"`
+	CommitHistory bool     `json:"commit-history"`
+	Submodules    bool     `json:"submodules"`
+	Lfs           string   `json:"lfs"`
+
+	// The credentials to fetch the repo with. The token is read from the
+	// file or the environment variable by git when it needs it, so that it
+	// is never part of the config.
+	SshKey        string `json:"ssh-key"`
+	SshKnownHosts string `json:"ssh-known-hosts"`
+	Username      string `json:"username"`
+	TokenFile     string `json:"token-file"`
+	TokenEnv      string `json:"token-env"`
+
 	refDetetector refDetetector
+
+	commander
+
+	// The globs of the paths that are checked out, see SetSparsePaths.
+	includePaths []string
+	excludePaths []string
 }
 
 type refDetetector interface {
@@ -32,8 +61,19 @@ type refDetetector interface {
 }
 
 type headBranchDetector struct {
+	// The environment for the git commands run in a directory.
+	env func(dir string) []string
+
+	// Runs the git commands.
+	cmds *commander
 }
 
+// The username that is sent along with a token when none is configured. Code
+// hosts generally ignore it for tokens.
+const defaultUsername = "git"
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
 func newGit(b []byte) (Driver, error) {
 	var d GitDriver
 
@@ -43,76 +83,575 @@ func newGit(b []byte) (Driver, error) {
 		}
 	}
 
-	d.refDetetector = &headBranchDetector{}
+	switch d.Lfs {
+	case "", lfsSkip, lfsSmudge:
+	default:
+		return nil, fmt.Errorf("git: lfs must be %q or %q, not %q", lfsSkip, lfsSmudge, d.Lfs)
+	}
+
+	if d.TokenFile != "" && d.TokenEnv != "" {
+		return nil, errors.New("git: only one of token-file and token-env may be set")
+	}
+
+	if d.TokenEnv != "" && !envNameRegexp.MatchString(d.TokenEnv) {
+		return nil, fmt.Errorf("git: token-env is not a valid environment variable name: %q", d.TokenEnv)
+	}
+
+	d.refDetetector = &headBranchDetector{env: d.env, cmds: &d.commander}
 
 	return &d, nil
 }
 
 func (g *GitDriver) HeadRev(dir string) (string, error) {
-	cmd := exec.Command(
+	cmd := g.command(
 		"git",
 		"rev-parse",
 		"HEAD")
 	cmd.Dir = dir
-	r, err := cmd.StdoutPipe()
+	out, err := g.run(cmd)
+	return strings.TrimSpace(string(out)), err
+}
+
+// Run a command in dir with the given environment, or the current process's
+// when env is nil. The output is what the command wrote to stdout, and the
+// error is a CommandError if it fails.
+func (c *commander) runWithEnv(desc, dir string, env []string, name string, args ...string) (string, error) {
+	cmd := c.command(name, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	out, err := c.run(cmd)
 	if err != nil {
+		log.Printf("Failed to %s at %q: %s", desc, cmd.Dir, err)
+	}
+
+	return string(out), err
+}
+
+func (g *GitDriver) Pull(dir string) (string, error) {
+	if len(g.Refs) > 0 {
+		return g.pullRefs(dir)
+	}
+
+	targetRef := g.targetRef(dir)
+
+	args := []string{"fetch", "--prune", "--no-tags"}
+	args = append(args, g.depthArgs(dir)...)
+	args = append(args, "origin", fmt.Sprintf("+%s:remotes/origin/%s", targetRef, targetRef))
+	if _, err := g.runWithEnv("git fetch", dir, g.env(dir), "git", args...); err != nil {
 		return "", err
 	}
-	defer r.Close()
 
-	if err := cmd.Start(); err != nil {
+	if err := g.sparseCheckout(dir); err != nil {
 		return "", err
 	}
 
-	var buf bytes.Buffer
+	if _, err := g.runWithEnv("git reset", dir, g.env(dir),
+		"git",
+		"reset",
+		"--hard",
+		fmt.Sprintf("origin/%s", targetRef)); err != nil {
+		return "", err
+	}
 
-	if _, err := io.Copy(&buf, r); err != nil {
+	if err := g.updateWorkTree(dir); err != nil {
 		return "", err
 	}
 
-	return strings.TrimSpace(buf.String()), cmd.Wait()
+	return g.HeadRev(dir)
+}
+
+// The environment for git commands run in dir, or nil to use the current
+// process's.
+func (g *GitDriver) env(dir string) []string {
+	var remote string
+	if g.hasToken() {
+		remote = g.remoteUrl(dir)
+	}
+	return g.envFor(remote)
+}
+
+// The environment for git commands that fetch from the remote url, or nil to
+// use the current process's. Credentials are only provided for its host.
+func (g *GitDriver) envFor(remote string) []string {
+	var env []string
+	if g.Lfs == lfsSkip {
+		env = append(env, "GIT_LFS_SKIP_SMUDGE=1")
+	}
+
+	if cmd := g.sshCommand(); cmd != "" {
+		env = append(env, "GIT_SSH_COMMAND="+cmd)
+	}
+
+	if prefix := credentialPrefix(remote); prefix != "" && g.hasToken() {
+		// The empty helper drops the helpers configured elsewhere, so that
+		// the token is not stored by them.
+		key := "credential." + prefix + ".helper"
+		env = append(env, gitConfigEnv(key, "", key, g.credentialHelper())...)
+		env = append(env, "GIT_TERMINAL_PROMPT=0")
+	}
+
+	if env == nil {
+		return nil
+	}
+	return append(os.Environ(), env...)
+}
+
+func (g *GitDriver) hasToken() bool {
+	return g.TokenFile != "" || g.TokenEnv != ""
+}
+
+// The ssh command that git uses to connect to ssh remotes, or the empty string
+// for the default.
+func (g *GitDriver) sshCommand() string {
+	if g.SshKey == "" && g.SshKnownHosts == "" {
+		return ""
+	}
+
+	cmd := "ssh"
+	if g.SshKey != "" {
+		cmd += " -i " + shellQuote(g.SshKey) + " -o IdentitiesOnly=yes"
+	}
+	if g.SshKnownHosts != "" {
+		cmd += " -o UserKnownHostsFile=" + shellQuote(g.SshKnownHosts) + " -o StrictHostKeyChecking=yes"
+	}
+	return cmd
 }
 
-func run(desc, dir, cmd string, args ...string) (string, error) {
-	c := exec.Command(cmd, args...)
-	c.Dir = dir
-	out, err := c.CombinedOutput()
+// A credential helper, in git's shell syntax, that answers with the username
+// and the token. The token is only read by the shell, so that it never passes
+// through hound.
+func (g *GitDriver) credentialHelper() string {
+	username := g.Username
+	if username == "" {
+		username = defaultUsername
+	}
+
+	password := "$" + g.TokenEnv
+	if g.TokenFile != "" {
+		password = "$(cat " + shellQuote(g.TokenFile) + ")"
+	}
+
+	return fmt.Sprintf(
+		`!f() { test "$1" = get && echo username=%s && echo "password=%s"; }; f`,
+		shellQuote(username),
+		password)
+}
+
+// The scheme and host of an http or https url, which credentials are scoped
+// to, or the empty string for other urls.
+func credentialPrefix(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// The url of the origin remote of the repo in dir.
+func (g *GitDriver) remoteUrl(dir string) string {
+	cmd := g.command("git", "remote", "get-url", "origin")
+	cmd.Dir = dir
+	out, err := g.run(cmd)
 	if err != nil {
-		log.Printf(
-			"Failed to %s %v at %q, see output below\n%s: %+v\nContinuing...",
-			desc,
-			c.Args, c.Dir,
-			out, err)
+		return ""
 	}
+	return strings.TrimSpace(string(out))
+}
 
-	return string(out), nil
+// The environment that adds the config to git's, after any config that the
+// environment of the process adds. kv holds pairs of keys and values.
+func gitConfigEnv(kv ...string) []string {
+	n, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+
+	var env []string
+	for i := 0; i+1 < len(kv); i += 2 {
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", n, kv[i]),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", n, kv[i+1]))
+		n++
+	}
+	return append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", n))
 }
 
-func (g *GitDriver) Pull(dir string) (string, error) {
-	targetRef := g.targetRef(dir)
+// Quote s for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
 
-	if _, err := run("git fetch", dir,
-		"git",
-		"fetch",
-		"--prune",
-		"--no-tags",
-		"--depth", "1",
-		"origin",
-		fmt.Sprintf("+%s:remotes/origin/%s", targetRef, targetRef)); err != nil {
+func (g *GitDriver) SetSparsePaths(include, exclude []string) {
+	g.includePaths = include
+	g.excludePaths = exclude
+}
+
+// The sparse-checkout patterns for the include and exclude paths, or nil if
+// the whole repo is checked out. The patterns are anchored at the root of the
+// repo and the excludes come last so that they take precedence.
+func (g *GitDriver) sparsePatterns() []string {
+	if len(g.includePaths) == 0 && len(g.excludePaths) == 0 {
+		return nil
+	}
+
+	var patterns []string
+	for _, path := range g.includePaths {
+		patterns = append(patterns, "/"+strings.Trim(path, "/"))
+	}
+	if len(patterns) == 0 {
+		patterns = append(patterns, "/*")
+	}
+
+	for _, path := range g.excludePaths {
+		patterns = append(patterns, "!/"+strings.Trim(path, "/"))
+	}
+	return patterns
+}
+
+// Apply the sparse-checkout patterns to a working directory, or turn sparse
+// checkout off if there are none and it was on. This must happen before the
+// working directory is reset so that excluded paths are never checked out.
+func (g *GitDriver) sparseCheckout(dir string) error {
+	patterns := g.sparsePatterns()
+	if patterns == nil {
+		// git config exits with an error when the option is not set.
+		cmd := g.command("git", "config", "--get", "core.sparseCheckout")
+		cmd.Dir = dir
+		if out, _ := g.run(cmd); strings.TrimSpace(string(out)) != "true" {
+			return nil
+		}
+		return g.git(dir, "sparse-checkout", "disable")
+	}
+
+	return g.git(dir, append([]string{"sparse-checkout", "set", "--no-cone"}, patterns...)...)
+}
+
+func (g *GitDriver) SparseFiles(dir string) ([]string, error) {
+	if g.sparsePatterns() == nil {
+		return nil, nil
+	}
+
+	cmd := g.command("git", "ls-files", "-t", "-z")
+	cmd.Dir = dir
+	out, err := g.run(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files that are not checked out are marked with S, for skip-worktree.
+	var files []string
+	for _, entry := range strings.Split(string(out), "\x00") {
+		if strings.HasPrefix(entry, "S ") {
+			files = append(files, entry[2:])
+		}
+	}
+	return files, nil
+}
+
+// Bring the submodules and the files in Git LFS of a working directory in
+// line with the commit that is checked out, as configured. Submodules are
+// checked out recursively at their path so they are indexed along with the
+// repo.
+func (g *GitDriver) updateWorkTree(dir string) error {
+	if g.Submodules {
+		if err := g.git(dir, "submodule", "sync", "--recursive"); err != nil {
+			return err
+		}
+
+		if err := g.git(dir,
+			"submodule",
+			"update",
+			"--init",
+			"--recursive",
+			"--force",
+			"--depth", "1"); err != nil {
+			return err
+		}
+	}
+
+	if g.Lfs == lfsSmudge {
+		if err := g.git(dir, "lfs", "pull"); err != nil {
+			return err
+		}
+
+		if g.Submodules {
+			if err := g.git(dir, "submodule", "foreach", "--recursive", "git lfs pull"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// The arguments that limit the history that is fetched. Only the latest commit
+// is fetched, unless the commit history is kept, in which case a shallow clone
+// is deepened to the full history.
+func (g *GitDriver) depthArgs(dir string) []string {
+	if !g.CommitHistory {
+		return []string{"--depth", "1"}
+	}
+
+	if g.isShallow(dir) {
+		return []string{"--unshallow"}
+	}
+	return nil
+}
+
+// Is the clone in dir shallow?
+func (g *GitDriver) isShallow(dir string) bool {
+	cmd := g.command("git", "rev-parse", "--is-shallow-repository")
+	cmd.Dir = dir
+	out, err := g.run(cmd)
+	return err == nil && strings.TrimSpace(string(out)) == "true"
+}
+
+// Fetch the branches that match any of the refs and check out the first one.
+func (g *GitDriver) pullRefs(dir string) (string, error) {
+	args := []string{"fetch", "--prune", "--no-tags"}
+	args = append(args, g.depthArgs(dir)...)
+	args = append(args, "origin")
+	for _, ref := range g.Refs {
+		args = append(args, fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", ref, ref))
+	}
+
+	if _, err := g.runWithEnv("git fetch", dir, g.env(dir), "git", args...); err != nil {
+		return "", err
+	}
+
+	refs, err := g.ListRefs(dir)
+	if err != nil {
 		return "", err
 	}
 
-	if _, err := run("git reset", dir,
+	if len(refs) == 0 {
+		return "", fmt.Errorf("no branches match %s", strings.Join(g.Refs, ", "))
+	}
+
+	return g.Checkout(dir, refs[0])
+}
+
+// Does the branch name match the ref? Like a git refspec, a ref may contain a
+// single * that matches any part of a name, including slashes.
+func matchRef(ref, name string) bool {
+	i := strings.Index(ref, "*")
+	if i < 0 {
+		return ref == name
+	}
+
+	prefix, suffix := ref[:i], ref[i+1:]
+	return len(name) >= len(prefix)+len(suffix) &&
+		strings.HasPrefix(name, prefix) &&
+		strings.HasSuffix(name, suffix)
+}
+
+// Is the branch one of the refs that are indexed? This is only meaningful
+// when refs are configured.
+func (g *GitDriver) MatchesRefs(name string) bool {
+	for _, ref := range g.Refs {
+		if matchRef(ref, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the fetched branches that match the refs, in the order of the refs
+// and then by name. Returns nil if refs are not configured.
+func (g *GitDriver) ListRefs(dir string) ([]string, error) {
+	if len(g.Refs) == 0 {
+		return nil, nil
+	}
+
+	cmd := g.command(
 		"git",
-		"reset",
-		"--hard",
-		fmt.Sprintf("origin/%s", targetRef)); err != nil {
+		"for-each-ref",
+		"--format=%(refname)",
+		"refs/remotes/origin/")
+	cmd.Dir = dir
+	out, err := g.run(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, line := range strings.Split(string(out), "\n") {
+		name := strings.TrimPrefix(strings.TrimSpace(line), "refs/remotes/origin/")
+		if name != "" && name != "HEAD" {
+			names = append(names, name)
+		}
+	}
+
+	refs := []string{}
+	seen := map[string]bool{}
+	for _, ref := range g.Refs {
+		for _, name := range names {
+			if !seen[name] && matchRef(ref, name) {
+				seen[name] = true
+				refs = append(refs, name)
+			}
+		}
+	}
+
+	return refs, nil
+}
+
+// Separators of the records and fields in the output of git log.
+const (
+	logRecordSep = "\x1e"
+	logFieldSep  = "\x1f"
+)
+
+// Return the commits that lead up to rev along with the paths they touched,
+// newest first. Returns nil unless the commit history is kept.
+func (g *GitDriver) Log(dir, rev string) ([]*Commit, error) {
+	if !g.CommitHistory {
+		return nil, nil
+	}
+
+	cmd := g.command(
+		"git",
+		"-c", "core.quotePath=false",
+		"log",
+		"--name-only",
+		"--no-renames",
+		"--format="+logRecordSep+"%H"+logFieldSep+"%an"+logFieldSep+"%ae"+logFieldSep+"%at"+logFieldSep+"%B"+logFieldSep,
+		rev)
+	cmd.Dir = dir
+	out, err := g.run(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLog(string(out))
+}
+
+// Parse the output of git log in the format used by Log.
+func parseLog(out string) ([]*Commit, error) {
+	var commits []*Commit
+	for _, rec := range strings.Split(out, logRecordSep) {
+		if strings.TrimSpace(rec) == "" {
+			continue
+		}
+
+		fields := strings.SplitN(rec, logFieldSep, 6)
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("unexpected git log record: %q", rec)
+		}
+
+		secs, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		c := &Commit{
+			Rev:     fields[0],
+			Author:  fields[1],
+			Email:   fields[2],
+			Date:    time.Unix(secs, 0).UTC(),
+			Message: strings.TrimSpace(fields[4]),
+		}
+
+		for _, path := range strings.Split(fields[5], "\n") {
+			if path != "" {
+				c.Paths = append(c.Paths, path)
+			}
+		}
+
+		commits = append(commits, c)
+	}
+
+	return commits, nil
+}
+
+// Run a git command in dir, returning a CommandError if it fails.
+func (g *GitDriver) git(dir string, args ...string) error {
+	cmd := g.command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = g.env(dir)
+	_, err := g.run(cmd)
+	return err
+}
+
+// Check out a fetched branch and return its revision.
+func (g *GitDriver) Checkout(dir, ref string) (string, error) {
+	if err := g.sparseCheckout(dir); err != nil {
+		return "", err
+	}
+
+	if err := g.git(dir, "reset", "--hard", fmt.Sprintf("origin/%s", ref)); err != nil {
+		return "", err
+	}
+
+	if err := g.updateWorkTree(dir); err != nil {
 		return "", err
 	}
 
 	return g.HeadRev(dir)
 }
 
+// Fetch rev, which is a tag, a branch or a full commit id, and check it out
+// into a new worktree that shares the clone's objects.
+func (g *GitDriver) AddWorktree(dir, wtDir, rev string) (string, error) {
+	// Forget worktrees whose directories were removed without git knowing.
+	if err := g.git(dir, "worktree", "prune"); err != nil {
+		return "", err
+	}
+
+	// The rev is fetched into a ref of its own so that polling, which also
+	// fetches, cannot interfere. Only a clone that is already shallow is
+	// fetched into shallowly, since a full clone keeps the commit history.
+	tmpRef := "refs/hound/" + filepath.Base(wtDir)
+	args := []string{"fetch", "--no-tags"}
+	if g.isShallow(dir) {
+		args = append(args, "--depth", "1")
+	}
+	args = append(args, "origin", fmt.Sprintf("+%s:%s", rev, tmpRef))
+	if err := g.git(dir, args...); err != nil {
+		return "", err
+	}
+	defer g.git(dir, "update-ref", "-d", tmpRef) //nolint
+
+	if g.sparsePatterns() == nil {
+		if err := g.git(dir, "worktree", "add", "--detach", wtDir, tmpRef); err != nil {
+			return "", err
+		}
+	} else {
+		// Sparse checkout is set up for each worktree before any of the
+		// files are checked out.
+		if err := g.git(dir, "worktree", "add", "--no-checkout", "--detach", wtDir, tmpRef); err != nil {
+			return "", err
+		}
+
+		if err := g.sparseCheckout(wtDir); err != nil {
+			return "", err
+		}
+
+		if err := g.git(wtDir, "reset", "--hard"); err != nil {
+			return "", err
+		}
+	}
+
+	if err := g.updateWorkTree(wtDir); err != nil {
+		return "", err
+	}
+
+	return g.HeadRev(wtDir)
+}
+
+// Remove a worktree that was created by AddWorktree.
+func (g *GitDriver) RemoveWorktree(dir, wtDir string) error {
+	return g.git(dir, "worktree", "remove", "--force", wtDir)
+}
+
+// The ref that is indexed, given the default branch of the remote for when the
+// ref is detected. This is empty if the default branch is needed but unknown.
+func (g *GitDriver) IndexedRef(defaultBranch string) string {
+	if g.Ref != "" {
+		return g.Ref
+	} else if g.DetectRef {
+		return defaultBranch
+	}
+	return defaultRef
+}
+
 func (g *GitDriver) targetRef(dir string) string {
 	var targetRef string
 	if g.Ref != "" {
@@ -130,16 +669,22 @@ func (g *GitDriver) targetRef(dir string) string {
 
 func (g *GitDriver) Clone(dir, url string) (string, error) {
 	par, rep := filepath.Split(dir)
-	cmd := exec.Command(
-		"git",
-		"clone",
-		"--depth", "1",
-		url,
-		rep)
+	args := []string{"clone", "--depth", "1"}
+	if g.Submodules {
+		args = append(args, "--recurse-submodules", "--shallow-submodules")
+	}
+	if g.sparsePatterns() != nil {
+		// The files are checked out by the pull that follows, once the
+		// sparse-checkout patterns are set.
+		args = append(args, "--no-checkout")
+	}
+	args = append(args, url, rep)
+
+	cmd := g.command("git", args...)
 	cmd.Dir = par
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("Failed to clone %s, see output below\n%sContinuing...", url, out)
+	cmd.Env = g.envFor(url)
+	if _, err := g.run(cmd); err != nil {
+		log.Printf("Failed to clone %s: %s", url, err)
 		return "", err
 	}
 
@@ -155,25 +700,20 @@ func (g *GitDriver) SpecialFiles() []string {
 func (g *GitDriver) AutoGeneratedFiles(dir string) []string {
 	var files []string
 
-	filesCmd := exec.Command("git", "ls-files", "-z");
+	filesCmd := g.command("git", "ls-files", "-z");
 	filesCmd.Dir = dir
-	pipe, err := filesCmd.StdoutPipe();
+	paths, err := g.run(filesCmd)
 
 	if err != nil {
 		log.Printf("Error occured when running git ls-files in %s: %s.", dir, err)
 		return files
 	}
 
-	if err := filesCmd.Start(); err != nil {
-		log.Printf("Error occured when running git ls-files in %s: %s.", dir, err)
-		return files
-	}
-
-	attributesCmd := exec.Command("git", "check-attr", "--stdin", "-z", autoGeneratedAttribute);
+	attributesCmd := g.command("git", "check-attr", "--stdin", "-z", autoGeneratedAttribute);
 	attributesCmd.Dir = dir
-	attributesCmd.Stdin = pipe
+	attributesCmd.Stdin = bytes.NewReader(paths)
 
-	out, err := attributesCmd.Output()
+	out, err := g.run(attributesCmd)
 
 	if err != nil {
 		log.Printf("Error occured when running git check-attr in %s: %s.", dir, err)
@@ -189,16 +729,42 @@ func (g *GitDriver) AutoGeneratedFiles(dir string) []string {
 		}
 	}
 
-	if err := filesCmd.Wait(); err != nil {
-		log.Printf("Error occured when running git ls-files in %s: %s.", dir, err)
-		return files
+	return files
+}
+
+func (g *GitDriver) ChangedFiles(dir, fromRev, toRev string) ([]string, error) {
+	// A diff of the repo only shows that a submodule moved, not the files
+	// within it that changed.
+	if g.Submodules {
+		return nil, ErrChangesUnknown
 	}
 
-	return files
+	cmd := g.command(
+		"git",
+		"diff",
+		"--name-only",
+		"--no-renames",
+		"-z",
+		fromRev,
+		toRev)
+	cmd.Dir = dir
+	out, err := g.run(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, file := range bytes.Split(out, []byte{0}) {
+		if len(file) > 0 {
+			files = append(files, filepath.FromSlash(string(file)))
+		}
+	}
+
+	return files, nil
 }
 
 func (d *headBranchDetector) detectRef(dir string) string {
-	output, err := run("git show remote info", dir,
+	output, err := d.cmds.runWithEnv("git show remote info", dir, d.env(dir),
 		"git",
 		"remote",
 		"show",
@@ -2,6 +2,9 @@ package vcs
 
 import (
 	"fmt"
+	"os"
+	"os/exec"
+	"strings"
 	"testing"
 )
 
@@ -83,3 +86,129 @@ func TestTargetRef(t *testing.T) {
 		})
 	}
 }
+
+func TestMatchRef(t *testing.T) {
+	testCases := []struct {
+		ref      string
+		name     string
+		expected bool
+	}{
+		{"main", "main", true},
+		{"main", "maint", false},
+		{"release/*", "release/1.0", true},
+		{"release/*", "release/1.0/hotfix", true},
+		{"release/*", "release", false},
+		{"*-stable", "v2-stable", true},
+		{"*-stable", "v2-unstable", false},
+		{"*-stable", "stable", false},
+	}
+	for _, testCase := range testCases {
+		if got := matchRef(testCase.ref, testCase.name); got != testCase.expected {
+			t.Errorf("matchRef(%q, %q): expected %v, got %v", testCase.ref, testCase.name, testCase.expected, got)
+		}
+	}
+}
+
+func TestParseLog(t *testing.T) {
+	out := logRecordSep + "abc" + logFieldSep + "Alice" + logFieldSep + "alice@example.com" + logFieldSep + "1700000000" + logFieldSep +
+		"Fix the parser\n\nIt was broken.\n" + logFieldSep + "\n\nparser.go\ndocs/parser.md\n" +
+		logRecordSep + "def" + logFieldSep + "Bob" + logFieldSep + "bob@example.com" + logFieldSep + "1600000000" + logFieldSep +
+		"Merge branch 'x'\n" + logFieldSep + "\n"
+
+	commits, err := parseLog(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(commits) != 2 {
+		t.Fatalf("expected 2 commits, got %d", len(commits))
+	}
+
+	c := commits[0]
+	if c.Rev != "abc" || c.Author != "Alice" || c.Email != "alice@example.com" || c.Date.Unix() != 1700000000 {
+		t.Errorf("unexpected commit: %+v", c)
+	}
+
+	if c.Message != "Fix the parser\n\nIt was broken." {
+		t.Errorf("unexpected message: %q", c.Message)
+	}
+
+	if fmt.Sprint(c.Paths) != "[parser.go docs/parser.md]" {
+		t.Errorf("unexpected paths: %v", c.Paths)
+	}
+
+	if len(commits[1].Paths) != 0 {
+		t.Errorf("expected no paths for a merge, got %v", commits[1].Paths)
+	}
+
+	if _, err := parseLog(logRecordSep + "abc" + logFieldSep + "Alice"); err == nil {
+		t.Error("expected an error for a truncated record")
+	}
+}
+
+func TestLfsOption(t *testing.T) {
+	for cfg, valid := range map[string]bool{
+		`{}`:                true,
+		`{"lfs": "skip"}`:   true,
+		`{"lfs": "smudge"}`: true,
+		`{"lfs": "fetch"}`:  false,
+	} {
+		_, err := newGit([]byte(cfg))
+		if valid && err != nil {
+			t.Errorf("expected %s to be valid, got %s", cfg, err)
+		} else if !valid && err == nil {
+			t.Errorf("expected %s to be invalid", cfg)
+		}
+	}
+}
+
+func TestGitCredentials(t *testing.T) {
+	for cfg, valid := range map[string]bool{
+		`{"token-env": "GIT_TOKEN"}`:                          true,
+		`{"token-file": "/etc/token"}`:                        true,
+		`{"token-env": "$(reboot)"}`:                          false,
+		`{"token-env": "A", "token-file": "/etc/token"}`:      false,
+		`{"ssh-key": "/keys/id", "ssh-known-hosts": "/keys"}`: true,
+	} {
+		_, err := newGit([]byte(cfg))
+		if valid && err != nil {
+			t.Errorf("expected %s to be valid, got %s", cfg, err)
+		} else if !valid && err == nil {
+			t.Errorf("expected %s to be invalid", cfg)
+		}
+	}
+
+	d, err := newGit([]byte(`{"ssh-key": "/keys/it's", "username": "bot", "token-env": "HOUND_TEST_TOKEN"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := d.(*GitDriver)
+
+	env := strings.Join(g.envFor("https://git.example.com/org/repo.git"), "\n")
+	for _, expected := range []string{
+		`GIT_SSH_COMMAND=ssh -i '/keys/it'\''s' -o IdentitiesOnly=yes`,
+		"credential.https://git.example.com.helper",
+		"GIT_TERMINAL_PROMPT=0",
+	} {
+		if !strings.Contains(env, expected) {
+			t.Errorf("expected the environment to contain %s", expected)
+		}
+	}
+
+	if env := strings.Join(g.envFor("git@git.example.com:org/repo.git"), "\n"); strings.Contains(env, "credential.") {
+		t.Errorf("expected no credentials for ssh urls, got %s", env)
+	}
+
+	// The helper reads the token itself, so that hound never holds it.
+	helper := g.credentialHelper()
+	cmd := exec.Command("sh", "-c", strings.TrimPrefix(helper, "!")+" get")
+	cmd.Env = append(os.Environ(), "HOUND_TEST_TOKEN=t0ken")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(out) != "username=bot\npassword=t0ken\n" {
+		t.Errorf("unexpected credential helper output: %q", out)
+	}
+}
@@ -0,0 +1,240 @@
+package vcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/hound-search/hound/gitrepo"
+)
+
+func init() {
+	Register(newGitNative, "git-native")
+}
+
+// A git driver that reads and fetches repos itself instead of running git. It
+// fetches only the latest commit of a branch, from local repos and over http
+// or https.
+type GitNativeDriver struct {
+	DetectRef bool   `json:"detect-ref"`
+	Ref       string `json:"ref"`
+
+	// Keep the repo without a working directory, so that files are indexed
+	// and searched straight from its objects.
+	Bare bool `json:"bare"`
+
+	// Fetches are given the command timeout, and stopped along with the
+	// driver, like the commands of the other drivers.
+	commander
+}
+
+func newGitNative(b []byte) (Driver, error) {
+	var d GitNativeDriver
+
+	if b != nil {
+		if err := json.Unmarshal(b, &d); err != nil {
+			return nil, err
+		}
+	}
+
+	return &d, nil
+}
+
+func (g *GitNativeDriver) HeadRev(dir string) (string, error) {
+	r, err := gitrepo.Open(dir)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	id, err := r.Head()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// The branch to fetch, or the empty string for the remote's default branch.
+func (g *GitNativeDriver) branch() string {
+	if g.Ref != "" {
+		return g.Ref
+	} else if g.DetectRef {
+		return ""
+	}
+	return defaultRef
+}
+
+func (g *GitNativeDriver) Pull(dir string) (string, error) {
+	r, err := gitrepo.Open(dir)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	url, err := r.RemoteURL()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(g.context(), g.commandTimeout())
+	defer cancel()
+
+	id, _, err := r.Fetch(ctx, url, g.branch())
+	if err != nil {
+		return "", err
+	}
+
+	if g.Bare {
+		err = r.SetHead(id)
+	} else {
+		err = r.Checkout(id)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return id.String(), nil
+}
+
+// The packs of earlier commits are kept until they are pruned, since indexes
+// of trees read from them and the files that changed since an indexed commit
+// are found from it.
+func (g *GitNativeDriver) Prune(dir string, keep []string) error {
+	r, err := gitrepo.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	head, err := r.Head()
+	if err != nil {
+		return err
+	}
+
+	ids := []gitrepo.ID{head}
+	for _, rev := range keep {
+		id, err := gitrepo.ParseID(rev)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	return r.Prune(ids...)
+}
+
+func (g *GitNativeDriver) Clone(dir, url string) (string, error) {
+	if err := gitrepo.Init(dir, url); err != nil {
+		return "", err
+	}
+	return g.Pull(dir)
+}
+
+func (g *GitNativeDriver) SpecialFiles() []string {
+	return []string{
+		".git",
+	}
+}
+
+func (g *GitNativeDriver) AutoGeneratedFiles(dir string) []string {
+	r, err := gitrepo.Open(dir)
+	if err != nil {
+		log.Printf("Error occured when reading attributes in %s: %s.", dir, err)
+		return nil
+	}
+	defer r.Close()
+
+	id, err := r.Head()
+	if err == nil {
+		var files []string
+		if files, err = r.FilesWithAttribute(id, autoGeneratedAttribute); err == nil {
+			return files
+		}
+	}
+
+	log.Printf("Error occured when reading attributes in %s: %s.", dir, err)
+	return nil
+}
+
+func (g *GitNativeDriver) ChangedFiles(dir, fromRev, toRev string) ([]string, error) {
+	r, err := gitrepo.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	from, err := gitrepo.ParseID(fromRev)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := gitrepo.ParseID(toRev)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the latest commits are kept, so older ones may be gone.
+	files, err := r.ChangedFiles(from, to)
+	if errors.Is(err, gitrepo.ErrObjectNotFound) {
+		return nil, ErrChangesUnknown
+	} else if err != nil {
+		return nil, err
+	}
+
+	for i, file := range files {
+		files[i] = filepath.FromSlash(file)
+	}
+	return files, nil
+}
+
+func (g *GitNativeDriver) OpenTree(dir, rev string) (Tree, error) {
+	if !g.Bare {
+		return nil, nil
+	}
+
+	id, err := gitrepo.ParseID(rev)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := gitrepo.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gitTree{repo: r, id: id}, nil
+}
+
+// The files of a commit, read from the repo's objects.
+type gitTree struct {
+	repo *gitrepo.Repo
+	id   gitrepo.ID
+}
+
+func (t *gitTree) Walk(fn func(path string, mode os.FileMode, blob string) error) error {
+	return t.repo.Walk(t.id, func(path string, e gitrepo.TreeEntry) error {
+		var mode os.FileMode = 0644
+		switch e.Mode {
+		case gitrepo.ModeSymlink:
+			mode = os.ModeSymlink
+		case gitrepo.ModeExec:
+			mode = 0755
+		}
+		return fn(path, mode, e.ID.String())
+	})
+}
+
+func (t *gitTree) ReadBlob(blob string) ([]byte, error) {
+	id, err := gitrepo.ParseID(blob)
+	if err != nil {
+		return nil, err
+	}
+	return t.repo.Blob(id)
+}
+
+func (t *gitTree) Close() error {
+	return t.repo.Close()
+}
@@ -1,10 +1,6 @@
 package vcs
 
 import (
-	"bytes"
-	"io"
-	"io/ioutil"
-	"os/exec"
 	"path/filepath"
 	"strings"
 )
@@ -13,14 +9,16 @@ func init() {
 	Register(newHg, "hg", "mercurial")
 }
 
-type MercurialDriver struct{}
+type MercurialDriver struct {
+	commander
+}
 
 func newHg(b []byte) (Driver, error) {
 	return &MercurialDriver{}, nil
 }
 
 func (g *MercurialDriver) HeadRev(dir string) (string, error) {
-	cmd := exec.Command(
+	cmd := g.command(
 		"hg",
 		"log",
 		"-r",
@@ -28,30 +26,14 @@ func (g *MercurialDriver) HeadRev(dir string) (string, error) {
 		"--template",
 		"{node}")
 	cmd.Dir = dir
-	r, err := cmd.StdoutPipe()
-	if err != nil {
-		return "", err
-	}
-	defer r.Close()
-
-	if err := cmd.Start(); err != nil {
-		return "", err
-	}
-
-	var buf bytes.Buffer
-
-	if _, err := io.Copy(&buf, r); err != nil {
-		return "", err
-	}
-
-	return strings.TrimSpace(buf.String()), cmd.Wait()
+	out, err := g.run(cmd)
+	return strings.TrimSpace(string(out)), err
 }
 
 func (g *MercurialDriver) Pull(dir string) (string, error) {
-	cmd := exec.Command("hg", "pull", "-u")
+	cmd := g.command("hg", "pull", "-u")
 	cmd.Dir = dir
-	err := cmd.Run()
-	if err != nil {
+	if _, err := g.run(cmd); err != nil {
 		return "", err
 	}
 
@@ -60,14 +42,13 @@ func (g *MercurialDriver) Pull(dir string) (string, error) {
 
 func (g *MercurialDriver) Clone(dir, url string) (string, error) {
 	par, rep := filepath.Split(dir)
-	cmd := exec.Command(
+	cmd := g.command(
 		"hg",
 		"clone",
 		url,
 		rep)
 	cmd.Dir = par
-	cmd.Stdout = ioutil.Discard
-	if err := cmd.Run(); err != nil {
+	if _, err := g.run(cmd); err != nil {
 		return "", err
 	}
 
@@ -83,3 +64,29 @@ func (g *MercurialDriver) SpecialFiles() []string {
 func (g *MercurialDriver) AutoGeneratedFiles(dir string) []string {
 	return []string{}
 }
+
+func (g *MercurialDriver) ChangedFiles(dir, fromRev, toRev string) ([]string, error) {
+	cmd := g.command(
+		"hg",
+		"status",
+		"--rev", fromRev,
+		"--rev", toRev,
+		"--modified",
+		"--added",
+		"--removed",
+		"--no-status")
+	cmd.Dir = dir
+	out, err := g.run(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, file := range strings.Split(string(out), "\n") {
+		if file != "" {
+			files = append(files, filepath.FromSlash(file))
+		}
+	}
+
+	return files, nil
+}
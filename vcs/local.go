@@ -8,10 +8,11 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 
-	"golang.org/x/mod/sumdb/dirhash"
+	"github.com/hound-search/hound/ignore"
 )
 
 func init() {
@@ -21,6 +22,12 @@ func init() {
 type LocalDriver struct {
 	WatchChanges bool     `json:"watch-changes"`
 	IgnoredFiles []string `json:"ignored-files"`
+
+	// The names of the ignore files whose patterns are not hashed.
+	ignoreFiles []string
+
+	// The include and exclude paths, the files they leave out are not hashed.
+	paths ignore.Paths
 }
 
 func newLocal(b []byte) (Driver, error) {
@@ -77,10 +84,79 @@ func (g *LocalDriver) HeadRev(dir string) (string, error) {
 		}
 	}
 
-	// Hash all files in the directory
-	// TODO: implement logic from indexAllFiles to skip ignored files?
-	hash, err := dirhash.HashDir(dir, "", myHash)
-	return hash, err
+	// Hash all files in the directory that are indexed, so that changes to
+	// ignored files do not cause a reindex.
+	files, err := g.listFiles(dir)
+	if err != nil {
+		return "", err
+	}
+
+	return myHash(files, func(name string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(dir, name))
+	})
+}
+
+func (g *LocalDriver) SetIgnoreFiles(names []string) {
+	g.ignoreFiles = names
+}
+
+// The whole directory is linked rather than checked out, so the include and
+// exclude paths only limit the files that HeadRev hashes.
+func (g *LocalDriver) SetSparsePaths(include, exclude []string) {
+	g.paths = ignore.Paths{Include: include, Exclude: exclude}
+}
+
+func (g *LocalDriver) SparseFiles(dir string) ([]string, error) {
+	return nil, nil
+}
+
+// List the regular files in dir, relative to dir and slash separated, that are
+// neither special, ignored nor left out by the include and exclude paths.
+func (g *LocalDriver) listFiles(dir string) ([]string, error) {
+	ignored := ignore.New(g.ignoreFiles...)
+
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			return ignored.Load(dir, rel)
+		}
+
+		if containsString(g.IgnoredFiles, info.Name()) || g.paths.Excludes(rel, info.IsDir()) ||
+			ignored.Match(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			return ignored.Load(dir, rel)
+		}
+
+		if info.Mode().IsRegular() {
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return files, err
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
 }
 
 func (g *LocalDriver) Pull(dir string) (string, error) {
@@ -105,3 +181,7 @@ func (g *LocalDriver) SpecialFiles() []string {
 func (g *LocalDriver) AutoGeneratedFiles(dir string) []string {
 	return []string{}
 }
+
+func (g *LocalDriver) ChangedFiles(dir, fromRev, toRev string) ([]string, error) {
+	return nil, ErrChangesUnknown
+}
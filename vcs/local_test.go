@@ -0,0 +1,114 @@
+package vcs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Tests that changes to ignored files do not change the rev of a local repo.
+func TestLocalHeadRevIgnoresFiles(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(".houndignore", "build/\n*.log\n")
+	write("main.go", "package main\n")
+
+	wd, err := New("local", []byte(`{"watch-changes": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd.SetIgnoreFiles([]string{".houndignore"})
+
+	rev, err := wd.HeadRev(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("build/out.bin", "alpha")
+	write("debug.log", "bravo")
+
+	if got, err := wd.HeadRev(dir); err != nil {
+		t.Fatal(err)
+	} else if got != rev {
+		t.Fatalf("expected rev of %s after changing ignored files, got %s", rev, got)
+	}
+
+	write("main.go", "package main\n\nfunc main() {}\n")
+
+	if got, err := wd.HeadRev(dir); err != nil {
+		t.Fatal(err)
+	} else if got == rev {
+		t.Fatal("expected the rev to change after changing main.go")
+	}
+}
+
+// Tests that changes to files that are left out by the include and exclude
+// paths, or that are special, do not change the rev of a local repo.
+func TestLocalHeadRevExcludesPaths(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("src/main.go", "package main\n")
+	write("src/vendor/lib.go", "package lib\n")
+	write("docs/index.md", "# Docs\n")
+	write("src/.hg/store", "alpha")
+
+	wd, err := New("local", []byte(`{"watch-changes": true, "ignored-files": [".hg"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd.SetSparsePaths([]string{"src"}, []string{"**/vendor"})
+
+	rev, err := wd.HeadRev(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("src/vendor/lib.go", "package lib\n\nfunc Lib() {}\n")
+	write("docs/index.md", "# More docs\n")
+	write("src/.hg/store", "bravo")
+
+	if got, err := wd.HeadRev(dir); err != nil {
+		t.Fatal(err)
+	} else if got != rev {
+		t.Fatalf("expected rev of %s after changing excluded files, got %s", rev, got)
+	}
+
+	write("src/main.go", "package main\n\nfunc main() {}\n")
+
+	if got, err := wd.HeadRev(dir); err != nil {
+		t.Fatal(err)
+	} else if got == rev {
+		t.Fatal("expected the rev to change after changing src/main.go")
+	}
+}
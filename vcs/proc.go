@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package vcs
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Run the command in a process group of its own, so that it can be stopped
+// along with the processes it starts.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Ask the process group of a command that was started by setProcessGroup to
+// exit.
+func terminateProcessGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGTERM)
+}
+
+// Kill the process group of a command that was started by setProcessGroup.
+func killProcessGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,19 @@
+package vcs
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Processes are not grouped on Windows, and cannot be asked to exit, so only
+// the command itself is killed.
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+func terminateProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
+
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
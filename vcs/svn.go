@@ -1,11 +1,8 @@
 package vcs
 
 import (
-	"bytes"
 	"encoding/json"
-	"io"
 	"log"
-	"os/exec"
 	"path/filepath"
 	"strings"
 )
@@ -17,6 +14,8 @@ func init() {
 type SVNDriver struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+
+	commander
 }
 
 func newSvn(b []byte) (Driver, error) {
@@ -32,30 +31,15 @@ func newSvn(b []byte) (Driver, error) {
 }
 
 func (g *SVNDriver) HeadRev(dir string) (string, error) {
-	cmd := exec.Command(
+	cmd := g.command(
 		"svnversion")
 	cmd.Dir = dir
-	r, err := cmd.StdoutPipe()
-	if err != nil {
-		return "", err
-	}
-	defer r.Close()
-
-	if err := cmd.Start(); err != nil {
-		return "", err
-	}
-
-	var buf bytes.Buffer
-
-	if _, err := io.Copy(&buf, r); err != nil {
-		return "", err
-	}
-
-	return strings.TrimSpace(buf.String()), cmd.Wait()
+	out, err := g.run(cmd)
+	return strings.TrimSpace(string(out)), err
 }
 
 func (g *SVNDriver) Pull(dir string) (string, error) {
-	cmd := exec.Command(
+	cmd := g.command(
 		"svn",
 		"update",
 		"--ignore-externals",
@@ -64,9 +48,8 @@ func (g *SVNDriver) Pull(dir string) (string, error) {
 		"--password",
 		g.Password)
 	cmd.Dir = dir
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("Failed to SVN update %s, see output below\n%sContinuing...", dir, out)
+	if _, err := g.run(cmd); err != nil {
+		log.Printf("Failed to SVN update %s: %s", dir, err)
 		return "", err
 	}
 
@@ -75,7 +58,7 @@ func (g *SVNDriver) Pull(dir string) (string, error) {
 
 func (g *SVNDriver) Clone(dir, url string) (string, error) {
 	par, rep := filepath.Split(dir)
-	cmd := exec.Command(
+	cmd := g.command(
 		"svn",
 		"checkout",
 		"--ignore-externals",
@@ -86,9 +69,8 @@ func (g *SVNDriver) Clone(dir, url string) (string, error) {
 		url,
 		rep)
 	cmd.Dir = par
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("Failed to checkout %s, see output below\n%sContinuing...", url, out)
+	if _, err := g.run(cmd); err != nil {
+		log.Printf("Failed to checkout %s: %s", url, err)
 		return "", err
 	}
 
@@ -104,3 +86,7 @@ func (g *SVNDriver) SpecialFiles() []string {
 func (g *SVNDriver) AutoGeneratedFiles(dir string) []string {
 	return []string{}
 }
+
+func (g *SVNDriver) ChangedFiles(dir, fromRev, toRev string) ([]string, error) {
+	return nil, ErrChangesUnknown
+}
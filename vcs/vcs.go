@@ -1,9 +1,15 @@
 package vcs
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"os/exec"
+	"strings"
+	"time"
 )
 
 // A collection that maps vcs names to their underlying
@@ -11,6 +17,74 @@ import (
 // json config passed in to be parsed.
 var drivers = make(map[string]func(c []byte) (Driver, error))
 
+// Returned by drivers that are unable to determine which files changed
+// between two revisions.
+var ErrChangesUnknown = errors.New("vcs: changed files are unknown")
+
+// The most of a failed command's stderr that is kept in a CommandError. The
+// end of the output is kept, since that is usually where the cause is.
+const maxStderrLen = 4096
+
+// Returned by drivers when a vcs command fails.
+type CommandError struct {
+	// The command line, with passwords redacted.
+	Command string
+
+	// The exit code of the command, or -1 if it could not be run or was
+	// killed.
+	ExitCode int
+
+	// What the command wrote to stderr, trimmed.
+	Stderr string
+
+	// Was the command killed because it ran for too long?
+	TimedOut bool `json:",omitempty"`
+}
+
+func (e *CommandError) Error() string {
+	status := fmt.Sprintf("exit code %d", e.ExitCode)
+	if e.TimedOut {
+		status = "timed out"
+	}
+
+	if e.Stderr == "" {
+		return fmt.Sprintf("%s: %s", e.Command, status)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Command, status, e.Stderr)
+}
+
+// Create a CommandError for a command that failed with err.
+func newCommandError(args []string, stderr []byte, err error) *CommandError {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		if i > 0 && args[i-1] == "--password" {
+			arg = "xxxxx"
+		} else if u, err := url.Parse(arg); err == nil && u.User != nil {
+			arg = u.Redacted()
+		}
+		redacted[i] = arg
+	}
+
+	e := &CommandError{
+		Command:  strings.Join(redacted, " "),
+		ExitCode: -1,
+		Stderr:   string(bytes.TrimSpace(stderr)),
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		e.ExitCode = exitErr.ExitCode()
+	} else if e.Stderr == "" {
+		e.Stderr = err.Error()
+	}
+
+	if len(e.Stderr) > maxStderrLen {
+		e.Stderr = "..." + e.Stderr[len(e.Stderr)-maxStderrLen:]
+	}
+
+	return e
+}
+
 // A "plugin" for each vcs that supports the very limited set of vcs
 // operations that hound needs.
 type Driver interface {
@@ -30,6 +104,120 @@ type Driver interface {
 	// Return a list of filenames that are marked as auto-generated.
 	AutoGeneratedFiles(dir string) []string
 
+	// Return the files, relative to the vcs directory, that were added, modified
+	// or removed between two revisions. Drivers that are unable to do so return
+	// ErrChangesUnknown.
+	ChangedFiles(dir, fromRev, toRev string) ([]string, error)
+}
+
+// Implemented by drivers that can index several refs of a repo from a single
+// working directory.
+type RefsDriver interface {
+
+	// Return the refs to index as of the last pull, in the order they are
+	// configured, or nil if only the working directory as pulled is indexed.
+	ListRefs(dir string) ([]string, error)
+
+	// Check out a ref in the working directory and return its revision.
+	Checkout(dir, ref string) (string, error)
+}
+
+// Implemented by drivers that can check out any revision of a repo, such as a
+// tag, next to the working directory.
+type WorktreeDriver interface {
+
+	// Check out rev into a new directory, wtDir, using the repo in the
+	// working directory dir and return the revision it resolved to.
+	AddWorktree(dir, wtDir, rev string) (string, error)
+
+	// Remove a directory that was created by AddWorktree.
+	RemoveWorktree(dir, wtDir string) error
+}
+
+// A commit in the history of a repo and the paths it touched.
+type Commit struct {
+	Rev     string
+	Author  string
+	Email   string
+	Date    time.Time
+	Message string
+	Paths   []string
+}
+
+// Implemented by drivers that can report the history of a repo.
+type HistoryDriver interface {
+
+	// Return the commits that lead up to rev, newest first, or nil if the
+	// driver is not configured to keep the history.
+	Log(dir, rev string) ([]*Commit, error)
+}
+
+// Implemented by drivers that can check out only part of a repo.
+type SparseDriver interface {
+
+	// Limit the checkouts of the repo to the paths that match the include
+	// globs, or every path if there are none, and none of the exclude
+	// globs. Globs are relative to the root of the repo and a glob that
+	// matches a directory matches everything in it.
+	SetSparsePaths(include, exclude []string)
+
+	// Return the files, relative to the vcs directory, that are in the repo
+	// but were left out of the checkout.
+	SparseFiles(dir string) ([]string, error)
+}
+
+// Implemented by drivers whose revisions depend on the files in the working
+// directory that are not ignored.
+type IgnoreDriver interface {
+
+	// Ignore the files that match the patterns in the ignore files with the
+	// given names, in increasing order of precedence.
+	SetIgnoreFiles(names []string)
+}
+
+// Implemented by drivers that run external commands, or otherwise wait on
+// remotes that may hang.
+type CommandDriver interface {
+
+	// Kill each command that runs for longer than the timeout, or
+	// DefaultCommandTimeout if it is 0.
+	SetCommandTimeout(timeout time.Duration)
+
+	// Kill any running commands and fail any that are run afterwards.
+	Stop()
+}
+
+// The files of a revision of a repo, which are read from the objects of the
+// repo rather than from a working directory.
+type Tree interface {
+
+	// Call fn with the slash separated path, the mode and the blob id of
+	// each file. Symlinks have the os.ModeSymlink mode.
+	Walk(fn func(path string, mode os.FileMode, blob string) error) error
+
+	// Read the content of a file by its blob id.
+	ReadBlob(blob string) ([]byte, error)
+
+	Close() error
+}
+
+// Implemented by drivers that can keep repos without a working directory,
+// whose revisions are indexed from the objects of the repo instead.
+type TreeDriver interface {
+
+	// Open the files of rev in the repo in dir, or return nil if the repo
+	// has a working directory to index.
+	OpenTree(dir, rev string) (Tree, error)
+}
+
+// Implemented by drivers that keep the objects that pulls leave behind until
+// they are told which revisions are still needed, since the indexes of trees
+// read from them.
+type PruneDriver interface {
+
+	// Remove the objects that neither the pulled revision nor any of the
+	// revisions to keep need.
+	Prune(dir string, keep []string) error
 }
 
 // An API to interact with a vcs working directory. This is
@@ -79,3 +267,101 @@ func (w *WorkDir) PullOrClone(dir, url string) (string, error) {
 	}
 	return w.Clone(dir, url)
 }
+
+// Return the refs of the working directory that are indexed, or nil if the
+// driver only indexes the working directory as it is pulled.
+func (w *WorkDir) ListRefs(dir string) ([]string, error) {
+	if d, ok := w.Driver.(RefsDriver); ok {
+		return d.ListRefs(dir)
+	}
+	return nil, nil
+}
+
+// Check out a ref that was returned by ListRefs and return its revision.
+func (w *WorkDir) Checkout(dir, ref string) (string, error) {
+	if d, ok := w.Driver.(RefsDriver); ok {
+		return d.Checkout(dir, ref)
+	}
+	return "", fmt.Errorf("vcs: cannot check out %s", ref)
+}
+
+// Check out a revision of the repo into a new directory, see WorktreeDriver.
+func (w *WorkDir) AddWorktree(dir, wtDir, rev string) (string, error) {
+	if d, ok := w.Driver.(WorktreeDriver); ok {
+		return d.AddWorktree(dir, wtDir, rev)
+	}
+	return "", errors.New("vcs: checking out revisions is not supported")
+}
+
+// Remove a directory that was created by AddWorktree.
+func (w *WorkDir) RemoveWorktree(dir, wtDir string) error {
+	if d, ok := w.Driver.(WorktreeDriver); ok {
+		return d.RemoveWorktree(dir, wtDir)
+	}
+	return os.RemoveAll(wtDir)
+}
+
+// Return the commits that lead up to rev, or nil if the driver does not keep
+// the history of the repo.
+func (w *WorkDir) Log(dir, rev string) ([]*Commit, error) {
+	if d, ok := w.Driver.(HistoryDriver); ok {
+		return d.Log(dir, rev)
+	}
+	return nil, nil
+}
+
+// Limit the paths that are checked out, see SparseDriver. Drivers that cannot
+// check out part of a repo check out every path.
+func (w *WorkDir) SetSparsePaths(include, exclude []string) {
+	if d, ok := w.Driver.(SparseDriver); ok {
+		d.SetSparsePaths(include, exclude)
+	}
+}
+
+// Return the files that were left out of the checkout, or nil if the driver
+// checks out every path.
+func (w *WorkDir) SparseFiles(dir string) ([]string, error) {
+	if d, ok := w.Driver.(SparseDriver); ok {
+		return d.SparseFiles(dir)
+	}
+	return nil, nil
+}
+
+// Set the ignore files of the repo, see IgnoreDriver.
+func (w *WorkDir) SetIgnoreFiles(names []string) {
+	if d, ok := w.Driver.(IgnoreDriver); ok {
+		d.SetIgnoreFiles(names)
+	}
+}
+
+// Set how long each command of the driver may run, see CommandDriver.
+func (w *WorkDir) SetCommandTimeout(timeout time.Duration) {
+	if d, ok := w.Driver.(CommandDriver); ok {
+		d.SetCommandTimeout(timeout)
+	}
+}
+
+// Kill the running commands of the driver, see CommandDriver. The WorkDir
+// should not be used afterwards.
+func (w *WorkDir) Stop() {
+	if d, ok := w.Driver.(CommandDriver); ok {
+		d.Stop()
+	}
+}
+
+// Remove the objects that are no longer needed, see PruneDriver.
+func (w *WorkDir) Prune(dir string, keep []string) error {
+	if d, ok := w.Driver.(PruneDriver); ok {
+		return d.Prune(dir, keep)
+	}
+	return nil
+}
+
+// Open the files of a revision, see TreeDriver. Returns nil for drivers that
+// index the working directory.
+func (w *WorkDir) OpenTree(dir, rev string) (Tree, error) {
+	if d, ok := w.Driver.(TreeDriver); ok {
+		return d.OpenTree(dir, rev)
+	}
+	return nil, nil
+}
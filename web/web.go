@@ -3,10 +3,13 @@ package web
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 
 	"github.com/hound-search/hound/api"
+	"github.com/hound-search/hound/auth"
 	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/metrics"
 	"github.com/hound-search/hound/searcher"
 	"github.com/hound-search/hound/ui"
 )
@@ -20,6 +23,7 @@ type Server struct {
 	configFile string
 	dev        bool
 	ch         chan error
+	auth       auth.Authenticator
 
 	mux           *http.ServeMux
 	lck           sync.RWMutex
@@ -29,7 +33,38 @@ type Server struct {
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == s.cfg.HealthCheckURI {
-		fmt.Fprintln(w, "👍")
+		s.serveHealthCheck(w)
+		return
+	}
+
+	if s.serveCors(w, r) {
+		return
+	}
+
+	if role := requiredRole(r); role != auth.RoleNone {
+		id, err := s.auth.Authenticate(r)
+		if err != nil || (id.Role < role && id.Name == "") {
+			if c := auth.Challenge(s.auth); c != "" {
+				w.Header().Set("WWW-Authenticate", c)
+			}
+			http.Error(w,
+				http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+			return
+		}
+
+		if id.Role < role {
+			http.Error(w,
+				http.StatusText(http.StatusForbidden),
+				http.StatusForbidden)
+			return
+		}
+
+		r = r.WithContext(auth.WithIdentity(r.Context(), id))
+	}
+
+	if r.URL.Path == "/metrics" {
+		metrics.Handler().ServeHTTP(w, r)
 		return
 	}
 
@@ -44,6 +79,80 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// The health check always returns 200 while the server is up. The body is
+// "👍" when every repo is healthy and the number of repos whose last poll
+// failed when the server is up but some indexes are stale. The check is not
+// authenticated, so it does not name the repos, which the status of each
+// repo does.
+func (s *Server) serveHealthCheck(w http.ResponseWriter) {
+	stale := 0
+	for _, srch := range s.GetSearchers() {
+		if srch.Status().Stale {
+			stale++
+		}
+	}
+
+	if stale == 0 {
+		fmt.Fprintln(w, "👍")
+		return
+	}
+
+	fmt.Fprintf(w, "stale: %d\n", stale)
+}
+
+// The role a client needs for a request. Mutations, including requests for
+// indexes of revisions, need the admin role and everything else needs the read
+// role, except for webhooks which are called by code hosts. Metrics are labeled
+// with the names of all repos, including those restricted to groups, so they
+// need the admin role as well.
+func requiredRole(r *http.Request) auth.Role {
+	p := r.URL.Path
+	switch {
+	case api.IsWebhook(p):
+		return auth.RoleNone
+	case p == "/api/v1/repos/add", p == "/api/v1/update", p == "/api/v1/config/reload", p == "/metrics":
+		return auth.RoleAdmin
+	case strings.HasPrefix(p, "/api/v1/repos/") && r.Method != "GET" && r.Method != "HEAD":
+		return auth.RoleAdmin
+	}
+	return auth.RoleRead
+}
+
+// Set the CORS headers on API responses for the origins in the config. This
+// returns true if the request was a preflight, which has been answered.
+func (s *Server) serveCors(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	var allowed string
+	for _, o := range s.cfg.CorsOrigins {
+		if o == "*" || o == origin {
+			allowed = o
+			break
+		}
+	}
+
+	if allowed == "" {
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", allowed)
+	if allowed != "*" {
+		w.Header().Add("Vary", "Origin")
+	}
+
+	if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
 func (s *Server) serveWith(m *http.ServeMux) {
 	s.lck.Lock()
 	defer s.lck.Unlock()
@@ -54,12 +163,17 @@ func (s *Server) serveWith(m *http.ServeMux) {
 // The HTTP server will return 200 on the health check, but a 503 on every other
 // request until ServeWithIndex is called to begin serving search traffic with
 // the given searchers.
-func Start(cfg *config.Config, addr string, dev bool) *Server {
+func Start(cfg *config.Config, addr string, dev bool) (*Server, error) {
 	return StartWithConfigFile(cfg, "config.json", addr, dev)
 }
 
 // StartWithConfigFile creates a new server with a specific config file path
-func StartWithConfigFile(cfg *config.Config, configFile string, addr string, dev bool) *Server {
+func StartWithConfigFile(cfg *config.Config, configFile string, addr string, dev bool) (*Server, error) {
+	a, err := auth.New(cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+
 	ch := make(chan error)
 
 	s := &Server{
@@ -67,23 +181,24 @@ func StartWithConfigFile(cfg *config.Config, configFile string, addr string, dev
 		configFile: configFile,
 		dev:        dev,
 		ch:         ch,
+		auth:       a,
 	}
 
+	s.registerMetrics()
+
 	go func() {
 		ch <- http.ListenAndServe(addr, s)
 	}()
 
-	return s
+	return s, nil
 }
 
 // ServeWithIndex allow the server to start offering the search UI and the
 // search APIs operating on the given indexes.
 func (s *Server) ServeWithIndex(idx map[string]*searcher.Searcher) error {
-	s.searchersLock.Lock()
-	s.searchers = idx
-	s.searchersLock.Unlock()
+	s.SetSearchers(idx)
 
-	h, err := ui.Content(s.dev, s.cfg)
+	h, err := ui.Content(s.dev, s.cfg, s.visibleRepos)
 	if err != nil {
 		return err
 	}
@@ -97,6 +212,43 @@ func (s *Server) ServeWithIndex(idx map[string]*searcher.Searcher) error {
 	return <-s.ch
 }
 
+// Register the metrics that are collected from the searchers when they are
+// scraped.
+func (s *Server) registerMetrics() {
+	metrics.NewGaugeFunc(
+		"hound_pending_updates",
+		"Number of requested updates that have not started.",
+		[]string{"repo"},
+		func(set func(float64, ...string)) {
+			for name, srch := range s.GetSearchers() {
+				set(float64(srch.PendingUpdates()), name)
+			}
+		})
+
+	metrics.NewGaugeFunc(
+		"hound_index_size_bytes",
+		"Size of the indexes of all refs on disk.",
+		[]string{"repo"},
+		func(set func(float64, ...string)) {
+			for name, srch := range s.GetSearchers() {
+				status := srch.Status()
+				set(float64(status.TotalIndexSize()), name)
+			}
+		})
+}
+
+// The repos of the searchers that the client of the request may see.
+func (s *Server) visibleRepos(r *http.Request) map[string]*config.Repo {
+	id := auth.FromContext(r.Context())
+	repos := map[string]*config.Repo{}
+	for name, srch := range s.GetSearchers() {
+		if id.CanSee(srch.Repo) {
+			repos[name] = srch.Repo
+		}
+	}
+	return repos
+}
+
 // GetSearchers returns the current searchers map (thread-safe)
 func (s *Server) GetSearchers() map[string]*searcher.Searcher {
 	s.searchersLock.RLock()
@@ -109,6 +261,13 @@ func (s *Server) GetSearchers() map[string]*searcher.Searcher {
 	return result
 }
 
+// SetSearchers replaces all of the server's searchers (thread-safe)
+func (s *Server) SetSearchers(idx map[string]*searcher.Searcher) {
+	s.searchersLock.Lock()
+	defer s.searchersLock.Unlock()
+	s.searchers = idx
+}
+
 // AddSearcher adds a new searcher to the server (thread-safe)
 func (s *Server) AddSearcher(name string, srch *searcher.Searcher) {
 	s.searchersLock.Lock()
@@ -119,6 +278,26 @@ func (s *Server) AddSearcher(name string, srch *searcher.Searcher) {
 	s.searchers[name] = srch
 }
 
+// RemoveSearcher removes a searcher from the server (thread-safe)
+func (s *Server) RemoveSearcher(name string) {
+	s.searchersLock.Lock()
+	defer s.searchersLock.Unlock()
+	delete(s.searchers, name)
+}
+
+// ReplaceSearcher replaces the searcher for an existing repo and returns
+// the searcher that was previously registered under the name (thread-safe)
+func (s *Server) ReplaceSearcher(name string, srch *searcher.Searcher) *searcher.Searcher {
+	s.searchersLock.Lock()
+	defer s.searchersLock.Unlock()
+	if s.searchers == nil {
+		s.searchers = make(map[string]*searcher.Searcher)
+	}
+	old := s.searchers[name]
+	s.searchers[name] = srch
+	return old
+}
+
 // GetConfig returns the server's config
 func (s *Server) GetConfig() *config.Config {
 	return s.cfg